@@ -0,0 +1,201 @@
+package auth
+
+import (
+    "crypto/sha256"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "os"
+    "strings"
+    "sync/atomic"
+    "time"
+    "github.com/gin-gonic/gin"
+	"github.com/starqi/wi-util-servers/internal/logging"
+)
+
+// Permissions, granted per key
+const (
+    // Describe, patch and revoke tokens
+    PermSessions = "sessions"
+    // Mute, kick and ban
+    PermModerate = "moderate"
+    // Register and heartbeat game servers
+    PermServers = "servers"
+    // Chat history, filter hits and system messages
+    PermChat = "chat"
+    PermReports = "reports"
+    // Prometheus scrapes
+    PermMetrics = "metrics"
+    // Grants everything
+    PermAll = "*"
+)
+
+// Name of the authenticated key, set on the gin context
+const KeyNameContextKey = "authKeyName"
+
+var logger = logging.For("auth")
+
+const reloadPollInterval = 5 * time.Second
+const minKeyLength = 16
+
+// Keyring file is JSON
+type Config struct {
+    Keys []KeyConfig `json:"keys"`
+}
+
+type KeyConfig struct {
+    // For logs only
+    Name string `json:"name"`
+    // Sent as a bearer token
+    Key string `json:"key"`
+    Permissions []string `json:"permissions"`
+}
+
+type key struct {
+    name string
+    permissions map[string]bool
+}
+
+// SHA-256 of the key -> key, so lookups don't compare secrets directly
+type keys map[[sha256.Size]byte]*key
+
+type Keyring struct {
+    path string
+    keys atomic.Pointer[keys]
+    modTime time.Time
+}
+
+func isValidPermission(permission string) bool {
+    switch permission {
+    case PermSessions, PermModerate, PermServers, PermChat, PermReports, PermMetrics, PermAll:
+        return true
+    default:
+        return false
+    }
+}
+
+func compile(config *Config) (*keys, error) {
+    result := make(keys)
+    for i, k := range config.Keys {
+        if k.Name == "" {
+            return nil, fmt.Errorf("Key %d has no name", i)
+        }
+        if len(k.Key) < minKeyLength {
+            return nil, fmt.Errorf("Key %s must be at least %d characters", k.Name, minKeyLength)
+        }
+        hash := sha256.Sum256([]byte(k.Key))
+        if _, found := result[hash]; found {
+            return nil, fmt.Errorf("Key %s is a duplicate", k.Name)
+        }
+        permissions := make(map[string]bool)
+        for _, permission := range k.Permissions {
+            if !isValidPermission(permission) {
+                return nil, fmt.Errorf("Invalid permission %s for key %s", permission, k.Name)
+            }
+            permissions[permission] = true
+        }
+        result[hash] = &key { k.Name, permissions }
+    }
+    return &result, nil
+}
+
+func MakeKeyringFromConfig(config *Config) (*Keyring, error) {
+    compiled, err := compile(config)
+    if err != nil {
+        return nil, err
+    }
+    k := &Keyring{}
+    k.keys.Store(compiled)
+    return k, nil
+}
+
+// Polls the file for changes and reloads it, keeping the previous keys if the new file is invalid
+func MakeKeyring(path string) (*Keyring, error) {
+    k := &Keyring { path: path }
+    if err := k.reload(); err != nil {
+        return nil, err
+    }
+    go k.watcher()
+    return k, nil
+}
+
+func (k *Keyring) reload() error {
+    info, err := os.Stat(k.path)
+    if err != nil {
+        return err
+    }
+    raw, err := os.ReadFile(k.path)
+    if err != nil {
+        return err
+    }
+    var config Config
+    if err := json.Unmarshal(raw, &config); err != nil {
+        return err
+    }
+    compiled, err := compile(&config)
+    if err != nil {
+        return err
+    }
+    k.keys.Store(compiled)
+    k.modTime = info.ModTime()
+    logger.Info("Loaded keyring", "path", k.path, "keys", len(config.Keys))
+    return nil
+}
+
+func (k *Keyring) watcher() {
+    ticker := time.NewTicker(reloadPollInterval)
+    for {
+        <-ticker.C
+        info, err := os.Stat(k.path)
+        if err != nil {
+            logger.Error("Failed to check keyring, keeping previous", "err", err)
+            continue
+        }
+        if info.ModTime().Equal(k.modTime) {
+            continue
+        }
+        if err := k.reload(); err != nil {
+            logger.Error("Failed to reload keyring, keeping previous", "err", err)
+            // Don't retry until the file changes again
+            k.modTime = info.ModTime()
+        }
+    }
+}
+
+// Nil if the bearer key is unknown
+func (k *Keyring) find(authorization string) *key {
+    bearer, found := strings.CutPrefix(authorization, "Bearer ")
+    if !found || bearer == "" {
+        return nil
+    }
+    return (*k.keys.Load())[sha256.Sum256([]byte(bearer))]
+}
+
+// Middleware, 401 for a missing or unknown key, 403 if the key lacks the permission.
+// Every authenticated request is logged with the key name, but never the key.
+// A nil keyring rejects everything with 503, so a missing keyring never leaves private routes open.
+func (k *Keyring) Require(permission string) gin.HandlerFunc {
+    if k == nil {
+        return func (c *gin.Context) {
+            logger.WarnContext(c.Request.Context(), "Auth rejected, no keyring", "method", c.Request.Method, "route", c.FullPath(), "clientIp", c.ClientIP())
+            c.AbortWithStatus(http.StatusServiceUnavailable)
+        }
+    }
+    return func (c *gin.Context) {
+        found := k.find(c.GetHeader("Authorization"))
+        if found == nil {
+            logger.WarnContext(c.Request.Context(), "Auth rejected, unknown key", "method", c.Request.Method, "route", c.FullPath(), "clientIp", c.ClientIP())
+            c.AbortWithStatus(http.StatusUnauthorized)
+            return
+        }
+        if !found.permissions[permission] && !found.permissions[PermAll] {
+            logger.WarnContext(c.Request.Context(), "Auth rejected, missing permission", "method", c.Request.Method, "route", c.FullPath(), "clientIp", c.ClientIP(), "keyName", found.name, "permission", permission)
+            c.AbortWithStatus(http.StatusForbidden)
+            return
+        }
+
+        c.Set(KeyNameContextKey, found.name)
+        c.Next()
+        logger.InfoContext(c.Request.Context(), "Auth", "keyName", found.name, "method", c.Request.Method, "route", c.FullPath(), "clientIp", c.ClientIP(), "status", c.Writer.Status())
+    }
+}
@@ -0,0 +1,80 @@
+package auth
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "github.com/gin-gonic/gin"
+)
+
+func request(router *gin.Engine, path string, authorization string) int {
+    req := httptest.NewRequest(http.MethodGet, path, nil)
+    if authorization != "" {
+        req.Header.Set("Authorization", authorization)
+    }
+    w := httptest.NewRecorder()
+    router.ServeHTTP(w, req)
+    return w.Code
+}
+
+func TestRequire(t *testing.T) {
+    keyring, err := MakeKeyringFromConfig(&Config { Keys: []KeyConfig {
+        { Name: "game", Key: "game-server-key-0001", Permissions: []string { PermSessions, PermServers } },
+        { Name: "admin", Key: "admin-key-00000001", Permissions: []string { PermAll } },
+    }})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    router := gin.New()
+    var keyName string
+    router.GET("/token", keyring.Require(PermSessions), func (c *gin.Context) {
+        keyName = c.GetString(KeyNameContextKey)
+        c.Status(http.StatusOK)
+    })
+    router.GET("/bans", keyring.Require(PermModerate), func (c *gin.Context) { c.Status(http.StatusOK) })
+
+    if code := request(router, "/token", ""); code != http.StatusUnauthorized {
+        t.Fatalf("Expected 401 without a key, got %d", code)
+    }
+    if code := request(router, "/token", "Bearer wrong-key-000000000"); code != http.StatusUnauthorized {
+        t.Fatalf("Expected 401 for an unknown key, got %d", code)
+    }
+    if code := request(router, "/token", "game-server-key-0001"); code != http.StatusUnauthorized {
+        t.Fatalf("Expected 401 without the bearer scheme, got %d", code)
+    }
+    if code := request(router, "/token", "Bearer game-server-key-0001"); code != http.StatusOK || keyName != "game" {
+        t.Fatalf("Expected 200 as game, got %d as %s", code, keyName)
+    }
+    if code := request(router, "/bans", "Bearer game-server-key-0001"); code != http.StatusForbidden {
+        t.Fatalf("Expected 403 without the permission, got %d", code)
+    }
+    if code := request(router, "/bans", "Bearer admin-key-00000001"); code != http.StatusOK {
+        t.Fatalf("Expected 200 for the wildcard permission, got %d", code)
+    }
+
+    var nilKeyring *Keyring
+    closed := gin.New()
+    closed.GET("/token", nilKeyring.Require(PermSessions), func (c *gin.Context) { c.Status(http.StatusOK) })
+    if code := request(closed, "/token", "Bearer admin-key-00000001"); code != http.StatusServiceUnavailable {
+        t.Fatalf("Expected a nil keyring to reject everything, got %d", code)
+    }
+}
+
+func TestInvalidKeyring(t *testing.T) {
+    configs := []Config {
+        { Keys: []KeyConfig { { Name: "short", Key: "short" } } },
+        { Keys: []KeyConfig { { Name: "bad", Key: "bad-permission-key", Permissions: []string { "everything" } } } },
+        { Keys: []KeyConfig { { Name: "a", Key: "duplicate-key-0001" }, { Name: "b", Key: "duplicate-key-0001" } } },
+    }
+    for i := range configs {
+        if _, err := MakeKeyringFromConfig(&configs[i]); err == nil {
+            t.Fatalf("Expected config %d to be rejected", i)
+        }
+    }
+}
+
+func TestMain(m *testing.M) {
+    gin.SetMode(gin.TestMode)
+    m.Run()
+}
@@ -1,28 +1,108 @@
 package chat
 
 import (
+    "context"
     "time"
-    "log"
-    "fmt"
+    "github.com/google/uuid"
     "github.com/gorilla/websocket"
+	"github.com/starqi/wi-util-servers/cmd/chat/filter"
+	"github.com/starqi/wi-util-servers/cmd/chat/history"
+	"github.com/starqi/wi-util-servers/cmd/chat/reports"
 	"github.com/starqi/wi-util-servers/cmd/chat/sessions"
+	"github.com/starqi/wi-util-servers/internal/broker"
+	"github.com/starqi/wi-util-servers/internal/deadline"
+	"github.com/starqi/wi-util-servers/internal/logging"
+	"github.com/starqi/wi-util-servers/internal/metrics"
 )
 
+// What chat uses of the sessions service
+type SessionsService interface {
+    Get(ctx context.Context, token string) (*sessions.Session, error)
+    sessions.EventSource
+    sessions.ChatChecks
+}
+
+// Callbacks must be buffered, see `deadline.Call`
+type KickData struct{SessionID string; Reason string; Cb chan int}
+// Returns the number of rooms the message was added to
+type SystemData struct{Room string; Global bool; Text string; Cb chan int}
+
 type Chat struct {
     Register chan *websocket.Conn
+    KickChan chan KickData
+    SystemChan chan SystemData
+    PresenceChan chan PresenceData
     unregister chan *client
-    inbound chan string
+    authenticated chan *client
+    inbound chan inboundMessage
+    notices chan notice
+    snapshots chan snapshotData
+    closing chan chan bool
+    pings chan chan bool
+    sessionEvents *sessions.Subscription
     clients map[*client]bool
-    sessionsService *sessions.Sessions
+    // Session ID -> clients, only for authenticated clients
+    sessionClients map[string]map[*client]bool
+    flood floodControl
+    rooms map[string]*room
+    options Options
+    sessionsService SessionsService
+    // Nil if chat logs are not persisted
+    historyDb *history.HistoryDb
+    // Nil if messages are not filtered
+    filters *filter.Pipeline
+    reports reports.Store
+    // Nil if not replicated to other nodes
+    broker broker.Broker
+    node string
+    replicas <-chan []byte
 }
 
-func MakeChat(sessionsService *sessions.Sessions) *Chat {
+func MakeChat(
+    sessionsService SessionsService,
+    options Options,
+    historyDb *history.HistoryDb,
+    filters *filter.Pipeline,
+    reportsStore reports.Store,
+    b broker.Broker,
+) *Chat {
     chat := Chat {
         make(chan *websocket.Conn),
+        make(chan KickData),
+        make(chan SystemData),
+        make(chan PresenceData),
         make(chan *client),
-        make(chan string, 20),
+        make(chan *client),
+        make(chan inboundMessage, 20),
+        make(chan notice, 20),
+        make(chan snapshotData),
+        make(chan chan bool),
+        make(chan chan bool),
+        sessions.MakeSubscription(),
         make(map[*client]bool),
+        make(map[string]map[*client]bool),
+        makeFloodControl(),
+        make(map[string]*room),
+        options,
         sessionsService,
+        historyDb,
+        filters,
+        reportsStore,
+        b,
+        uuid.New().String(),
+        nil,
+    }
+    if b != nil {
+        replicas, err := b.Subscribe(chatTopic)
+        if err != nil {
+            logger.Error("Failed to subscribe to chat replicas, chat will not be shared", "err", err)
+            chat.broker = nil
+        } else {
+            chat.replicas = replicas
+        }
+    }
+    if err := sessionsService.Subscribe(context.Background(), chat.sessionEvents); err != nil {
+        logger.Error("Unexpected session subscribe error", "err", err)
     }
     go chat.aggregator()
     return &chat
@@ -32,110 +112,427 @@ func MakeChat(sessionsService *sessions.Sessions) *Chat {
 
 type client struct {
     conn *websocket.Conn
+    // Written once by the client loop before being sent to the aggregator through `authenticated`
     session *sessions.Session
-    revision uint64
+    // Also written once by the client loop, where the client left off before reconnecting
+    resume *resumeCursor
+    // Owned by the aggregator, nil until authenticated
+    room *room
+    // Sequence number of the last message sent from the room, owned by the aggregator
+    lastSeq uint64
 }
 
-type messages struct {
-    arr []string
-    index int
-    revision uint64
+func (c *client) kick(reason string) {
+    logger.Info("Kicking", "remoteAddr", c.conn.RemoteAddr().String(), "reason", reason)
+    c.disconnect(websocket.ClosePolicyViolation, reason)
 }
 
-func makeMessages(size int) messages {
-    m := messages {
-        arr: make([]string, size),
-        index: 0,
-    }
-    return m
+// Close frame write is allowed concurrently with the client loop's reads, then the read fails and unregisters
+func (c *client) disconnect(code int, reason string) {
+    deadline := time.Now().Add(time.Second)
+    c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+    c.conn.Close()
 }
 
-func (r *messages) add(s string) {
-    r.arr[r.index] = s
-    r.index = (r.index + 1) % len(r.arr)
-    r.revision++
+type inboundMessage struct {
+    c *client
+    // Latest copy, since the player name may have been patched since joining
+    session *sessions.Session
+    text string
 }
 
-func fullModulo(index int, length int) int {
-    // -3 -2 -1 0 1 2 3 4 5 -> 0 -2 -1 0 1 2 0 1 2 -> 312012012 -> 012012012
-    return ((index % length) + length) % length
+type notice struct {
+    c *client
+    o outbound
 }
 
-func (r *messages) forEach(amount int, cb func(int, string)) {
-    l := len(r.arr)
-    if amount < 0 || amount > l { amount = l; }
+var logger = logging.For("chat")
 
-    // Start from latest message minus amount
-    start := fullModulo(r.index - amount, l)
-    for _i := start; _i < start + amount; _i++ {
-        i := fullModulo(_i, l)
+var clientsGauge = metrics.Default.Gauge("chat_clients", "Open chat websockets on this node")
+var messagesCounter = metrics.Default.Counter("chat_messages_total", "Chat messages accepted on this node")
 
-        item := r.arr[i]
-        if item == "" {
-            break;
-        }
-        cb(i, item)
+// For sessions service calls from client loops
+const sessionsTimeout = 5 * time.Second
+
+type Options struct {
+    // Messages kept per room, for resuming after reconnect
+    HistorySize int
+    // Fresh joins only get the tail of the history
+    InitialReplay int
+    // Messages are batched to clients on every tick
+    OutboundTick time.Duration
+}
+
+// For anything not configured
+func DefaultOptions() Options {
+    return Options {
+        HistorySize: 200,
+        InitialReplay: 20,
+        OutboundTick: 500 * time.Millisecond,
     }
 }
 
-// TODO Force tick if revision delta >= length on inbound, to avoid message loss on mass inbound
 func (chat *Chat) aggregator() {
-    outboundTicker := time.NewTicker(500 * time.Millisecond)
-    msgs := makeMessages(20)
+    outboundTicker := time.NewTicker(chat.options.OutboundTick)
+    defer outboundTicker.Stop()
+    roomPruneTicker := time.NewTicker(time.Minute)
+    defer roomPruneTicker.Stop()
     for {
         select {
         case m := <-chat.inbound:
-            msgs.add(m)
+            chat.onInbound(&m)
         case <-outboundTicker.C:
-            for c := range chat.clients {
-                num_to_send := msgs.revision - c.revision;
-                if num_to_send > 0 {
-                    log.Printf("%s - rev=%d, curr=%d", c.conn.RemoteAddr().String(), msgs.revision, c.revision)
-                    msgs.forEach(int(num_to_send), func (i int, s string) {
-                        //log.Print("Message ", i)
-                        c.conn.WriteMessage(websocket.TextMessage, []byte(s))
-                    })
-                    c.revision = msgs.revision
-                }
+            for _, r := range chat.rooms {
+                chat.flush(r)
             }
-        case conn := <-chat.Register:
-            c := client {
-                conn: conn,
-                revision: 0, // Get all messages on init
+        case n := <-chat.notices:
+            n.c.send(&n.o)
+        case system := <-chat.SystemChan:
+            system.Cb <- chat.onSystem(&system)
+            close(system.Cb)
+        case presence := <-chat.PresenceChan:
+            presence.Cb <- chat.presenceSnapshot()
+            close(presence.Cb)
+        case snapshot := <-chat.snapshots:
+            snapshot.cb <- chat.snapshot(snapshot.room, snapshot.num)
+            close(snapshot.cb)
+        case kick := <-chat.KickChan:
+            kicked := 0
+            for c := range chat.sessionClients[kick.SessionID] {
+                c.kick(kick.Reason)
+                kicked++
             }
+            kick.Cb <- kicked
+            close(kick.Cb)
+        case <-roomPruneTicker.C:
+            chat.pruneRooms()
+        case cb := <-chat.pings:
+            cb <- true
+            close(cb)
+        case cb := <-chat.closing:
+            chat.closeClients()
+            cb <- true
+            close(cb)
+            return
+        case conn := <-chat.Register:
+            conn.SetReadLimit(maxFrameBytes)
+            c := client { conn: conn }
             chat.clients[&c] = true
+            clientsGauge.Set(float64(len(chat.clients)))
             go chat.clientLoop(&c)
+        case c := <-chat.authenticated:
+            c.sendJoined(chat.joinRoom(c, c.session.GameInstance, c.resume))
+            id := c.session.ID
+            if chat.sessionClients[id] == nil {
+                chat.sessionClients[id] = make(map[*client]bool)
+            }
+            chat.sessionClients[id][c] = true
+        case payload, ok := <-chat.replicas:
+            if !ok {
+                logger.Warn("Chat replicas closed")
+                chat.replicas = nil
+                continue
+            }
+            chat.onReplica(payload)
+        case <-chat.sessionEvents.Ready():
+            for _, event := range chat.sessionEvents.Drain() {
+                chat.onSessionEvent(&event)
+            }
         case c := <-chat.unregister:
             delete(chat.clients, c)
+            clientsGauge.Set(float64(len(chat.clients)))
+            chat.leaveRoom(c)
+            if c.session != nil {
+                id := c.session.ID
+                delete(chat.sessionClients[id], c)
+                if len(chat.sessionClients[id]) == 0 {
+                    delete(chat.sessionClients, id)
+                }
+            }
         }
     }
 }
 
+// Buffered channels into the aggregator, for metrics. Safe to call from any goroutine.
+func (chat *Chat) QueueDepths() map[string]int {
+    return map[string]int {
+        "chat_inbound": len(chat.inbound),
+        "chat_notices": len(chat.notices),
+        "chat_session_events": chat.sessionEvents.Len(),
+        "chat_replicas": len(chat.replicas),
+    }
+}
+
+// Sends what is pending, then close frames so clients know to reconnect elsewhere
+func (chat *Chat) closeClients() {
+    for _, r := range chat.rooms {
+        chat.flush(r)
+    }
+    for c := range chat.clients {
+        c.disconnect(websocket.CloseGoingAway, "Server shutting down")
+    }
+    logger.Info("Closed chat clients", "count", len(chat.clients))
+}
+
+// Succeeds if the aggregator is responding, for readiness checks
+func (chat *Chat) Ping(ctx context.Context) error {
+    cb := make(chan bool, 1)
+    _, err := deadline.Call(ctx, chat.pings, cb, cb)
+    return err
+}
+
+// Stops the aggregator after closing every client, for shutting down.
+// Nothing may be sent to the chat afterwards, eg. the HTTP server must already be shut down.
+func (chat *Chat) Close(ctx context.Context) error {
+    cb := make(chan bool, 1)
+    _, err := deadline.Call(ctx, chat.closing, cb, cb)
+    return err
+}
+
+// Only authenticated clients are in rooms and receive messages
+func (chat *Chat) flush(r *room) {
+    msgs := &r.msgs
+    for c := range r.clients {
+        if c.lastSeq >= msgs.lastSeq {
+            continue
+        }
+        logger.Debug("Flushing", "remoteAddr", c.conn.RemoteAddr().String(), "room", r.name, "seq", msgs.lastSeq, "curr", c.lastSeq)
+        missed := msgs.since(c.lastSeq, func (o *outbound) {
+            c.send(o)
+        })
+        if missed > 0 {
+            logger.Warn("Client missed messages", "remoteAddr", c.conn.RemoteAddr().String(), "missed", missed)
+        }
+        c.lastSeq = msgs.lastSeq
+    }
+    msgs.pending = 0
+}
+
+func (chat *Chat) onInbound(m *inboundMessage) {
+    if m.c.room == nil {
+        return
+    }
+    now := time.Now()
+    verdict := chat.flood.check(m.c.session.ID, m.text, now)
+    switch verdict.action {
+    case floodOk:
+        text, ok := chat.filter(m, now)
+        if !ok {
+            m.c.send(&outbound { Type: typeNotice, Text: "Message blocked by chat filter" })
+            return
+        }
+        o := outbound { Type: typeChat, PlayerName: m.session.PlayerName, Text: text }
+        chat.addMessage(m.c.room, o)
+        m.c.room.lastActive = now
+        messagesCounter.Inc()
+        chat.replicate(chatEvent { Room: m.c.room.name, Message: &o })
+        if chat.historyDb != nil {
+            chat.historyDb.Log(history.ChatLog {
+                Room: m.c.room.name,
+                SessionID: m.c.session.ID,
+                PlayerName: m.session.PlayerName,
+                Text: m.text,
+                CreatedAt: now.Unix(),
+            })
+        }
+    case floodWarn:
+        m.c.send(&outbound { Type: typeNotice, Penalty: penaltyWarn, Text: verdict.reason })
+    case floodMute, floodMuted:
+        logger.Info("Muted", "session", m.c.session, "reason", verdict.reason)
+        m.c.send(&outbound {
+            Type: typeNotice,
+            Penalty: penaltyMute,
+            Text: verdict.reason,
+            Seconds: int(verdict.remaining.Seconds() + 0.5),
+        })
+    case floodKick:
+        m.c.send(&outbound { Type: typeNotice, Penalty: penaltyKick, Text: verdict.reason })
+        m.c.kick(verdict.reason)
+    }
+}
+
+// Never attributed to a player, and not filtered
+func (chat *Chat) onSystem(system *SystemData) int {
+    targets := make([]*room, 0)
+    if system.Global {
+        for _, r := range chat.rooms {
+            targets = append(targets, r)
+        }
+    } else {
+        // Create the room if needed, so players joining soon still see it
+        targets = append(targets, chat.getRoom(system.Room))
+    }
+
+    now := time.Now()
+    for _, r := range targets {
+        chat.addMessage(r, outbound { Type: typeSystem, Text: system.Text })
+        if chat.historyDb != nil {
+            chat.historyDb.Log(history.ChatLog { Room: r.name, Text: system.Text, CreatedAt: now.Unix() })
+        }
+    }
+    o := outbound { Type: typeSystem, Text: system.Text }
+    if system.Global {
+        chat.replicate(chatEvent { Message: &o })
+    } else {
+        chat.replicate(chatEvent { Room: system.Room, Message: &o })
+    }
+    logger.Info("System message", "rooms", len(targets), "text", system.Text)
+    return len(targets)
+}
+
+// Returns the text to send, or false if rejected
+func (chat *Chat) filter(m *inboundMessage, now time.Time) (string, bool) {
+    if chat.filters == nil {
+        return m.text, true
+    }
+    result := chat.filters.Check(m.c.room.name, m.text)
+    if result.Action == "" {
+        return result.Text, true
+    }
+    chat.filters.RecordHit(filter.Hit {
+        Room: m.c.room.name,
+        SessionID: m.session.ID,
+        PlayerName: m.session.PlayerName,
+        Text: m.text,
+        Hits: result.Hits,
+        Action: result.Action,
+        CreatedAt: now.Unix(),
+    })
+    return result.Text, result.Action != filter.ActionReject
+}
+
+func (chat *Chat) onSessionEvent(event *sessions.SessionEvent) {
+    var reason string
+    switch event.Kind {
+    case sessions.SessionExpired:
+        chat.flood.forget(event.Session.ID)
+        reason = "Session expired"
+    case sessions.SessionRevoked:
+        chat.flood.forget(event.Session.ID)
+        reason = "Session revoked"
+    case sessions.SessionMuted:
+        text := "Muted by a moderator"
+        if mutedSeconds(&event.Session) == 0 {
+            text = "Unmuted by a moderator"
+        }
+        for c := range chat.sessionClients[event.Session.ID] {
+            c.send(&outbound { Type: typeNotice, Penalty: penaltyMute, Text: text, Seconds: mutedSeconds(&event.Session) })
+        }
+        return
+    case sessions.SessionBanned:
+        reason = "Banned"
+    case sessions.SessionPatched:
+        if event.Session.IsInGame {
+            chat.followGameInstance(&event.Session)
+            return
+        }
+        reason = "Left game"
+    default:
+        return
+    }
+    // Unregister will clean up the maps after the client loop's read fails
+    for c := range chat.sessionClients[event.Session.ID] {
+        c.kick(reason)
+    }
+}
+
+func mutedSeconds(session *sessions.Session) int {
+    remaining := time.Until(session.MutedUntil)
+    if remaining <= 0 {
+        return 0
+    }
+    return int(remaining.Seconds() + 0.5)
+}
+
+// Nil if the sessions service did not respond in time.
+// By session ID once authenticated, since the token may have been replaced by a patch or refresh.
+func (chat *Chat) chatCheck(token string, sessionID string) *sessions.ChatCheck {
+    ctx, cancel := context.WithTimeout(context.Background(), sessionsTimeout)
+    defer cancel()
+    var check *sessions.ChatCheck
+    var err error
+    if sessionID != "" {
+        check, err = chat.sessionsService.ChatCheckByID(ctx, sessionID)
+    } else {
+        check, err = chat.sessionsService.ChatCheck(ctx, token)
+    }
+    if err != nil {
+        logger.Warn("Chat check failed", "err", err)
+        return nil
+    }
+    return check
+}
+
 func (chat *Chat) clientLoop(c *client) {
     for {
         messageType, p, err := c.conn.ReadMessage()
         if err != nil {
-            log.Print("Closing client ", err) // Could just be disconnect
+            logger.Debug("Closing client", "err", err) // Could just be disconnect
             chat.unregister <- c
             return
         }
 
-        if messageType == websocket.TextMessage {
-            msg := string(p)
+        if messageType != websocket.TextMessage {
+            continue
+        }
+
+        msg := string(p)
+        if c.session == nil {
+            auth := parseAuth(msg)
+            c.resume = auth.resume()
+            check := chat.chatCheck(auth.Token, "")
+            if check == nil {
+                c.conn.Close()
+                continue
+            }
+            c.session = check.Session
             if c.session == nil {
-                cb := make(chan *sessions.Session)
-                chat.sessionsService.FindChan <- sessions.FindData{Token: msg, Cb: cb}
-                c.session = <-cb
-                if c.session == nil {
-                    log.Print("Invalid token on chat join, closing ", msg)
-                    c.conn.Close()
-                } else if !c.session.IsInGame {
-                    log.Print("Cannot join chat when not in game, closing ", c.session)
-                    c.conn.Close()
-                }
+                logger.Info("Invalid token on chat join, closing", "token", auth.Token)
+                c.conn.Close()
+            } else if check.Banned {
+                logger.Info("Banned from chat, closing", "session", c.session)
+                c.kick("Banned")
+            } else if !c.session.IsInGame {
+                logger.Info("Cannot join chat when not in game, closing", "session", c.session)
+                c.conn.Close()
             } else {
-                chat.inbound <- fmt.Sprintf("%s: %s", c.session.PlayerName, msg)
+                chat.authenticated <- c
             }
+            continue
+        }
+
+        // Moderation state lives in the sessions service, so check it on every message
+        check := chat.chatCheck("", c.session.ID)
+        if check == nil {
+            chat.notices <- notice { c, outbound { Type: typeNotice, Text: "Chat is busy, message not sent" } }
+        } else if check.Session == nil {
+            logger.Info("Session gone, closing", "session", c.session)
+            c.conn.Close()
+        } else if check.Banned {
+            c.kick("Banned")
+        } else if command := parseCommand(msg); command != nil {
+            chat.onCommand(c, check.Session, command)
+        } else if mutedSeconds(check.Session) > 0 {
+            chat.notices <- notice { c, outbound {
+                Type: typeNotice,
+                Penalty: penaltyMute,
+                Text: "Muted by a moderator",
+                Seconds: mutedSeconds(check.Session),
+            } }
+        } else {
+            chat.inbound <- inboundMessage { c: c, session: check.Session, text: msg }
+        }
+    }
+}
+
+// Moves clients to their new room if the game server patched their game instance
+func (chat *Chat) followGameInstance(session *sessions.Session) {
+    for c := range chat.sessionClients[session.ID] {
+        if c.room != nil && c.room.name != session.GameInstance {
+            logger.Info("Moving rooms", "remoteAddr", c.conn.RemoteAddr().String(), "from", c.room.name, "to", session.GameInstance)
+            chat.joinRoom(c, session.GameInstance, nil)
+            // Sequence numbers are per room
+            c.sendJoined(true)
         }
     }
 }
@@ -0,0 +1,145 @@
+package chat
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+    "github.com/gorilla/websocket"
+	"github.com/starqi/wi-util-servers/cmd/chat/reports"
+	"github.com/starqi/wi-util-servers/cmd/chat/sessions"
+	"github.com/starqi/wi-util-servers/internal/token"
+)
+
+// More expiries in one tick than the old event buffer held
+func TestExpiryKicksEveryClient(t *testing.T) {
+    const count = 50
+    signer, _ := token.MakeSigner([]byte("0123456789abcdef"))
+    lifetimes := sessions.DefaultLifetimes()
+    // Token expiry is in whole seconds, so leave at least a second to join
+    lifetimes.FromPatch = 2 * time.Second
+    lifetimes.CleanupInterval = 2500 * time.Millisecond
+    store := sessions.MakeSessions(signer, lifetimes, nil, nil)
+    defer store.Close(context.Background())
+    chat := MakeChat(store, DefaultOptions(), nil, nil, nil, nil)
+    defer chat.Close(context.Background())
+
+    upgrader := websocket.Upgrader{}
+    server := httptest.NewServer(http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+        if conn, err := upgrader.Upgrade(w, r, nil); err == nil {
+            chat.Register <- conn
+        }
+    }))
+    defer server.Close()
+    url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+    ctx := context.Background()
+    inGame := true
+    game := "game1"
+    conns := make([]*websocket.Conn, 0, count)
+    for i := 0; i < count; i++ {
+        signed, _ := store.Create(ctx)
+        signed, err := store.Patch(ctx, signed, &sessions.PatchSessionRequest{IsInGame: &inGame, GameInstance: &game})
+        if err != nil {
+            t.Fatal(err)
+        }
+        conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        defer conn.Close()
+        conn.WriteMessage(websocket.TextMessage, []byte(signed))
+        var joined outbound
+        if err := conn.ReadJSON(&joined); err != nil || joined.Type != typeJoined {
+            t.Fatalf("Expected joined, got %v %v", joined, err)
+        }
+        conns = append(conns, conn)
+    }
+
+    for i, conn := range conns {
+        conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+        for {
+            _, _, err := conn.ReadMessage()
+            if err == nil {
+                continue
+            }
+            var closeErr *websocket.CloseError
+            if !errors.As(err, &closeErr) || closeErr.Code != websocket.ClosePolicyViolation {
+                t.Fatalf("Expected client %d to be kicked, got %v", i, err)
+            }
+            break
+        }
+    }
+}
+
+func TestReportSnapshotHasNoToken(t *testing.T) {
+    session := &sessions.Session { ID: "s1", Token: "secret", PlayerName: "Bob" }
+    if sessions.SessionToJson(session).Token != "secret" {
+        t.Fatal("Expected the token in the session JSON")
+    }
+    snapshot, err := snapshotJson(session)
+    if err != nil || strings.Contains(string(snapshot), "secret") || !strings.Contains(string(snapshot), "Bob") {
+        t.Fatalf("Expected the snapshot without the token, got %s %v", snapshot, err)
+    }
+}
+
+// Only what chat uses of the sessions service
+type fakeSessions struct {
+    byToken map[string]*sessions.Session
+}
+
+func (f *fakeSessions) Get(ctx context.Context, token string) (*sessions.Session, error) {
+    if session := f.byToken[token]; session != nil {
+        return session, nil
+    }
+    return nil, sessions.ErrNotFound
+}
+
+func (f *fakeSessions) Subscribe(ctx context.Context, subscription *sessions.Subscription) error {
+    return nil
+}
+
+func (f *fakeSessions) ChatCheck(ctx context.Context, token string) (*sessions.ChatCheck, error) {
+    session, _ := f.Get(ctx, token)
+    return &sessions.ChatCheck { Session: session }, nil
+}
+
+func (f *fakeSessions) ChatCheckByID(ctx context.Context, sessionID string) (*sessions.ChatCheck, error) {
+    return &sessions.ChatCheck{}, nil
+}
+
+func (f *fakeSessions) FindByPlayerName(ctx context.Context, playerName string, gameInstance string) (*sessions.Session, error) {
+    return nil, sessions.ErrNotFound
+}
+
+type fakeReports struct {
+    added []*reports.Report
+}
+
+func (f *fakeReports) Add(report *reports.Report) error {
+    f.added = append(f.added, report)
+    return nil
+}
+
+func (f *fakeReports) List(resolved bool, limit int) ([]reports.Report, error) { return nil, nil }
+func (f *fakeReports) Resolve(id int64, resolution string) error { return nil }
+func (f *fakeReports) Close() error { return nil }
+
+func TestReportWithFakeSessions(t *testing.T) {
+    bob := &sessions.Session { ID: "s1", Token: "t1", PlayerName: "Bob", GameInstance: "game1", IsInGame: true }
+    store := &fakeReports{}
+    chat := MakeChat(&fakeSessions { map[string]*sessions.Session { "t1": bob } }, DefaultOptions(), nil, nil, store, nil)
+    defer chat.Close(context.Background())
+
+    ctx := context.Background()
+    if _, err := chat.Report(ctx, "missing", &ReportRequest { PlayerName: "Alice" }); err != ErrReporterNotFound {
+        t.Fatal("Expected unknown reporter to be rejected, got ", err)
+    }
+    report, err := chat.Report(ctx, "t1", &ReportRequest { PlayerName: "Alice", Reason: "Spam" })
+    if err != nil || len(store.added) != 1 || report.ReporterSessionID != "s1" || report.ReportedSessionID != "" {
+        t.Fatalf("Expected a report from Bob about an unknown Alice, got %v %v", report, err)
+    }
+}
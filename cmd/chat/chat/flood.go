@@ -0,0 +1,109 @@
+package chat
+
+import (
+    "fmt"
+    "time"
+    "unicode/utf8"
+)
+
+const maxMessageLength = 200
+// Hard cap on websocket frames, the connection is dropped if exceeded, so leave room for the softer length check
+const maxFrameBytes = 2048
+
+// Token bucket, allows short bursts
+const bucketCapacity = 5.0
+const bucketRefillPerSecond = 1.0
+
+const duplicateWindow = 10 * time.Second
+
+// Strikes reset if there are no violations for this long
+const strikeDecay = 2 * time.Minute
+const strikesToMute = 3
+const strikesToKick = 6
+const muteDuration = 30 * time.Second
+
+const (
+    floodOk = iota
+    floodWarn = iota
+    floodMute = iota
+    floodMuted = iota
+    floodKick = iota
+)
+
+type floodVerdict struct {
+    action int
+    reason string
+    remaining time.Duration
+}
+
+type floodState struct {
+    tokens float64
+    lastRefill time.Time
+    lastMessage string
+    lastMessageAt time.Time
+    strikes int
+    lastStrike time.Time
+    mutedUntil time.Time
+}
+
+// Keyed by session ID, so reconnecting does not reset penalties.
+// Not thread safe, owned by the aggregator.
+type floodControl struct {
+    states map[string]*floodState
+}
+
+func makeFloodControl() floodControl {
+    return floodControl { states: make(map[string]*floodState) }
+}
+
+func (f *floodControl) forget(id string) {
+    delete(f.states, id)
+}
+
+func (f *floodControl) check(id string, msg string, now time.Time) floodVerdict {
+    state, found := f.states[id]
+    if !found {
+        state = &floodState { tokens: bucketCapacity, lastRefill: now }
+        f.states[id] = state
+    }
+
+    if now.Before(state.mutedUntil) {
+        return floodVerdict { action: floodMuted, reason: "Muted", remaining: state.mutedUntil.Sub(now) }
+    }
+
+    state.tokens += now.Sub(state.lastRefill).Seconds() * bucketRefillPerSecond
+    if state.tokens > bucketCapacity { state.tokens = bucketCapacity; }
+    state.lastRefill = now
+
+    if l := utf8.RuneCountInString(msg); l > maxMessageLength {
+        return state.strike(fmt.Sprintf("Message too long (%d/%d)", l, maxMessageLength), now)
+    }
+    if state.tokens < 1 {
+        return state.strike("Sending messages too fast", now)
+    }
+    if msg == state.lastMessage && now.Sub(state.lastMessageAt) < duplicateWindow {
+        return state.strike("Duplicate message", now)
+    }
+
+    state.tokens--
+    state.lastMessage = msg
+    state.lastMessageAt = now
+    return floodVerdict { action: floodOk }
+}
+
+func (state *floodState) strike(reason string, now time.Time) floodVerdict {
+    if now.Sub(state.lastStrike) > strikeDecay {
+        state.strikes = 0
+    }
+    state.strikes++
+    state.lastStrike = now
+
+    if state.strikes >= strikesToKick {
+        return floodVerdict { action: floodKick, reason: reason }
+    } else if state.strikes >= strikesToMute {
+        state.mutedUntil = now.Add(muteDuration)
+        return floodVerdict { action: floodMute, reason: reason, remaining: muteDuration }
+    } else {
+        return floodVerdict { action: floodWarn, reason: reason }
+    }
+}
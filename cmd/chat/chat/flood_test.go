@@ -0,0 +1,78 @@
+package chat
+
+import (
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestFloodBurstThenWarnMuteKick(t *testing.T) {
+    f := makeFloodControl()
+    now := time.Now()
+
+    for i := 0; i < int(bucketCapacity); i++ {
+        verdict := f.check("a", string(rune('a' + i)), now)
+        if verdict.action != floodOk {
+            t.Fatalf("Expected message %d to pass, got %d", i, verdict.action)
+        }
+    }
+
+    verdict := f.check("a", "x", now)
+    if verdict.action != floodWarn {
+        t.Fatalf("Expected warn after burst, got %d", verdict.action)
+    }
+    f.check("a", "y", now)
+    verdict = f.check("a", "z", now)
+    if verdict.action != floodMute {
+        t.Fatalf("Expected mute on strike %d, got %d", strikesToMute, verdict.action)
+    }
+
+    verdict = f.check("a", "z", now.Add(time.Second))
+    if verdict.action != floodMuted {
+        t.Fatalf("Expected still muted, got %d", verdict.action)
+    }
+
+    // Other sessions are unaffected
+    verdict = f.check("b", "x", now)
+    if verdict.action != floodOk {
+        t.Fatalf("Expected other session to pass, got %d", verdict.action)
+    }
+
+    // Strikes while muted are ignored, repeat offences after each mute escalate
+    for i := strikesToMute; i < strikesToKick; i++ {
+        now = now.Add(muteDuration)
+        verdict = f.check("a", strings.Repeat("!", maxMessageLength + 1), now)
+    }
+    if verdict.action != floodKick {
+        t.Fatalf("Expected kick on strike %d, got %d", strikesToKick, verdict.action)
+    }
+}
+
+func TestFloodDuplicateAndDecay(t *testing.T) {
+    f := makeFloodControl()
+    now := time.Now()
+
+    f.check("a", "gg", now)
+    verdict := f.check("a", "gg", now.Add(time.Second))
+    if verdict.action != floodWarn {
+        t.Fatalf("Expected duplicate warn, got %d", verdict.action)
+    }
+
+    verdict = f.check("a", "gg", now.Add(duplicateWindow + time.Second))
+    if verdict.action != floodOk {
+        t.Fatalf("Expected duplicate to pass after window, got %d", verdict.action)
+    }
+
+    // Strikes decay, so this is a warn and not a mute
+    now = now.Add(duplicateWindow + strikeDecay + 2 * time.Second)
+    f.check("a", "gg", now)
+    f.check("a", "gg", now)
+    verdict = f.check("a", "gg", now)
+    if verdict.action != floodWarn {
+        t.Fatalf("Expected warn after decay, got %d", verdict.action)
+    }
+}
+
+func TestMain(m *testing.M) {
+    m.Run()
+}
@@ -0,0 +1,90 @@
+package chat
+
+import (
+    "github.com/google/uuid"
+)
+
+// Ring buffer of chat messages, each stamped with an increasing sequence number.
+// Clients keep a cursor of the last sequence number they were sent.
+type messages struct {
+    arr []outbound
+    lastSeq uint64
+    // Messages added since the last flush to clients
+    pending int
+    // Sequence numbers restart with the server and with pruned rooms, so resume cursors must match this too
+    epoch string
+}
+
+func makeMessages(size int) messages {
+    return messages { arr: make([]outbound, size), epoch: uuid.New().String() }
+}
+
+func (r *messages) add(o outbound) {
+    r.lastSeq++
+    o.Seq = r.lastSeq
+    r.arr[r.indexOf(r.lastSeq)] = o
+    r.pending++
+}
+
+func (r *messages) indexOf(seq uint64) int {
+    return int((seq - 1) % uint64(len(r.arr)))
+}
+
+// Sequence numbers start at 1
+func (r *messages) oldestSeq() uint64 {
+    l := uint64(len(r.arr))
+    if r.lastSeq < l {
+        return 1
+    }
+    return r.lastSeq - l + 1
+}
+
+// Calls back with every message after `seq`, preceded by a gap marker if some have already been overwritten.
+// Returns the number of missed messages.
+func (r *messages) since(seq uint64, cb func(*outbound)) uint64 {
+    if seq >= r.lastSeq {
+        return 0
+    }
+
+    start := seq + 1
+    var missed uint64 = 0
+    if oldest := r.oldestSeq(); start < oldest {
+        missed = oldest - start
+        start = oldest
+        cb(&outbound { Type: typeGap, Missed: missed })
+    }
+
+    for s := start; s <= r.lastSeq; s++ {
+        cb(&r.arr[r.indexOf(s)])
+    }
+    return missed
+}
+
+// Where a reconnecting client left off, as sent in the `joined` message
+type resumeCursor struct {
+    room string
+    epoch string
+    seq uint64
+}
+
+// Cursor to get up to the last `replay` messages
+func (r *messages) freshCursor(replay uint64) uint64 {
+    fresh := r.oldestSeq() - 1
+    if r.lastSeq > replay && r.lastSeq - replay > fresh {
+        fresh = r.lastSeq - replay
+    }
+    return fresh
+}
+
+// Cursor for a newly authenticated client, which is either resuming from a sequence number
+// (gap marker on the next flush if it is too old), or fresh and gets up to the last `replay` messages.
+// A cursor from another room or epoch is meaningless, so it gets the whole buffer and true to resync.
+func (r *messages) resumeCursor(room string, resume *resumeCursor, replay uint64) (uint64, bool) {
+    if resume == nil {
+        return r.freshCursor(replay), false
+    }
+    if resume.room != room || resume.epoch != r.epoch || resume.seq > r.lastSeq {
+        return r.oldestSeq() - 1, true
+    }
+    return resume.seq, false
+}
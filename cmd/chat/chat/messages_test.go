@@ -0,0 +1,108 @@
+package chat
+
+import (
+    "testing"
+)
+
+func collect(msgs *messages, seq uint64) ([]outbound, uint64) {
+    result := make([]outbound, 0)
+    missed := msgs.since(seq, func (o *outbound) {
+        result = append(result, *o)
+    })
+    return result, missed
+}
+
+func TestMessagesSinceWithoutWrap(t *testing.T) {
+    msgs := makeMessages(4)
+    for _, text := range []string { "a", "b", "c" } {
+        msgs.add(outbound { Type: typeChat, Text: text })
+    }
+
+    result, missed := collect(&msgs, msgs.oldestSeq() - 1)
+    if missed != 0 || len(result) != 3 {
+        t.Fatalf("Expected 3 messages and none missed, got %d and %d", len(result), missed)
+    }
+    if result[0].Text != "a" || result[0].Seq != 1 || result[2].Seq != 3 {
+        t.Fatalf("Unexpected order %v", result)
+    }
+
+    result, _ = collect(&msgs, 2)
+    if len(result) != 1 || result[0].Text != "c" {
+        t.Fatalf("Expected only c, got %v", result)
+    }
+
+    result, _ = collect(&msgs, 3)
+    if len(result) != 0 {
+        t.Fatalf("Expected nothing, got %v", result)
+    }
+}
+
+func TestMessagesSinceWithGap(t *testing.T) {
+    msgs := makeMessages(4)
+    for _, text := range []string { "a", "b", "c", "d", "e", "f" } {
+        msgs.add(outbound { Type: typeChat, Text: text })
+    }
+    if msgs.oldestSeq() != 3 {
+        t.Fatalf("Expected oldest 3, got %d", msgs.oldestSeq())
+    }
+
+    result, missed := collect(&msgs, 0)
+    if missed != 2 {
+        t.Fatalf("Expected 2 missed, got %d", missed)
+    }
+    if len(result) != 5 || result[0].Type != typeGap || result[0].Missed != 2 {
+        t.Fatalf("Expected gap marker then 4 messages, got %v", result)
+    }
+    if result[1].Text != "c" || result[4].Text != "f" {
+        t.Fatalf("Unexpected order %v", result)
+    }
+
+    result, missed = collect(&msgs, 3)
+    if missed != 0 || len(result) != 3 || result[0].Text != "d" {
+        t.Fatalf("Expected d, e, f, got %v", result)
+    }
+}
+
+func TestMessagesResumeCursor(t *testing.T) {
+    msgs := makeMessages(10)
+    for i := 0; i < 15; i++ {
+        msgs.add(outbound { Type: typeChat, Text: "x" })
+    }
+
+    if cursor, resync := msgs.resumeCursor("game1", nil, 3); cursor != 12 || resync {
+        t.Fatalf("Expected fresh join to replay last 3, got cursor %d", cursor)
+    }
+    if cursor, _ := msgs.resumeCursor("game1", nil, 50); cursor != 5 {
+        t.Fatalf("Expected fresh join to replay whole buffer, got cursor %d", cursor)
+    }
+
+    if cursor, resync := msgs.resumeCursor("game1", &resumeCursor { "game1", msgs.epoch, 13 }, 3); cursor != 13 || resync {
+        t.Fatalf("Expected resume from 13, got %d", cursor)
+    }
+    if cursor, resync := msgs.resumeCursor("game1", &resumeCursor { "game1", msgs.epoch, 2 }, 3); cursor != 2 || resync {
+        t.Fatalf("Expected resume from 2 to be kept for a gap marker, got %d", cursor)
+    }
+
+    // Valid looking sequence numbers from elsewhere get the whole buffer
+    for _, resume := range []resumeCursor {
+        { "game1", msgs.epoch, 99 },
+        { "game2", msgs.epoch, 13 },
+        { "game1", "previous process", 13 },
+        { "game1", "", 13 },
+    } {
+        if cursor, resync := msgs.resumeCursor("game1", &resume, 3); cursor != 5 || !resync {
+            t.Fatalf("Expected %v to resync from the oldest message, got cursor %d", resume, cursor)
+        }
+    }
+}
+
+func TestEarlyFlushFromAnySource(t *testing.T) {
+    chat := &Chat { rooms: make(map[string]*room), options: Options { HistorySize: 4, InitialReplay: 2 } }
+    for i := 0; i < 3; i++ {
+        chat.onSystem(&SystemData { Room: "game1", Text: "x" })
+    }
+    // Flushed at 2 pending, so the third is the only one left
+    if r := chat.rooms["game1"]; r.msgs.lastSeq != 3 || r.msgs.pending != 1 {
+        t.Fatalf("Expected an early flush after system messages, got %d pending", r.msgs.pending)
+    }
+}
@@ -0,0 +1,84 @@
+package chat
+
+import (
+	"github.com/starqi/wi-util-servers/cmd/chat/sessions"
+)
+
+type presenceEntry struct {
+    playerName string
+    connections int
+}
+
+// Room -> session ID -> player name, of players with an open chat connection
+type Presence map[string]map[string]string
+
+type PresenceData struct{Cb chan Presence}
+
+const (
+    presenceJoin = "join"
+    presenceLeave = "leave"
+)
+
+// Aggregator only
+func (chat *Chat) presenceJoined(r *room, c *client) {
+    chat.presenceChange(r, c.session.ID, c.session.PlayerName, true)
+    chat.replicate(chatEvent { Room: r.name, Presence: presenceJoin, SessionID: c.session.ID, PlayerName: c.session.PlayerName })
+}
+
+func (chat *Chat) presenceLeft(r *room, c *client) {
+    chat.presenceChange(r, c.session.ID, c.session.PlayerName, false)
+    chat.replicate(chatEvent { Room: r.name, Presence: presenceLeave, SessionID: c.session.ID, PlayerName: c.session.PlayerName })
+}
+
+// Counts connections across all nodes, join and leave events are only for the first and last connection of a session
+func (chat *Chat) presenceChange(r *room, id string, playerName string, joined bool) {
+    entry, found := r.presence[id]
+    if joined {
+        if !found {
+            entry = &presenceEntry { playerName: playerName }
+            r.presence[id] = entry
+            chat.addMessage(r, outbound { Type: typePresence, Event: presenceJoin, PlayerName: entry.playerName })
+        }
+        entry.connections++
+        return
+    }
+    if !found {
+        return
+    }
+    entry.connections--
+    if entry.connections <= 0 {
+        delete(r.presence, id)
+        chat.addMessage(r, outbound { Type: typePresence, Event: presenceLeave, PlayerName: entry.playerName })
+    }
+}
+
+// Aggregator only
+func (chat *Chat) presenceSnapshot() Presence {
+    result := make(Presence)
+    for name, r := range chat.rooms {
+        if len(r.presence) == 0 {
+            continue
+        }
+        players := make(map[string]string)
+        for id, entry := range r.presence {
+            players[id] = entry.playerName
+        }
+        result[name] = players
+    }
+    return result
+}
+
+// Rooms with players only
+func (p Presence) Count() int {
+    count := 0
+    for _, players := range p {
+        count += len(players)
+    }
+    return count
+}
+
+// True if the session has an open chat connection in its game instance
+func (p Presence) InChat(session *sessions.Session) bool {
+    _, found := p[session.GameInstance][session.ID]
+    return found
+}
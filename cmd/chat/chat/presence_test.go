@@ -0,0 +1,42 @@
+package chat
+
+import (
+    "testing"
+	"github.com/starqi/wi-util-servers/cmd/chat/sessions"
+)
+
+func TestPresenceJoinLeaveEvents(t *testing.T) {
+    chat := &Chat { rooms: make(map[string]*room), options: Options { HistorySize: 10, InitialReplay: 5 } }
+    bob := &sessions.Session { Token: "t1", PlayerName: "Bob", GameInstance: "game1", IsInGame: true }
+    c1 := &client { session: bob }
+    c2 := &client { session: bob }
+
+    chat.joinRoom(c1, "game1", nil)
+    chat.joinRoom(c2, "game1", nil)
+    r := chat.rooms["game1"]
+    if r.msgs.lastSeq != 1 {
+        t.Fatalf("Expected 1 join event for 2 connections, got %d messages", r.msgs.lastSeq)
+    }
+
+    presence := chat.presenceSnapshot()
+    if presence.Count() != 1 || !presence.InChat(bob) {
+        t.Fatalf("Expected Bob in chat, got %v", presence)
+    }
+
+    chat.leaveRoom(c1)
+    if r.msgs.lastSeq != 1 {
+        t.Fatalf("Expected no leave event while another connection is open, got %d messages", r.msgs.lastSeq)
+    }
+
+    // Moving rooms leaves the old one
+    chat.joinRoom(c2, "game2", nil)
+    events, _ := collect(&r.msgs, 0)
+    if len(events) != 2 || events[0].Event != presenceJoin || events[1].Event != presenceLeave || events[1].PlayerName != "Bob" {
+        t.Fatalf("Expected join then leave, got %v", events)
+    }
+
+    presence = chat.presenceSnapshot()
+    if presence.Count() != 1 || presence.InChat(bob) {
+        t.Fatalf("Expected Bob in game2 only, got %v", presence)
+    }
+}
@@ -0,0 +1,123 @@
+package chat
+
+import (
+    "encoding/json"
+    "strings"
+    "time"
+    "github.com/gorilla/websocket"
+)
+
+// Outbound websocket messages are JSON, distinguished by type.
+// Inbound is plain text chat, except:
+// - The first message which is the auth, either a bare token or `authRequest` JSON
+// - `inboundCommand` JSON objects with a type
+
+const (
+    typeChat = "chat"
+    typeNotice = "notice"
+    // Some messages were overwritten before they could be sent
+    typeGap = "gap"
+    // From the game servers or admins, never has a player name
+    typeSystem = "system"
+    // A player joined or left the room's chat
+    typePresence = "presence"
+    // Sent on joining a room, before any of its messages
+    typeJoined = "joined"
+)
+
+// Inbound commands
+const (
+    typeReport = "report"
+)
+
+const (
+    penaltyWarn = "warn"
+    penaltyMute = "mute"
+    penaltyKick = "kick"
+)
+
+type outbound struct {
+    Type string `json:"type"`
+    // Chat, system and presence messages only, for clients to detect duplicates and gaps
+    Seq uint64 `json:"seq,omitempty"`
+    PlayerName string `json:"playerName,omitempty"`
+    Text string `json:"text"`
+    // Notices only
+    Penalty string `json:"penalty,omitempty"`
+    Seconds int `json:"seconds,omitempty"`
+    // Gap markers only
+    Missed uint64 `json:"missed,omitempty"`
+    // Presence only, join or leave
+    Event string `json:"event,omitempty"`
+    // Joined only, to send back with `lastSeq` when reconnecting
+    Room string `json:"room,omitempty"`
+    Epoch string `json:"epoch,omitempty"`
+    // Joined only, the client's cursor no longer applies, so it should discard what it has
+    Resync bool `json:"resync,omitempty"`
+}
+
+// A stalled peer only holds up the aggregator this long, then its writes fail and it is closed
+const writeTimeout = time.Second
+
+// Must only be called from the aggregator, since websocket connections allow one concurrent writer
+func (c *client) send(o *outbound) {
+    b, err := json.Marshal(o)
+    if err != nil {
+        logger.Error("Unexpected outbound marshal error", "err", err)
+        return
+    }
+    c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+    if err := c.conn.WriteMessage(websocket.TextMessage, b); err != nil {
+        logger.Debug("Outbound write failed, closing", "remoteAddr", c.conn.RemoteAddr().String(), "err", err)
+        // The client loop's read then fails and unregisters
+        c.conn.Close()
+    }
+}
+
+type authRequest struct {
+    Token string `json:"token"`
+    // Optional, the last sequence number received before reconnecting
+    LastSeq *uint64 `json:"lastSeq"`
+    // From the last `joined` message, required with `lastSeq`
+    Room string `json:"room"`
+    Epoch string `json:"epoch"`
+}
+
+// Nil for a fresh join
+func (auth *authRequest) resume() *resumeCursor {
+    if auth.LastSeq == nil {
+        return nil
+    }
+    return &resumeCursor { auth.Room, auth.Epoch, *auth.LastSeq }
+}
+
+func parseAuth(msg string) authRequest {
+    if !strings.HasPrefix(msg, "{") {
+        return authRequest { Token: msg }
+    }
+    var auth authRequest
+    if err := json.Unmarshal([]byte(msg), &auth); err != nil {
+        logger.Info("Auth JSON parse failed", "err", err)
+        return authRequest{}
+    }
+    return auth
+}
+
+type inboundCommand struct {
+    Type string `json:"type"`
+    // Reports only
+    PlayerName string `json:"playerName"`
+    Reason string `json:"reason"`
+}
+
+// Nil if this is a plain chat message
+func parseCommand(msg string) *inboundCommand {
+    if !strings.HasPrefix(msg, "{") {
+        return nil
+    }
+    var command inboundCommand
+    if err := json.Unmarshal([]byte(msg), &command); err != nil || command.Type == "" {
+        return nil
+    }
+    return &command
+}
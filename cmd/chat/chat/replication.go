@@ -0,0 +1,65 @@
+package chat
+
+import (
+    "encoding/json"
+)
+
+// Room messages and presence changes from clients on one node are applied to the same rooms on the others.
+// Sequence numbers are still per node, so reconnecting to a different node may get a gap marker or a replay.
+// Presence from a node that dies without its clients leaving is kept until the room is pruned.
+
+const chatTopic = "chat"
+
+type chatEvent struct {
+    Node string `json:"node"`
+    // Empty for global system messages
+    Room string `json:"room"`
+    // Chat and system messages only
+    Message *outbound `json:"message,omitempty"`
+    // Presence only, one join or leave per connection
+    Presence string `json:"presence,omitempty"`
+    SessionID string `json:"sessionId,omitempty"`
+    PlayerName string `json:"playerName,omitempty"`
+}
+
+// Aggregator only, no-op if not replicated
+func (chat *Chat) replicate(event chatEvent) {
+    if chat.broker == nil {
+        return
+    }
+    event.Node = chat.node
+    payload, err := json.Marshal(&event)
+    if err != nil {
+        logger.Error("Unexpected chat replica marshal error", "err", err)
+        return
+    }
+    chat.broker.Publish(chatTopic, payload)
+}
+
+func (chat *Chat) onReplica(payload []byte) {
+    var event chatEvent
+    if err := json.Unmarshal(payload, &event); err != nil {
+        logger.Warn("Chat replica JSON parse failed", "err", err)
+        return
+    }
+    if event.Node == chat.node {
+        return
+    }
+
+    if event.Presence != "" {
+        chat.presenceChange(chat.getRoom(event.Room), event.SessionID, event.PlayerName, event.Presence == presenceJoin)
+        return
+    }
+    if event.Message == nil {
+        return
+    }
+    message := *event.Message
+    message.Seq = 0
+    if event.Room == "" {
+        for _, r := range chat.rooms {
+            chat.addMessage(r, message)
+        }
+        return
+    }
+    chat.addMessage(chat.getRoom(event.Room), message)
+}
@@ -0,0 +1,50 @@
+package chat
+
+import (
+    "testing"
+	"github.com/starqi/wi-util-servers/cmd/chat/sessions"
+	"github.com/starqi/wi-util-servers/internal/broker"
+)
+
+func TestReplicationBetweenNodes(t *testing.T) {
+    b := broker.MakeMemoryBroker()
+    published, _ := b.Subscribe(chatTopic)
+    nodeA := &Chat { rooms: make(map[string]*room), options: Options { HistorySize: 10, InitialReplay: 5 }, broker: b, node: "a" }
+    nodeB := &Chat { rooms: make(map[string]*room), options: Options { HistorySize: 10, InitialReplay: 5 }, broker: b, node: "b" }
+    deliver := func () {
+        for len(published) > 0 {
+            payload := <-published
+            nodeA.onReplica(payload)
+            nodeB.onReplica(payload)
+        }
+    }
+
+    bob := &sessions.Session { ID: "s1", PlayerName: "Bob", GameInstance: "game1", IsInGame: true }
+    c := &client { session: bob }
+    nodeA.joinRoom(c, "game1", nil)
+    nodeA.onSystem(&SystemData { Room: "game1", Text: "Server restarting" })
+    nodeA.onSystem(&SystemData { Global: true, Text: "Hello everyone" })
+    deliver()
+
+    // Own events are not applied twice
+    if nodeA.rooms["game1"].msgs.lastSeq != 3 {
+        t.Fatalf("Expected 3 messages on the origin node, got %d", nodeA.rooms["game1"].msgs.lastSeq)
+    }
+    events, _ := collect(&nodeB.rooms["game1"].msgs, 0)
+    if len(events) != 3 || events[0].Event != presenceJoin || events[1].Text != "Server restarting" || events[2].Text != "Hello everyone" {
+        t.Fatalf("Expected join and system messages replicated, got %v", events)
+    }
+    if !nodeB.presenceSnapshot().InChat(bob) {
+        t.Fatal("Expected Bob in chat on the other node")
+    }
+
+    nodeA.leaveRoom(c)
+    deliver()
+    if nodeB.presenceSnapshot().InChat(bob) {
+        t.Fatal("Expected Bob to have left on the other node")
+    }
+    events, _ = collect(&nodeB.rooms["game1"].msgs, 3)
+    if len(events) != 1 || events[0].Event != presenceLeave {
+        t.Fatalf("Expected leave replicated, got %v", events)
+    }
+}
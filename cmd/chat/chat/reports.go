@@ -0,0 +1,135 @@
+package chat
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "time"
+	"github.com/starqi/wi-util-servers/cmd/chat/reports"
+	"github.com/starqi/wi-util-servers/cmd/chat/sessions"
+	"github.com/starqi/wi-util-servers/internal/deadline"
+)
+
+// Number of recent room messages captured with a report
+const reportContextSize = 30
+const maxReportReasonLength = 500
+
+var ErrReporterNotFound = errors.New("Reporter session not found")
+var ErrMissingReportedPlayer = errors.New("Missing reported player name")
+
+type snapshotData struct {
+    room string
+    num uint64
+    cb chan []outbound
+}
+
+type ReportRequest struct {
+    PlayerName string `json:"playerName"`
+    Reason string `json:"reason"`
+}
+
+// Aggregator only. Copies the last `num` chat and system messages of the room, oldest first.
+func (chat *Chat) snapshot(roomName string, num uint64) []outbound {
+    result := make([]outbound, 0)
+    r, found := chat.rooms[roomName]
+    if !found {
+        return result
+    }
+    r.msgs.since(r.msgs.freshCursor(num), func (o *outbound) {
+        if o.Type == typeChat || o.Type == typeSystem {
+            result = append(result, *o)
+        }
+    })
+    return result
+}
+
+// Blocks on the sessions service, the aggregator and the reports store, so must not be called from the aggregator
+func (chat *Chat) Report(ctx context.Context, reporterToken string, req *ReportRequest) (*reports.Report, error) {
+    if req.PlayerName == "" {
+        return nil, ErrMissingReportedPlayer
+    }
+
+    reporter, err := chat.sessionsService.Get(ctx, reporterToken)
+    if err == sessions.ErrNotFound {
+        return nil, ErrReporterNotFound
+    } else if err != nil {
+        return nil, err
+    }
+
+    // Still reported if the player can't be found, eg. after leaving
+    reported, err := chat.sessionsService.FindByPlayerName(ctx, req.PlayerName, reporter.GameInstance)
+    if err != nil && err != sessions.ErrNotFound {
+        return nil, err
+    }
+
+    snapshotCb := make(chan []outbound, 1)
+    snapshot, err := deadline.Call(ctx, chat.snapshots, snapshotData { room: reporter.GameInstance, num: reportContextSize, cb: snapshotCb }, snapshotCb)
+    if err != nil {
+        return nil, err
+    }
+    messages, err := json.Marshal(snapshot)
+    if err != nil {
+        return nil, err
+    }
+
+    reporterJson, err := snapshotJson(reporter)
+    if err != nil {
+        return nil, err
+    }
+    reportedID := ""
+    reportedJson := []byte("null")
+    if reported != nil {
+        reportedID = reported.ID
+        reportedJson, err = snapshotJson(reported)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    reason := []rune(req.Reason)
+    if len(reason) > maxReportReasonLength {
+        reason = reason[:maxReportReasonLength]
+    }
+
+    report := &reports.Report {
+        Room: reporter.GameInstance,
+        ReporterSessionID: reporter.ID,
+        ReporterName: reporter.PlayerName,
+        ReportedSessionID: reportedID,
+        ReportedName: req.PlayerName,
+        Reason: string(reason),
+        Messages: messages,
+        ReporterSession: reporterJson,
+        ReportedSession: reportedJson,
+        CreatedAt: time.Now().Unix(),
+    }
+    if err := chat.reports.Add(report); err != nil {
+        return nil, err
+    }
+    logger.Info("Reported", "reportId", report.ID, "reporter", reporter.PlayerName, "reported", req.PlayerName, "room", report.Room)
+    return report, nil
+}
+
+// Reports are kept long after the session, so never hold its token
+func snapshotJson(session *sessions.Session) ([]byte, error) {
+    result := sessions.SessionToJson(session)
+    result.Token = ""
+    return json.Marshal(result)
+}
+
+// Client loop only
+func (chat *Chat) onCommand(c *client, session *sessions.Session, command *inboundCommand) {
+    switch command.Type {
+    case typeReport:
+        text := "Report submitted"
+        ctx, cancel := context.WithTimeout(context.Background(), sessionsTimeout)
+        defer cancel()
+        if _, err := chat.Report(ctx, session.Token, &ReportRequest { PlayerName: command.PlayerName, Reason: command.Reason }); err != nil {
+            logger.Error("Report failed", "err", err)
+            text = "Report failed"
+        }
+        chat.notices <- notice { c, outbound { Type: typeNotice, Text: text } }
+    default:
+        logger.Info("Unknown command", "type", command.Type)
+    }
+}
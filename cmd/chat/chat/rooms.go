@@ -0,0 +1,81 @@
+package chat
+
+import (
+    "time"
+)
+
+// Rooms are game instances. Each has its own history, so sequence numbers are per room.
+type room struct {
+    name string
+    msgs messages
+    clients map[*client]bool
+    // Session ID -> player, a player may have more than one connection
+    presence map[string]*presenceEntry
+    lastActive time.Time
+}
+
+// Empty rooms keep their history for a while, for players reconnecting
+const roomIdleTimeout = 10 * time.Minute
+
+func (chat *Chat) getRoom(name string) *room {
+    r, found := chat.rooms[name]
+    if !found {
+        r = &room {
+            name: name,
+            msgs: makeMessages(chat.options.HistorySize),
+            clients: make(map[*client]bool),
+            presence: make(map[string]*presenceEntry),
+        }
+        chat.rooms[name] = r
+    }
+    r.lastActive = time.Now()
+    return r
+}
+
+// Every add goes through here, so a burst from any source flushes before the buffer wraps around the slowest
+// cursor, which is at most the last flush
+func (chat *Chat) addMessage(r *room, o outbound) {
+    r.msgs.add(o)
+    if r.msgs.pending >= len(r.msgs.arr) / 2 {
+        chat.flush(r)
+    }
+}
+
+// Returns true if the client must resync, see `resumeCursor`
+func (chat *Chat) joinRoom(c *client, name string, resume *resumeCursor) bool {
+    if c.room != nil {
+        chat.leaveRoom(c)
+    }
+    r := chat.getRoom(name)
+    c.room = r
+    // Before the client is in the room, since the join notice may flush and the cursor isn't set yet
+    chat.presenceJoined(r, c)
+    r.clients[c] = true
+    var resync bool
+    c.lastSeq, resync = r.msgs.resumeCursor(name, resume, uint64(chat.options.InitialReplay))
+    return resync
+}
+
+// Before the room's messages, which are sent on the next flush
+func (c *client) sendJoined(resync bool) {
+    c.send(&outbound { Type: typeJoined, Room: c.room.name, Epoch: c.room.msgs.epoch, Resync: resync })
+}
+
+func (chat *Chat) leaveRoom(c *client) {
+    if c.room == nil {
+        return
+    }
+    delete(c.room.clients, c)
+    chat.presenceLeft(c.room, c)
+    c.room.lastActive = time.Now()
+    c.room = nil
+}
+
+func (chat *Chat) pruneRooms() {
+    now := time.Now()
+    for name, r := range chat.rooms {
+        if len(r.clients) == 0 && now.Sub(r.lastActive) >= roomIdleTimeout {
+            delete(chat.rooms, name)
+        }
+    }
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+    "encoding/base64"
+    "time"
+    "github.com/gin-gonic/gin"
+	"github.com/starqi/wi-util-servers/cmd/chat/chat"
+	"github.com/starqi/wi-util-servers/cmd/chat/sessions"
+	"github.com/starqi/wi-util-servers/internal/config"
+	"github.com/starqi/wi-util-servers/internal/cors"
+	"github.com/starqi/wi-util-servers/internal/logging"
+)
+
+// Names are also the env vars and flags, see `config.Load`
+type Config struct {
+    Port int `yaml:"port" env:"PORT"`
+    // Messages kept per room
+    ChatHistorySize int `yaml:"chatHistorySize"`
+    // Messages sent on a fresh join, the rest is for resuming after reconnect
+    ChatInitialReplay int `yaml:"chatInitialReplay"`
+    ChatOutboundTick config.Duration `yaml:"chatOutboundTick"`
+    // Optional, chat logs, reports and sessions are only persisted if set
+    ChatDbPath string `yaml:"chatDbPath"`
+    ChatRetentionDays int `yaml:"chatRetentionDays"`
+    // Optional JSON file, reloaded on change
+    ChatFilterPath string `yaml:"chatFilterPath"`
+    // Eg. https://example.com or https://*.example.com, any origin if empty outside of GIN_MODE=release
+    CorsOrigins []string `yaml:"corsOrigins"`
+    // Request headers allowed cross-origin, except on routes with their own rule
+    CorsHeaders []string `yaml:"corsHeaders"`
+    CorsMaxAge config.Duration `yaml:"corsMaxAge"`
+    // JSON file of bearer keys for private routes, reloaded on change. Required in release mode,
+    // otherwise private routes answer 503 without it.
+    KeyringPath string `yaml:"keyringPath"`
+    // Base64, shared with servers verifying session tokens offline
+    SessionSecret string `yaml:"sessionSecret" secret:"true"`
+    // See `sessions.Lifetimes`
+    TokenLifetimeFromRequest config.Duration `yaml:"tokenLifetimeFromRequest"`
+    TokenLifetimeFromPatch config.Duration `yaml:"tokenLifetimeFromPatch"`
+    TokenLifetimeFromRefresh config.Duration `yaml:"tokenLifetimeFromRefresh"`
+    // 0 for unbounded
+    TokenMaxLifetime config.Duration `yaml:"tokenMaxLifetime"`
+    SessionCleanupInterval config.Duration `yaml:"sessionCleanupInterval"`
+    // Optional, redis://[[user]:password@]host[:port] to share chat and sessions between nodes,
+    // which must also share the session secret. Secret since it may hold a password.
+    BrokerUrl string `yaml:"brokerUrl" secret:"true"`
+    // After which requests waiting on the sessions service or chat get a 503
+    RequestTimeout config.Duration `yaml:"requestTimeout"`
+    // To drain requests, close websockets and flush the chat DB on SIGTERM
+    ShutdownTimeout config.Duration `yaml:"shutdownTimeout"`
+    // golang-migrate files, for the readiness schema check
+    MigrationsDir string `yaml:"migrationsDir"`
+    LogLevel string `yaml:"logLevel"`
+    // Eg. "chat=debug,sessions=warn"
+    LogLevels string `yaml:"logLevels"`
+    // Off to log tokens, secrets and payloads
+    LogRedact bool `yaml:"logRedact"`
+}
+
+func defaultConfig() Config {
+    options := chat.DefaultOptions()
+    lifetimes := sessions.DefaultLifetimes()
+    return Config {
+        Port: 8080,
+        ChatHistorySize: options.HistorySize,
+        ChatInitialReplay: options.InitialReplay,
+        ChatOutboundTick: config.Duration(options.OutboundTick),
+        ChatRetentionDays: 30,
+        CorsHeaders: []string { "Content-Type" },
+        CorsMaxAge: config.Duration(10 * time.Minute),
+        TokenLifetimeFromRequest: config.Duration(lifetimes.FromRequest),
+        TokenLifetimeFromPatch: config.Duration(lifetimes.FromPatch),
+        TokenLifetimeFromRefresh: config.Duration(lifetimes.FromRefresh),
+        TokenMaxLifetime: config.Duration(lifetimes.Max),
+        SessionCleanupInterval: config.Duration(lifetimes.CleanupInterval),
+        RequestTimeout: config.Duration(5 * time.Second),
+        ShutdownTimeout: config.Duration(10 * time.Second),
+        MigrationsDir: "./db/chat-migrations",
+        LogLevel: "info",
+        LogRedact: true,
+    }
+}
+
+func (c *Config) Validate() error {
+    var p config.Problems
+    p.Check(c.Port > 0 && c.Port < 65536, "port", "must be between 1 and 65535")
+    p.Check(c.ChatHistorySize > 0, "chatHistorySize", "must be positive")
+    p.Check(c.ChatInitialReplay >= 0 && c.ChatInitialReplay <= c.ChatHistorySize, "chatInitialReplay", "must be between 0 and chatHistorySize")
+    p.Check(c.ChatOutboundTick > 0, "chatOutboundTick", "must be positive")
+    p.Check(c.ChatRetentionDays > 0, "chatRetentionDays", "must be positive")
+    _, err := cors.MakeAllowlist(c.CorsOrigins)
+    p.Add("corsOrigins", err)
+    p.Check(c.CorsMaxAge >= 0, "corsMaxAge", "must not be negative")
+    p.Check(c.TokenLifetimeFromRequest > 0, "tokenLifetimeFromRequest", "must be positive")
+    p.Check(c.TokenLifetimeFromPatch > 0, "tokenLifetimeFromPatch", "must be positive")
+    p.Check(c.TokenLifetimeFromRefresh > 0, "tokenLifetimeFromRefresh", "must be positive")
+    p.Check(c.TokenMaxLifetime >= 0, "tokenMaxLifetime", "must not be negative")
+    p.Check(c.SessionCleanupInterval > 0, "sessionCleanupInterval", "must be positive")
+    p.Check(c.RequestTimeout > 0, "requestTimeout", "must be positive")
+    p.Check(c.ShutdownTimeout > 0, "shutdownTimeout", "must be positive")
+    p.Check(c.KeyringPath != "" || gin.Mode() != gin.ReleaseMode, "keyringPath", "is required in release mode")
+    if c.SessionSecret != "" {
+        _, err := base64.StdEncoding.DecodeString(c.SessionSecret)
+        p.Check(err == nil, "sessionSecret", "must be base64")
+    }
+    _, err = c.logging()
+    p.Check(err == nil, "logLevel and logLevels", "must be debug, info, warn or error")
+    return p.Err()
+}
+
+func (c *Config) lifetimes() sessions.Lifetimes {
+    return sessions.Lifetimes {
+        FromRequest: c.TokenLifetimeFromRequest.D(),
+        FromPatch: c.TokenLifetimeFromPatch.D(),
+        FromRefresh: c.TokenLifetimeFromRefresh.D(),
+        Max: c.TokenMaxLifetime.D(),
+        CleanupInterval: c.SessionCleanupInterval.D(),
+    }
+}
+
+func (c *Config) chatOptions() chat.Options {
+    return chat.Options {
+        HistorySize: c.ChatHistorySize,
+        InitialReplay: c.ChatInitialReplay,
+        OutboundTick: c.ChatOutboundTick.D(),
+    }
+}
+
+func (c *Config) logging() (logging.Config, error) {
+    return logging.MakeConfig(c.LogLevel, c.LogLevels, c.LogRedact)
+}
@@ -0,0 +1,116 @@
+package filter
+
+import (
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+var testConfig = Config {
+    Words: []string { "darn", "heck" },
+    BlockLinks: true,
+    StripCaps: true,
+    StripZalgo: true,
+    RoomActions: map[string]string {
+        "strict": ActionReject,
+        "lenient": ActionFlag,
+    },
+}
+
+func TestWordFilterLeetspeak(t *testing.T) {
+    f := MakeWordFilter(testConfig.Words)
+    cases := map[string]string {
+        "what the heck": "what the ****",
+        "what the H3CK!": "what the *****",
+        "daaaarn it": "******* it",
+        "d@rn": "****",
+        "checkmate darning": "checkmate darning",
+        "hello!": "hello!",
+    }
+    for input, expected := range cases {
+        if result, _ := f.Apply(input); result != expected {
+            t.Errorf("Expected %s -> %s, got %s", input, expected, result)
+        }
+    }
+}
+
+func TestLinkCapsZalgo(t *testing.T) {
+    if result, hits := (&LinkFilter{}).Apply("join www.spam.ru or evil.com/x now"); result != "join *********** or ********** now" || len(hits) != 2 {
+        t.Errorf("Unexpected link result %s %v", result, hits)
+    }
+    if result, hits := (&LinkFilter{}).Apply("gg. wp.."); result != "gg. wp.." || len(hits) != 0 {
+        t.Errorf("Unexpected link result %s %v", result, hits)
+    }
+    caps := &CapsFilter { MinLetters: 6, MaxUpperRatio: 0.7 }
+    if result, _ := caps.Apply("STOP SHOUTING"); result != "stop shouting" {
+        t.Errorf("Unexpected caps result %s", result)
+    }
+    if result, _ := caps.Apply("GG wp"); result != "GG wp" {
+        t.Errorf("Unexpected caps result %s", result)
+    }
+    if result, _ := (&ZalgoFilter{}).Apply("hé̂̃llo café"); result != "héllo café" {
+        t.Errorf("Unexpected zalgo result %q", result)
+    }
+}
+
+func TestPipelineRoomActions(t *testing.T) {
+    p, err := MakePipelineFromConfig(&testConfig)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if result := p.Check("any", "HECK YEAH ok"); result.Action != ActionMask || result.Text != "**** yeah ok" {
+        t.Errorf("Expected mask, got %v", result)
+    }
+    if result := p.Check("strict", "heck"); result.Action != ActionReject || result.Text != "" {
+        t.Errorf("Expected reject, got %v", result)
+    }
+    if result := p.Check("lenient", "heck"); result.Action != ActionFlag || result.Text != "heck" || len(result.Hits) != 1 {
+        t.Errorf("Expected flag, got %v", result)
+    }
+    if result := p.Check("strict", "fine"); result.Action != "" || result.Text != "fine" {
+        t.Errorf("Expected no hits, got %v", result)
+    }
+
+    if _, err := MakePipelineFromConfig(&Config { DefaultAction: "explode" }); err == nil {
+        t.Error("Expected invalid action error")
+    }
+}
+
+func TestPipelineReload(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "filter.json")
+    if err := os.WriteFile(path, []byte(`{"words": ["darn"]}`), 0644); err != nil {
+        t.Fatal(err)
+    }
+    p, err := MakePipeline(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if result := p.Check("", "heck"); result.Action != "" {
+        t.Errorf("Expected no hits, got %v", result)
+    }
+
+    if err := os.WriteFile(path, []byte(`{"words": ["heck"]}`), 0644); err != nil {
+        t.Fatal(err)
+    }
+    if err := p.reload(); err != nil {
+        t.Fatal(err)
+    }
+    if result := p.Check("", "heck"); result.Action != ActionMask {
+        t.Errorf("Expected reloaded word list, got %v", result)
+    }
+
+    if err := os.WriteFile(path, []byte(`{`), 0644); err != nil {
+        t.Fatal(err)
+    }
+    if err := p.reload(); err == nil {
+        t.Error("Expected parse error")
+    }
+    if result := p.Check("", "heck"); result.Action != ActionMask {
+        t.Errorf("Expected previous rules to be kept, got %v", result)
+    }
+}
+
+func TestMain(m *testing.M) {
+    m.Run()
+}
@@ -0,0 +1,180 @@
+package filter
+
+import (
+    "regexp"
+    "strings"
+    "unicode"
+)
+
+// Returns the possibly modified text, and what was matched if anything.
+// Filters which only clean up text (caps, zalgo) never report matches.
+type Filter interface {
+    Apply(text string) (string, []string)
+}
+
+//////////////////////////////////////////////////
+
+var leet = map[rune]rune {
+    '0': 'o',
+    '1': 'i',
+    '3': 'e',
+    '4': 'a',
+    '5': 's',
+    '7': 't',
+    '8': 'b',
+    '9': 'g',
+    '@': 'a',
+    '$': 's',
+    '!': 'i',
+    '|': 'l',
+}
+
+func isWordRune(r rune) bool {
+    _, isLeet := leet[r]
+    return unicode.IsLetter(r) || unicode.IsDigit(r) || isLeet
+}
+
+func normalizeRune(r rune) rune {
+    if n, found := leet[r]; found {
+        return n
+    }
+    return unicode.ToLower(r)
+}
+
+// "fuuuck" -> "fuck", applied to both the word list and the message
+func collapseRepeats(s []rune) string {
+    var b strings.Builder
+    var prev rune = -1
+    for _, r := range s {
+        if r != prev {
+            b.WriteRune(r)
+        }
+        prev = r
+    }
+    return b.String()
+}
+
+// Matches whole words after lower casing, leetspeak normalization and collapsing repeated letters
+type WordFilter struct {
+    words map[string]bool
+}
+
+func MakeWordFilter(words []string) *WordFilter {
+    f := &WordFilter { words: make(map[string]bool) }
+    for _, w := range words {
+        normalized := make([]rune, 0, len(w))
+        for _, r := range w {
+            normalized = append(normalized, normalizeRune(r))
+        }
+        if len(normalized) > 0 {
+            f.words[collapseRepeats(normalized)] = true
+        }
+    }
+    return f
+}
+
+func (f *WordFilter) matches(token []rune) bool {
+    normalized := make([]rune, len(token))
+    for i, r := range token {
+        normalized[i] = normalizeRune(r)
+    }
+    if f.words[collapseRepeats(normalized)] {
+        return true
+    }
+
+    // Leet symbols at the edges are more likely punctuation, eg. "hello!"
+    start, end := 0, len(token)
+    for start < end && !unicode.IsLetter(token[start]) && !unicode.IsDigit(token[start]) { start++; }
+    for end > start && !unicode.IsLetter(token[end - 1]) && !unicode.IsDigit(token[end - 1]) { end--; }
+    if start == 0 && end == len(token) || start == end {
+        return false
+    }
+    return f.words[collapseRepeats(normalized[start:end])]
+}
+
+func (f *WordFilter) Apply(text string) (string, []string) {
+    runes := []rune(text)
+    hits := make([]string, 0)
+    for i := 0; i < len(runes); {
+        if !isWordRune(runes[i]) {
+            i++
+            continue
+        }
+        j := i
+        for j < len(runes) && isWordRune(runes[j]) { j++; }
+        if f.matches(runes[i:j]) {
+            hits = append(hits, string(runes[i:j]))
+            mask(runes[i:j])
+        }
+        i = j
+    }
+    return string(runes), hits
+}
+
+func mask(runes []rune) {
+    for i := range runes {
+        runes[i] = '*'
+    }
+}
+
+//////////////////////////////////////////////////
+
+var linkRegex = regexp.MustCompile(`(?i)\b(?:[a-z][a-z0-9+.-]*://|www\.)\S+|\b[a-z0-9-]+(?:\.[a-z0-9-]+)*\.(?:com|net|org|io|gg|co|me|ru|xyz|tk|ly|be|tv|info|biz)\b(?:/\S*)?`)
+
+type LinkFilter struct{}
+
+func (f *LinkFilter) Apply(text string) (string, []string) {
+    hits := linkRegex.FindAllString(text, -1)
+    if len(hits) == 0 {
+        return text, hits
+    }
+    return linkRegex.ReplaceAllStringFunc(text, func (s string) string {
+        return strings.Repeat("*", len([]rune(s)))
+    }), hits
+}
+
+//////////////////////////////////////////////////
+
+// Lower cases shouting, if enough of the letters are upper case
+type CapsFilter struct {
+    MinLetters int
+    MaxUpperRatio float64
+}
+
+func (f *CapsFilter) Apply(text string) (string, []string) {
+    letters, upper := 0, 0
+    for _, r := range text {
+        if unicode.IsLetter(r) {
+            letters++
+            if unicode.IsUpper(r) {
+                upper++
+            }
+        }
+    }
+    if letters < f.MinLetters || float64(upper) / float64(letters) <= f.MaxUpperRatio {
+        return text, nil
+    }
+    return strings.ToLower(text), nil
+}
+
+//////////////////////////////////////////////////
+
+// Keeps at most one combining mark per base character, so normal accents survive
+type ZalgoFilter struct{}
+
+func (f *ZalgoFilter) Apply(text string) (string, []string) {
+    var b strings.Builder
+    marks := 0
+    for _, r := range text {
+        if unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Me, r) {
+            marks++
+            if marks > 1 {
+                continue
+            }
+        } else {
+            marks = 0
+        }
+        b.WriteRune(r)
+    }
+    return b.String(), nil
+}
@@ -0,0 +1,229 @@
+package filter
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "sync"
+    "sync/atomic"
+    "time"
+	"github.com/starqi/wi-util-servers/internal/logging"
+)
+
+const (
+    // Matches are replaced with asterisks
+    ActionMask = "mask"
+    // Message is not sent at all
+    ActionReject = "reject"
+    // Message is sent as-is, but the hit is still recorded for moderators
+    ActionFlag = "flag"
+)
+
+var logger = logging.For("filter")
+
+const reloadPollInterval = 5 * time.Second
+const recentHitsSize = 100
+
+// Config file is JSON
+type Config struct {
+    Words []string `json:"words"`
+    BlockLinks bool `json:"blockLinks"`
+    StripCaps bool `json:"stripCaps"`
+    StripZalgo bool `json:"stripZalgo"`
+    // Defaults to mask
+    DefaultAction string `json:"defaultAction"`
+    // Room -> action, overrides the default
+    RoomActions map[string]string `json:"roomActions"`
+}
+
+type Result struct {
+    Text string
+    Hits []string
+    // Empty if there were no hits
+    Action string
+}
+
+type Hit struct {
+    Room string `json:"room"`
+    SessionID string `json:"sessionId"`
+    PlayerName string `json:"playerName"`
+    Text string `json:"text"`
+    Hits []string `json:"hits"`
+    Action string `json:"action"`
+    CreatedAt int64 `json:"createdAt"`
+}
+
+type ruleset struct {
+    // Always applied
+    normalizers []Filter
+    // Applied according to the room's action
+    matchers []Filter
+    defaultAction string
+    roomActions map[string]string
+}
+
+type Pipeline struct {
+    path string
+    rules atomic.Pointer[ruleset]
+    modTime time.Time
+
+    hitsMutex sync.Mutex
+    recentHits []Hit
+}
+
+func isValidAction(action string) bool {
+    return action == ActionMask || action == ActionReject || action == ActionFlag
+}
+
+func compile(config *Config) (*ruleset, error) {
+    r := &ruleset {
+        normalizers: make([]Filter, 0),
+        matchers: make([]Filter, 0),
+        defaultAction: config.DefaultAction,
+        roomActions: config.RoomActions,
+    }
+    if r.defaultAction == "" {
+        r.defaultAction = ActionMask
+    }
+    if !isValidAction(r.defaultAction) {
+        return nil, fmt.Errorf("Invalid default action %s", r.defaultAction)
+    }
+    for room, action := range r.roomActions {
+        if !isValidAction(action) {
+            return nil, fmt.Errorf("Invalid action %s for room %s", action, room)
+        }
+    }
+
+    if config.StripZalgo {
+        r.normalizers = append(r.normalizers, &ZalgoFilter{})
+    }
+    if config.StripCaps {
+        r.normalizers = append(r.normalizers, &CapsFilter { MinLetters: 6, MaxUpperRatio: 0.7 })
+    }
+    if len(config.Words) > 0 {
+        r.matchers = append(r.matchers, MakeWordFilter(config.Words))
+    }
+    if config.BlockLinks {
+        r.matchers = append(r.matchers, &LinkFilter{})
+    }
+    return r, nil
+}
+
+func MakePipelineFromConfig(config *Config) (*Pipeline, error) {
+    rules, err := compile(config)
+    if err != nil {
+        return nil, err
+    }
+    p := &Pipeline { recentHits: make([]Hit, 0, recentHitsSize) }
+    p.rules.Store(rules)
+    return p, nil
+}
+
+// Polls the file for changes and reloads it, keeping the previous rules if the new file is invalid
+func MakePipeline(path string) (*Pipeline, error) {
+    p := &Pipeline { path: path, recentHits: make([]Hit, 0, recentHitsSize) }
+    if err := p.reload(); err != nil {
+        return nil, err
+    }
+    go p.watcher()
+    return p, nil
+}
+
+func (p *Pipeline) reload() error {
+    info, err := os.Stat(p.path)
+    if err != nil {
+        return err
+    }
+    raw, err := os.ReadFile(p.path)
+    if err != nil {
+        return err
+    }
+    var config Config
+    if err := json.Unmarshal(raw, &config); err != nil {
+        return err
+    }
+    rules, err := compile(&config)
+    if err != nil {
+        return err
+    }
+    p.rules.Store(rules)
+    p.modTime = info.ModTime()
+    logger.Info("Loaded chat filter", "path", p.path, "words", len(config.Words))
+    return nil
+}
+
+func (p *Pipeline) watcher() {
+    ticker := time.NewTicker(reloadPollInterval)
+    for {
+        <-ticker.C
+        info, err := os.Stat(p.path)
+        if err != nil {
+            logger.Error("Failed to check chat filter, keeping previous", "err", err)
+            continue
+        }
+        if info.ModTime().Equal(p.modTime) {
+            continue
+        }
+        if err := p.reload(); err != nil {
+            logger.Error("Failed to reload chat filter, keeping previous", "err", err)
+            // Don't retry until the file changes again
+            p.modTime = info.ModTime()
+        }
+    }
+}
+
+// Thread safe
+func (p *Pipeline) Check(room string, text string) Result {
+    rules := p.rules.Load()
+    if rules == nil {
+        return Result { Text: text }
+    }
+
+    for _, f := range rules.normalizers {
+        text, _ = f.Apply(text)
+    }
+
+    masked := text
+    hits := make([]string, 0)
+    for _, f := range rules.matchers {
+        var h []string
+        masked, h = f.Apply(masked)
+        hits = append(hits, h...)
+    }
+    if len(hits) == 0 {
+        return Result { Text: text }
+    }
+
+    action, found := rules.roomActions[room]
+    if !found {
+        action = rules.defaultAction
+    }
+    switch action {
+    case ActionMask:
+        return Result { Text: masked, Hits: hits, Action: action }
+    case ActionReject:
+        return Result { Text: "", Hits: hits, Action: action }
+    default:
+        return Result { Text: text, Hits: hits, Action: action }
+    }
+}
+
+// Thread safe, keeps only the most recent hits
+func (p *Pipeline) RecordHit(hit Hit) {
+    logger.Info("Chat filter hit", "action", hit.Action, "room", hit.Room, "playerName", hit.PlayerName, "hits", hit.Hits)
+    p.hitsMutex.Lock()
+    defer p.hitsMutex.Unlock()
+    if len(p.recentHits) >= recentHitsSize {
+        p.recentHits = p.recentHits[1:]
+    }
+    p.recentHits = append(p.recentHits, hit)
+}
+
+// Thread safe, oldest first
+func (p *Pipeline) RecentHits() []Hit {
+    p.hitsMutex.Lock()
+    defer p.hitsMutex.Unlock()
+    result := make([]Hit, len(p.recentHits))
+    copy(result, p.recentHits)
+    return result
+}
@@ -0,0 +1,10 @@
+package history
+
+type ChatLog struct {
+    ID int64 `json:"id"`
+    Room string `json:"room"`
+    SessionID string `json:"sessionId"`
+    PlayerName string `json:"playerName"`
+    Text string `json:"text"`
+    CreatedAt int64 `json:"createdAt"`
+}
@@ -0,0 +1,177 @@
+package history
+
+import (
+    "context"
+    "time"
+    "gorm.io/gorm"
+    "gorm.io/driver/sqlite"
+	"github.com/starqi/wi-util-servers/internal/deadline"
+	"github.com/starqi/wi-util-servers/internal/health"
+	"github.com/starqi/wi-util-servers/internal/logging"
+)
+
+// Pending writes beyond this are dropped, so that a slow disk never blocks the chat aggregator
+const writeQueueSize = 1000
+const maxBatchSize = 100
+const batchInterval = time.Second
+const pruneInterval = time.Hour
+
+const maxQueryLimit = 1000
+
+var logger = logging.For("history")
+
+type HistoryDb struct {
+    db *gorm.DB
+    writes chan ChatLog
+    retentionSeconds int64
+    flushChan chan chan bool
+}
+
+// All fields are optional, zero values are ignored
+type Query struct {
+    Room string
+    PlayerName string
+    SessionID string
+    // Unix seconds, inclusive
+    From int64
+    To int64
+    Limit int
+}
+
+// Starts the background writer and pruner
+func MakeHistoryDb(sqliteDbPath string, retentionDays int) (*HistoryDb, error) {
+    db, err := gorm.Open(sqlite.Open(sqliteDbPath), &gorm.Config{})
+    if err != nil {
+        return nil, err
+    }
+    h := &HistoryDb {
+        db,
+        make(chan ChatLog, writeQueueSize),
+        int64(retentionDays) * 24 * 3600,
+        make(chan chan bool),
+    }
+    go h.writer()
+    return h, nil
+}
+
+// Non-blocking, safe to call from the chat aggregator
+func (h *HistoryDb) Log(entry ChatLog) {
+    select {
+    case h.writes <- entry:
+    default:
+        logger.Warn("Chat log write queue full, dropping", "room", entry.Room, "playerName", entry.PlayerName)
+    }
+}
+
+// Writable and migrated to the latest file in the directory, for the whole chat DB
+func (h *HistoryDb) Checks(migrationsDir string) []health.Check {
+    return []health.Check { health.Writable(h.db), health.Schema(h.db, migrationsDir) }
+}
+
+// Pending writes, for metrics
+func (h *HistoryDb) QueueDepth() int {
+    return len(h.writes)
+}
+
+func (h *HistoryDb) writer() {
+    batchTicker := time.NewTicker(batchInterval)
+    defer batchTicker.Stop()
+    pruneTicker := time.NewTicker(pruneInterval)
+    defer pruneTicker.Stop()
+    batch := make([]ChatLog, 0, maxBatchSize)
+    for {
+        select {
+        case entry := <-h.writes:
+            batch = append(batch, entry)
+            if len(batch) >= maxBatchSize {
+                batch = h.writeBatch(batch)
+            }
+        case <-batchTicker.C:
+            batch = h.writeBatch(batch)
+        case <-pruneTicker.C:
+            if _, err := h.Prune(time.Now().Unix() - h.retentionSeconds); err != nil {
+                logger.Error("Failed to prune chat logs", "err", err)
+            }
+        case cb := <-h.flushChan:
+            for len(h.writes) > 0 {
+                batch = append(batch, <-h.writes)
+            }
+            h.writeBatch(batch)
+            cb <- true
+            close(cb)
+            return
+        }
+    }
+}
+
+// Writes everything queued so far and stops the writer, then closes the DB.
+// Should be called after the chat is closed, since later logs are dropped.
+func (h *HistoryDb) Close(ctx context.Context) error {
+    cb := make(chan bool, 1)
+    if _, err := deadline.Call(ctx, h.flushChan, cb, cb); err != nil {
+        return err
+    }
+    db, err := h.db.DB()
+    if err != nil {
+        return err
+    }
+    return db.Close()
+}
+
+// Returns the emptied batch for reuse
+func (h *HistoryDb) writeBatch(batch []ChatLog) []ChatLog {
+    if len(batch) == 0 {
+        return batch
+    }
+    if err := h.Insert(batch); err != nil {
+        logger.Error("Failed to write chat logs", "count", len(batch), "err", err)
+    }
+    return batch[:0]
+}
+
+func (h *HistoryDb) Insert(entries []ChatLog) error {
+    return h.db.Create(entries).Error
+}
+
+func (h *HistoryDb) Prune(beforeSeconds int64) (int64, error) {
+    result := h.db.Where("created_at < ?", beforeSeconds).Delete(&ChatLog{})
+    if result.Error != nil {
+        return 0, result.Error
+    }
+    if result.RowsAffected > 0 {
+        logger.Info("Pruned chat logs", "count", result.RowsAffected)
+    }
+    return result.RowsAffected, nil
+}
+
+// Oldest first
+func (h *HistoryDb) Select(q *Query) ([]ChatLog, error) {
+    tx := h.db.Model(&ChatLog{})
+    if q.Room != "" {
+        tx = tx.Where("room = ?", q.Room)
+    }
+    if q.PlayerName != "" {
+        tx = tx.Where("player_name = ?", q.PlayerName)
+    }
+    if q.SessionID != "" {
+        tx = tx.Where("session_id = ?", q.SessionID)
+    }
+    if q.From > 0 {
+        tx = tx.Where("created_at >= ?", q.From)
+    }
+    if q.To > 0 {
+        tx = tx.Where("created_at <= ?", q.To)
+    }
+
+    limit := q.Limit
+    if limit <= 0 || limit > maxQueryLimit {
+        limit = maxQueryLimit
+    }
+
+    var logs []ChatLog
+    result := tx.Order("created_at, id").Limit(limit).Find(&logs)
+    if result.Error != nil {
+        return nil, result.Error
+    }
+    return logs, nil
+}
@@ -0,0 +1,86 @@
+package history
+
+import (
+    "context"
+    "testing"
+    "time"
+)
+
+var now = time.Now().Unix()
+
+var h *HistoryDb
+
+func TestInsertSelectAndPrune(t *testing.T) {
+    err := h.Insert([]ChatLog {
+        { Room: "game1", SessionID: "s1", PlayerName: "Bob", Text: "old", CreatedAt: now - 3600 },
+        { Room: "game1", SessionID: "s1", PlayerName: "Bob", Text: "hi", CreatedAt: now - 60 },
+        { Room: "game1", SessionID: "s2", PlayerName: "Jill", Text: "hello", CreatedAt: now - 30 },
+        { Room: "game2", SessionID: "s3", PlayerName: "Jack", Text: "gg", CreatedAt: now - 10 },
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    game1, err := h.Select(&Query { Room: "game1" })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(game1) != 3 {
+        t.Fatalf("Expected 3 rows, got %d", len(game1))
+    }
+    if game1[0].Text != "old" || game1[2].Text != "hello" {
+        t.Fatalf("Expected oldest first, got %v", game1)
+    }
+
+    bobRecent, err := h.Select(&Query { PlayerName: "Bob", From: now - 120, To: now })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(bobRecent) != 1 || bobRecent[0].Text != "hi" {
+        t.Fatalf("Expected Bob's recent message, got %v", bobRecent)
+    }
+
+    bob, err := h.Select(&Query { SessionID: "s1" })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(bob) != 2 || bob[0].SessionID != "s1" {
+        t.Fatalf("Expected Bob's 2 messages by session, got %v", bob)
+    }
+
+    limited, err := h.Select(&Query { Limit: 2 })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(limited) != 2 {
+        t.Fatalf("Expected 2 rows, got %d", len(limited))
+    }
+
+    pruned, err := h.Prune(now - 120)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if pruned != 1 {
+        t.Fatalf("Expected 1 pruned, got %d", pruned)
+    }
+    game1, err = h.Select(&Query { Room: "game1" })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(game1) != 2 {
+        t.Fatalf("Expected 2 rows after prune, got %d", len(game1))
+    }
+}
+
+func TestChecks(t *testing.T) {
+    for _, check := range h.Checks("../../../db/chat-migrations") {
+        if err := check.Run(context.Background()); err != nil {
+            t.Fatalf("Expected %s check to pass, got %s", check.Name, err)
+        }
+    }
+}
+
+func TestMain(m *testing.M) {
+    h = RemakeTestDb()
+    m.Run()
+}
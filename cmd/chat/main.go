@@ -1,43 +1,203 @@
 package main
 
 import (
+    "context"
+    "crypto/rand"
+    "encoding/base64"
+    "fmt"
     "net/http"
-    "log"
+    "os"
+    "strconv"
+    "time"
     "github.com/gin-gonic/gin"
     "github.com/gorilla/websocket"
+	"github.com/starqi/wi-util-servers/cmd/chat/auth"
 	"github.com/starqi/wi-util-servers/cmd/chat/chat"
+	"github.com/starqi/wi-util-servers/cmd/chat/filter"
+	"github.com/starqi/wi-util-servers/cmd/chat/history"
+	"github.com/starqi/wi-util-servers/cmd/chat/reports"
 	"github.com/starqi/wi-util-servers/cmd/chat/sessions"
+	"github.com/starqi/wi-util-servers/internal/broker"
+	"github.com/starqi/wi-util-servers/internal/config"
+	"github.com/starqi/wi-util-servers/internal/cors"
+	"github.com/starqi/wi-util-servers/internal/deadline"
+	"github.com/starqi/wi-util-servers/internal/health"
+	"github.com/starqi/wi-util-servers/internal/logging"
+	"github.com/starqi/wi-util-servers/internal/metrics"
+	"github.com/starqi/wi-util-servers/internal/shutdown"
+	"github.com/starqi/wi-util-servers/internal/token"
 )
 
+const readinessTimeout = 2 * time.Second
+
+var logger = logging.For("main")
+
+var cfg Config
+
 var chatService *chat.Chat
-var sessionsService *sessions.Sessions
+// All the same sessions service, split so that handlers only use what they need
+var sessionsService sessions.SessionStore
+var moderation sessions.Moderation
+var gameServers sessions.ServerRegistry
+var sessionsLifecycle sessions.Lifecycle
+var historyDb *history.HistoryDb
+var chatFilters *filter.Pipeline
+var reportsStore reports.Store
+var sessionsDb *sessions.SessionsDb
+var keyring *auth.Keyring
+var corsOrigins *cors.Allowlist
 
 func main() {
 
-    sessionsService = sessions.MakeSessions()
-    chatService = chat.MakeChat(sessionsService)
-
-    // TODO CORS is for ease of local testing not behind Nginx, or else Chrome blocks requests to different ports
-    router := gin.Default()
-    router.Use(func (c *gin.Context) {
-        c.Header("Access-Control-Allow-Origin", "*")
-        c.Header("Access-Control-Allow-Methods", "*")
-        c.Header("Access-Control-Allow-Headers", "Authorization, *")
-        if c.Request.Method == "OPTIONS" {
-            c.AbortWithStatus(http.StatusNoContent)
-        } else {
-            c.Next()
+    cfg = defaultConfig()
+    args, err := config.Load("chat", &cfg, os.Args[1:])
+    if err != nil {
+        logging.Fatal(logger, "Invalid config", "err", err)
+    }
+    if exit, err := config.Command(args, &cfg, os.Stdout); err != nil {
+        logging.Fatal(logger, "Invalid config", "err", err)
+    } else if exit {
+        return
+    }
+    // Already validated
+    logConfig, _ := cfg.logging()
+    logging.Setup(logConfig)
+
+    if chatDbPath := cfg.ChatDbPath; chatDbPath == "" {
+        logger.Warn("Missing chatDbPath, chat logs, reports and sessions will not be persisted")
+        reportsStore = reports.MakeMemoryStore()
+    } else {
+        _historyDb, err := history.MakeHistoryDb(chatDbPath, cfg.ChatRetentionDays)
+        if err != nil {
+            logging.Fatal(logger, "Could not access chat DB", "err", err)
         }
-    })
+        historyDb = _historyDb
+        _reportsStore, err := reports.MakeSqliteStore(chatDbPath)
+        if err != nil {
+            logging.Fatal(logger, "Could not access chat DB", "err", err)
+        }
+        reportsStore = _reportsStore
+        _sessionsDb, err := sessions.MakeSessionsDb(chatDbPath)
+        if err != nil {
+            logging.Fatal(logger, "Could not access chat DB", "err", err)
+        }
+        sessionsDb = _sessionsDb
+    }
+
+    if chatFilterPath := cfg.ChatFilterPath; chatFilterPath == "" {
+        logger.Warn("Missing chatFilterPath, chat will not be filtered")
+    } else {
+        _chatFilters, err := filter.MakePipeline(chatFilterPath)
+        if err != nil {
+            logging.Fatal(logger, "Could not load chat filter", "err", err)
+        }
+        chatFilters = _chatFilters
+    }
+
+    if keyringPath := cfg.KeyringPath; keyringPath == "" {
+        logger.Warn("Missing keyringPath, private routes will answer 503")
+    } else {
+        _keyring, err := auth.MakeKeyring(keyringPath)
+        if err != nil {
+            logging.Fatal(logger, "Could not load keyring", "err", err)
+        }
+        keyring = _keyring
+    }
+
+    chatBroker, err := broker.Make(cfg.BrokerUrl)
+    if err != nil {
+        logging.Fatal(logger, "Could not make broker", "err", err)
+    }
+
+    sessionsImpl := sessions.MakeSessions(makeSigner(), cfg.lifetimes(), sessionsDb, chatBroker)
+    sessionsService, moderation, gameServers, sessionsLifecycle = sessionsImpl, sessionsImpl, sessionsImpl, sessionsImpl
+    chatService = chat.MakeChat(sessionsImpl, cfg.chatOptions(), historyDb, chatFilters, reportsStore, chatBroker)
+    metrics.Default.Collect(collectMetrics)
+
+    // Already validated
+    corsOrigins, _ = cors.MakeAllowlist(cfg.CorsOrigins)
+    corsPolicy := cors.MakePolicy(corsOrigins, cfg.CorsHeaders, cfg.CorsMaxAge.D())
+
+    router := gin.New()
+    router.Use(gin.Recovery(), logging.Middleware(logging.For("http")))
+    router.Use(corsPolicy.Middleware())
+    router.Use(metrics.Middleware(metrics.Default))
     router.GET("/chat", chatWs)
+    corsPolicy.Route("/chat", cors.Rule { Methods: []string { http.MethodGet } })
     // Should be rate limited by Nginx
     router.POST("/token/new", newToken)
+    router.POST("/token/refresh", refreshToken)
+    // The token is the credential
+    router.GET("/token/:id/ttl", describeTokenTtl)
+    router.POST("/report", postReport)
+    router.GET("/presence", getOnlineCount)
+    router.GET("/presence/:gameInstance", getRoster)
+    router.GET("/servers", listServers)
+    router.GET("/healthz", health.Liveness)
+    router.GET("/readyz", health.Readiness(readinessTimeout, readinessChecks()...))
 
-    // Private via Nginx
-    router.GET("/token/:id", describeToken)
-    router.PATCH("/token/:id", patchToken)
+    // Private, via Nginx and the keyring. Admin tools send the key as a bearer token.
+    privateCors := cors.Rule { Headers: []string { "Authorization", "Content-Type" } }
+    private := func (method string, route string, permission string, handler gin.HandlerFunc) {
+        router.Handle(method, route, keyring.Require(permission), handler)
+        corsPolicy.Route(route, privateCors)
+    }
+    private(http.MethodGet, "/token/revoked", auth.PermSessions, listRevokedTokens)
+    private(http.MethodGet, "/token/:id", auth.PermSessions, describeToken)
+    private(http.MethodPatch, "/token/:id", auth.PermSessions, patchToken)
+    private(http.MethodDelete, "/token/:id", auth.PermSessions, revokeToken)
+    private(http.MethodPost, "/token/:id/mute", auth.PermModerate, muteToken)
+    private(http.MethodPost, "/token/:id/kick", auth.PermModerate, kickToken)
+    private(http.MethodPost, "/token/:id/ban", auth.PermModerate, banToken)
+    private(http.MethodDelete, "/token/:id/ban", auth.PermModerate, unbanToken)
+    private(http.MethodPost, "/player/:name/ban", auth.PermModerate, banPlayer)
+    private(http.MethodDelete, "/player/:name/ban", auth.PermModerate, unbanPlayer)
+    private(http.MethodGet, "/bans", auth.PermModerate, listBans)
+    private(http.MethodPut, "/server/:id", auth.PermServers, registerServer)
+    private(http.MethodPost, "/server/:id/heartbeat", auth.PermServers, heartbeatServer)
+    private(http.MethodDelete, "/server/:id", auth.PermServers, deregisterServer)
+    private(http.MethodGet, "/chat/history", auth.PermChat, getChatHistory)
+    private(http.MethodGet, "/chat/filter/hits", auth.PermChat, getChatFilterHits)
+    private(http.MethodPost, "/chat/system", auth.PermChat, postSystemMessage)
+    private(http.MethodGet, "/reports", auth.PermReports, listReports)
+    private(http.MethodPost, "/reports/:id/resolve", auth.PermReports, resolveReport)
+    private(http.MethodGet, "/metrics", auth.PermMetrics, metrics.Handler(metrics.Default))
+    if err := corsPolicy.Preflight(router); err != nil {
+        logging.Fatal(logger, "Invalid CORS rules", "err", err)
+    }
 
-    router.Run()
+    // Chat before sessions, since chat waits on sessions, and both before the DBs they write to
+    // The websocket is hijacked, so has no deadline
+    handler := deadline.Handler(router, cfg.RequestTimeout.D(), "/chat")
+    err = shutdown.Run(handler, fmt.Sprintf(":%d", cfg.Port), cfg.ShutdownTimeout.D(),
+        func (ctx context.Context) {
+            if err := chatService.Close(ctx); err != nil {
+                logger.Error("Chat did not close", "err", err)
+            }
+        },
+        func (ctx context.Context) {
+            if err := sessionsLifecycle.Close(ctx); err != nil {
+                logger.Error("Sessions did not close", "err", err)
+            }
+            if err := sessionsDb.Close(ctx); err != nil {
+                logger.Error("Sessions DB did not close", "err", err)
+            }
+        },
+        func (ctx context.Context) {
+            if historyDb != nil {
+                if err := historyDb.Close(ctx); err != nil {
+                    logger.Error("Chat logs did not close", "err", err)
+                }
+            }
+            if err := reportsStore.Close(); err != nil {
+                logger.Error("Reports did not close", "err", err)
+            }
+            chatBroker.Close()
+        },
+    )
+    if err != nil {
+        logging.Fatal(logger, "Could not serve", "err", err)
+    }
 }
 
 var upgrader = websocket.Upgrader {
@@ -46,29 +206,113 @@ var upgrader = websocket.Upgrader {
     CheckOrigin: checkOrigin,
 }
 
-// WS has no CORS b/c of 101 protocol switch
-// Will use session token validation   
+// WS has no CORS b/c of 101 protocol switch, so the allowlist is checked here
 func checkOrigin(r *http.Request) bool {
-    return true
+    return corsOrigins.CheckOrigin(r)
 }
 
 func chatWs(c *gin.Context) {
     conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
     if err != nil {
-        log.Print("Chat init failed! ", err)
+        logger.InfoContext(c.Request.Context(), "Chat init failed", "err", err)
+        return
+    }
+    if err := deadline.Send(c.Request.Context(), chatService.Register, conn); err != nil {
+        logger.WarnContext(c.Request.Context(), "Chat register timed out")
+        conn.Close()
         return
     }
-    chatService.Register <- conn
     c.Status(http.StatusOK);
 }
 
+// The DB is only checked if chat is persisted
+func readinessChecks() []health.Check {
+    checks := []health.Check {
+        { Name: "chat", Run: chatService.Ping },
+        { Name: "sessions", Run: sessionsLifecycle.Ping },
+    }
+    if historyDb != nil {
+        checks = append(checks, historyDb.Checks(cfg.MigrationsDir)...)
+    }
+    return checks
+}
+
+// Without a configured secret, tokens are only valid until restart and can't be verified elsewhere
+func makeSigner() *token.Signer {
+    var secret []byte
+    if cfg.SessionSecret == "" {
+        logger.Warn("Missing sessionSecret, using a random secret")
+        secret = make([]byte, 32)
+        if _, err := rand.Read(secret); err != nil {
+            logging.Fatal(logger, "Failed to generate session secret", "err", err)
+        }
+    } else {
+        // Already validated
+        secret, _ = base64.StdEncoding.DecodeString(cfg.SessionSecret)
+    }
+
+    signer, err := token.MakeSigner(secret)
+    if err != nil {
+        logging.Fatal(logger, "Could not make signer", "err", err)
+    }
+    return signer
+}
+
+// Not found gets the given status, timeouts get a 503, anything else is logged
+func abortSessionsError(c *gin.Context, err error, notFoundStatus int) {
+    if err == sessions.ErrNotFound {
+        c.AbortWithStatus(notFoundStatus)
+        return
+    }
+    if deadline.IsExceeded(err) {
+        logger.WarnContext(c.Request.Context(), "Sessions request timed out", "method", c.Request.Method, "route", c.FullPath())
+        deadline.Abort(c)
+        return
+    }
+    logger.ErrorContext(c.Request.Context(), "Sessions request failed", "method", c.Request.Method, "route", c.FullPath(), "err", err)
+    c.AbortWithStatus(http.StatusInternalServerError)
+}
+
 func newToken(c *gin.Context) {
-    cb := make(chan *string)
-    sessionsService.RequestChan<-sessions.RequestData{Cb: cb}
-    token := <-cb
+    token, err := sessionsService.Create(c.Request.Context())
+    if err != nil {
+        abortSessionsError(c, err, http.StatusInternalServerError)
+        return
+    }
     c.JSON(http.StatusOK, gin.H{"token": token})
 }
 
+type refreshTokenRequest struct {
+    Token string `json:"token"`
+}
+
+// For clients to stay logged in outside of a game, where no game server patches the session
+func refreshToken(c *gin.Context) {
+    var json refreshTokenRequest
+    if err := c.BindJSON(&json); err != nil {
+        logger.InfoContext(c.Request.Context(), "Refresh token JSON parse failed", "err", err)
+        c.AbortWithStatus(http.StatusBadRequest)
+        return
+    }
+
+    token, err := sessionsService.Refresh(c.Request.Context(), json.Token)
+    if err != nil {
+        abortSessionsError(c, err, http.StatusUnauthorized)
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"token": token})
+}
+
+func describeTokenTtl(c *gin.Context) {
+    session, err := sessionsService.Get(c.Request.Context(), c.Param("id"))
+    if err != nil {
+        abortSessionsError(c, err, http.StatusNotFound)
+        return
+    }
+    json := sessions.SessionToJson(session)
+    c.JSON(http.StatusOK, gin.H{"ttl": json.Ttl, "maxTtl": json.MaxTtl})
+}
+
 func describeToken(c *gin.Context) {
     id, success := c.Params.Get("id")
     if !success {
@@ -76,13 +320,13 @@ func describeToken(c *gin.Context) {
         return
     }
 
-    cb := make(chan *sessions.Session)
-    sessionsService.FindChan<-sessions.FindData{Token: id, Cb: cb}
-
-    if session := <-cb; session != nil {
-        c.JSON(http.StatusOK, sessions.SessionToJson(session))
-    } else {
+    session, err := sessionsService.Get(c.Request.Context(), id)
+    if err == sessions.ErrNotFound {
         c.JSON(http.StatusOK, nil)
+    } else if err != nil {
+        abortSessionsError(c, err, http.StatusOK)
+    } else {
+        c.JSON(http.StatusOK, sessions.SessionToJson(session))
     }
 }
 
@@ -95,18 +339,388 @@ func patchToken(c *gin.Context) {
 
     var json sessions.PatchSessionRequest
     if err := c.BindJSON(&json); err != nil {
-        log.Print("Patch token JSON parse failed ", err)
+        logger.InfoContext(c.Request.Context(), "Patch token JSON parse failed", "err", err)
         c.AbortWithStatus(http.StatusBadRequest)
         return
     }
 
-    cb := make(chan bool);
-    sessionsService.PatchFromJsonChan<-sessions.PatchFromJsonData{Token: id, Info: &json, Cb: cb}
-    if success := <-cb; !success {
-        log.Print("Patch token missing token ", id)
+    token, err := sessionsService.Patch(c.Request.Context(), id, &json)
+    if err != nil {
+        logger.InfoContext(c.Request.Context(), "Patch token missing token", "token", id)
+        abortSessionsError(c, err, http.StatusBadRequest)
+        return
+    }
+
+    // Claims changed, so callers verifying offline need the new token
+    c.JSON(http.StatusOK, gin.H{"token": token})
+}
+
+func revokeToken(c *gin.Context) {
+    id, success := c.Params.Get("id")
+    if !success {
         c.AbortWithStatus(http.StatusBadRequest)
         return
     }
 
+    if err := sessionsService.Revoke(c.Request.Context(), id); err != nil {
+        logger.InfoContext(c.Request.Context(), "Revoke token missing token", "token", id)
+        abortSessionsError(c, err, http.StatusBadRequest)
+        return
+    }
+
+    c.Status(http.StatusOK)
+}
+
+// Query params are all optional: room, player, session (ID), from, to (unix seconds), num
+func getChatHistory(c *gin.Context) {
+    if historyDb == nil {
+        c.Status(http.StatusNotFound)
+        c.Writer.Write([]byte("Chat logs are not persisted"))
+        return
+    }
+
+    from, _ := strconv.ParseInt(c.Query("from"), 10, 64)
+    to, _ := strconv.ParseInt(c.Query("to"), 10, 64)
+    num, _ := strconv.Atoi(c.Query("num"))
+
+    logs, err := historyDb.Select(&history.Query {
+        Room: c.Query("room"),
+        PlayerName: c.Query("player"),
+        SessionID: c.Query("session"),
+        From: from,
+        To: to,
+        Limit: num,
+    })
+    if err != nil {
+        logger.ErrorContext(c.Request.Context(), "Failed to get chat history", "err", err)
+        c.Status(http.StatusInternalServerError)
+        return
+    }
+
+    c.JSON(http.StatusOK, logs)
+}
+
+type moderationRequest struct {
+    // Zero unmutes, or bans permanently
+    Seconds int64 `json:"seconds"`
+    Reason string `json:"reason"`
+}
+
+// Body is optional
+func bindModerationRequest(c *gin.Context) (moderationRequest, bool) {
+    var json moderationRequest
+    if c.Request.ContentLength == 0 {
+        return json, true
+    }
+    if err := c.BindJSON(&json); err != nil {
+        logger.InfoContext(c.Request.Context(), "Moderation JSON parse failed", "err", err)
+        return json, false
+    }
+    return json, true
+}
+
+func moderate(c *gin.Context, req sessions.ModerateRequest) {
+    if err := moderation.Moderate(c.Request.Context(), req); err != nil {
+        logger.InfoContext(c.Request.Context(), "Moderation target not found", "token", req.Token, "playerName", req.PlayerName)
+        abortSessionsError(c, err, http.StatusNotFound)
+        return
+    }
     c.Status(http.StatusOK)
 }
+
+func muteToken(c *gin.Context) {
+    json, ok := bindModerationRequest(c)
+    if !ok {
+        c.AbortWithStatus(http.StatusBadRequest)
+        return
+    }
+    moderate(c, sessions.ModerateRequest{
+        Kind: sessions.ModerateMute,
+        Token: c.Param("id"),
+        Duration: time.Duration(json.Seconds) * time.Second,
+    })
+}
+
+func banToken(c *gin.Context) {
+    json, ok := bindModerationRequest(c)
+    if !ok {
+        c.AbortWithStatus(http.StatusBadRequest)
+        return
+    }
+    moderate(c, sessions.ModerateRequest{
+        Kind: sessions.ModerateBanToken,
+        Token: c.Param("id"),
+        Duration: time.Duration(json.Seconds) * time.Second,
+    })
+}
+
+func unbanToken(c *gin.Context) {
+    moderate(c, sessions.ModerateRequest{Kind: sessions.ModerateUnbanToken, Token: c.Param("id")})
+}
+
+func banPlayer(c *gin.Context) {
+    json, ok := bindModerationRequest(c)
+    if !ok {
+        c.AbortWithStatus(http.StatusBadRequest)
+        return
+    }
+    moderate(c, sessions.ModerateRequest{
+        Kind: sessions.ModerateBanPlayer,
+        PlayerName: c.Param("name"),
+        Duration: time.Duration(json.Seconds) * time.Second,
+    })
+}
+
+func unbanPlayer(c *gin.Context) {
+    moderate(c, sessions.ModerateRequest{Kind: sessions.ModerateUnbanPlayer, PlayerName: c.Param("name")})
+}
+
+func listBans(c *gin.Context) {
+    bans, err := moderation.ListBans(c.Request.Context())
+    if err != nil {
+        abortSessionsError(c, err, http.StatusInternalServerError)
+        return
+    }
+    c.JSON(http.StatusOK, bans)
+}
+
+// Kicks from chat only, the session stays valid
+func kickToken(c *gin.Context) {
+    json, ok := bindModerationRequest(c)
+    if !ok {
+        c.AbortWithStatus(http.StatusBadRequest)
+        return
+    }
+    reason := json.Reason
+    if reason == "" {
+        reason = "Kicked by a moderator"
+    }
+
+    session, err := sessionsService.Get(c.Request.Context(), c.Param("id"))
+    if err != nil {
+        abortSessionsError(c, err, http.StatusNotFound)
+        return
+    }
+
+    cb := make(chan int, 1)
+    kicked, err := deadline.Call(c.Request.Context(), chatService.KickChan, chat.KickData{SessionID: session.ID, Reason: reason, Cb: cb}, cb)
+    if err != nil {
+        deadline.Abort(c)
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"kicked": kicked})
+}
+
+func getChatFilterHits(c *gin.Context) {
+    if chatFilters == nil {
+        c.JSON(http.StatusOK, []filter.Hit{})
+        return
+    }
+    c.JSON(http.StatusOK, chatFilters.RecentHits())
+}
+
+type postReportRequest struct {
+    // Reporter's token
+    Token string `json:"token"`
+    chat.ReportRequest
+}
+
+func postReport(c *gin.Context) {
+    var json postReportRequest
+    if err := c.BindJSON(&json); err != nil {
+        logger.InfoContext(c.Request.Context(), "Report JSON parse failed", "err", err)
+        c.AbortWithStatus(http.StatusBadRequest)
+        return
+    }
+
+    report, err := chatService.Report(c.Request.Context(), json.Token, &json.ReportRequest)
+    if deadline.IsExceeded(err) {
+        deadline.Abort(c)
+        return
+    } else if err == chat.ErrReporterNotFound {
+        c.AbortWithStatus(http.StatusUnauthorized)
+        return
+    } else if err == chat.ErrMissingReportedPlayer {
+        c.AbortWithStatus(http.StatusBadRequest)
+        return
+    } else if err != nil {
+        logger.ErrorContext(c.Request.Context(), "Failed to report", "err", err)
+        c.Status(http.StatusInternalServerError)
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{"id": report.ID})
+}
+
+// Query params: resolved (default false), num
+func listReports(c *gin.Context) {
+    resolved := c.Query("resolved") == "true"
+    num, _ := strconv.Atoi(c.Query("num"))
+    result, err := reportsStore.List(resolved, num)
+    if err != nil {
+        logger.ErrorContext(c.Request.Context(), "Failed to list reports", "err", err)
+        c.Status(http.StatusInternalServerError)
+        return
+    }
+    c.JSON(http.StatusOK, result)
+}
+
+type resolveReportRequest struct {
+    Resolution string `json:"resolution"`
+}
+
+func resolveReport(c *gin.Context) {
+    id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+    if err != nil {
+        c.AbortWithStatus(http.StatusBadRequest)
+        return
+    }
+
+    var json resolveReportRequest
+    if err := c.BindJSON(&json); err != nil {
+        logger.InfoContext(c.Request.Context(), "Resolve report JSON parse failed", "err", err)
+        c.AbortWithStatus(http.StatusBadRequest)
+        return
+    }
+
+    if err := reportsStore.Resolve(id, json.Resolution); err == reports.ErrNotFound {
+        c.AbortWithStatus(http.StatusNotFound)
+        return
+    } else if err != nil {
+        logger.ErrorContext(c.Request.Context(), "Failed to resolve report", "err", err)
+        c.Status(http.StatusInternalServerError)
+        return
+    }
+    c.Status(http.StatusOK)
+}
+
+type systemMessageRequest struct {
+    // Omit to broadcast to every room
+    GameInstance *string `json:"gameInstance"`
+    Text string `json:"text"`
+}
+
+func postSystemMessage(c *gin.Context) {
+    var json systemMessageRequest
+    if err := c.BindJSON(&json); err != nil {
+        logger.InfoContext(c.Request.Context(), "System message JSON parse failed", "err", err)
+        c.AbortWithStatus(http.StatusBadRequest)
+        return
+    }
+    if json.Text == "" {
+        c.AbortWithStatus(http.StatusBadRequest)
+        return
+    }
+
+    data := chat.SystemData{Global: json.GameInstance == nil, Text: json.Text}
+    if json.GameInstance != nil {
+        data.Room = *json.GameInstance
+    }
+    cb := make(chan int, 1)
+    data.Cb = cb
+    rooms, err := deadline.Call(c.Request.Context(), chatService.SystemChan, data, cb)
+    if err != nil {
+        deadline.Abort(c)
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"rooms": rooms})
+}
+
+func getPresence(c *gin.Context) ([]sessions.Session, chat.Presence, bool) {
+    all, err := sessionsService.List(c.Request.Context())
+    if err != nil {
+        abortSessionsError(c, err, http.StatusInternalServerError)
+        return nil, nil, false
+    }
+    presenceCb := make(chan chat.Presence, 1)
+    presence, err := deadline.Call(c.Request.Context(), chatService.PresenceChan, chat.PresenceData{Cb: presenceCb}, presenceCb)
+    if err != nil {
+        deadline.Abort(c)
+        return nil, nil, false
+    }
+    return all, presence, true
+}
+
+type rosterEntry struct {
+    PlayerName string `json:"playerName"`
+    InChat bool `json:"inChat"`
+}
+
+// Public, so no tokens
+func getRoster(c *gin.Context) {
+    gameInstance := c.Param("gameInstance")
+    all, presence, ok := getPresence(c)
+    if !ok {
+        return
+    }
+    roster := make([]rosterEntry, 0)
+    for i := range all {
+        if all[i].IsInGame && all[i].GameInstance == gameInstance {
+            roster = append(roster, rosterEntry{all[i].PlayerName, presence.InChat(&all[i])})
+        }
+    }
+    c.JSON(http.StatusOK, gin.H{"gameInstance": gameInstance, "players": roster})
+}
+
+func getOnlineCount(c *gin.Context) {
+    all, presence, ok := getPresence(c)
+    if !ok {
+        return
+    }
+    inGame := 0
+    gameInstances := make(map[string]int)
+    for _, session := range all {
+        if session.IsInGame {
+            inGame++
+            gameInstances[session.GameInstance]++
+        }
+    }
+    c.JSON(http.StatusOK, gin.H{"online": inGame, "inChat": presence.Count(), "gameInstances": gameInstances})
+}
+
+func serverRequest(c *gin.Context, req sessions.ServerRequest) {
+    if err := gameServers.Server(c.Request.Context(), req); err != nil {
+        logger.InfoContext(c.Request.Context(), "Game server request failed", "gameInstance", req.GameInstance)
+        abortSessionsError(c, err, http.StatusNotFound)
+        return
+    }
+    c.Status(http.StatusOK)
+}
+
+// Registers or updates, also counts as a heartbeat
+func registerServer(c *gin.Context) {
+    var json sessions.GameServerRequest
+    if err := c.BindJSON(&json); err != nil {
+        logger.InfoContext(c.Request.Context(), "Register server JSON parse failed", "err", err)
+        c.AbortWithStatus(http.StatusBadRequest)
+        return
+    }
+    serverRequest(c, sessions.ServerRequest{Kind: sessions.ServerRegister, GameInstance: c.Param("id"), Info: &json})
+}
+
+func heartbeatServer(c *gin.Context) {
+    serverRequest(c, sessions.ServerRequest{Kind: sessions.ServerHeartbeat, GameInstance: c.Param("id")})
+}
+
+func deregisterServer(c *gin.Context) {
+    serverRequest(c, sessions.ServerRequest{Kind: sessions.ServerDeregister, GameInstance: c.Param("id")})
+}
+
+func listServers(c *gin.Context) {
+    servers, err := gameServers.ListServers(c.Request.Context())
+    if err != nil {
+        abortSessionsError(c, err, http.StatusInternalServerError)
+        return
+    }
+    c.JSON(http.StatusOK, servers)
+}
+
+// For servers verifying tokens offline, to poll
+func listRevokedTokens(c *gin.Context) {
+    revoked, err := sessionsService.ListRevoked(c.Request.Context())
+    if err != nil {
+        abortSessionsError(c, err, http.StatusInternalServerError)
+        return
+    }
+    c.JSON(http.StatusOK, revoked)
+}
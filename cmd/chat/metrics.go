@@ -0,0 +1,52 @@
+package main
+
+import (
+    "context"
+    "time"
+	"github.com/starqi/wi-util-servers/internal/metrics"
+)
+
+// Scrapes must not hang on a stuck aggregator
+const metricsTimeout = time.Second
+
+var sessionsGauge = metrics.Default.Gauge("sessions", "Sessions on this node by state", "state")
+var mutedGauge = metrics.Default.Gauge("sessions_muted", "Sessions currently muted")
+var queueDepthGauge = metrics.Default.Gauge("queue_depth", "Pending items in aggregator and writer queues", "queue")
+
+func collectMetrics() {
+    for queue, depth := range chatService.QueueDepths() {
+        queueDepthGauge.Set(float64(depth), queue)
+    }
+    queueDepthGauge.Set(float64(sessionsDb.QueueDepth()), "sessions_db")
+    if historyDb != nil {
+        queueDepthGauge.Set(float64(historyDb.QueueDepth()), "chat_history_db")
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), metricsTimeout)
+    defer cancel()
+    all, err := sessionsService.List(ctx)
+    if err != nil {
+        logger.Warn("Sessions metrics unavailable", "err", err)
+        return
+    }
+    inGame, muted := 0, 0
+    now := time.Now()
+    for _, session := range all {
+        if session.IsInGame {
+            inGame++
+        }
+        if session.MutedUntil.After(now) {
+            muted++
+        }
+    }
+    sessionsGauge.Set(float64(inGame), "in_game")
+    sessionsGauge.Set(float64(len(all) - inGame), "not_in_game")
+    mutedGauge.Set(float64(muted))
+
+    revoked, err := sessionsService.ListRevoked(ctx)
+    if err != nil {
+        logger.Warn("Sessions metrics unavailable", "err", err)
+        return
+    }
+    sessionsGauge.Set(float64(len(revoked)), "revoked")
+}
@@ -0,0 +1,24 @@
+package reports
+
+import (
+    "encoding/json"
+)
+
+type Report struct {
+    ID int64 `json:"id"`
+    Room string `json:"room"`
+    ReporterSessionID string `json:"reporterSessionId"`
+    ReporterName string `json:"reporterName"`
+    // Empty if the reported player could not be found
+    ReportedSessionID string `json:"reportedSessionId"`
+    ReportedName string `json:"reportedName"`
+    Reason string `json:"reason"`
+    // JSON snapshots of the room's recent messages, and both sessions
+    Messages json.RawMessage `json:"messages"`
+    ReporterSession json.RawMessage `json:"reporterSession"`
+    ReportedSession json.RawMessage `json:"reportedSession"`
+    CreatedAt int64 `json:"createdAt"`
+    Resolved bool `json:"resolved"`
+    Resolution string `json:"resolution"`
+    ResolvedAt int64 `json:"resolvedAt"`
+}
@@ -0,0 +1,133 @@
+package reports
+
+import (
+    "errors"
+    "sort"
+    "sync"
+    "time"
+    "gorm.io/gorm"
+    "gorm.io/driver/sqlite"
+)
+
+const maxListLimit = 200
+
+var ErrNotFound = errors.New("Report not found")
+
+// Stores are thread safe
+type Store interface {
+    Add(report *Report) error
+    // Newest first
+    List(resolved bool, limit int) ([]Report, error)
+    Resolve(id int64, resolution string) error
+    Close() error
+}
+
+func clampLimit(limit int) int {
+    if limit <= 0 || limit > maxListLimit {
+        return maxListLimit
+    }
+    return limit
+}
+
+//////////////////////////////////////////////////
+
+// Lost on restart, for when there is no chat DB
+type MemoryStore struct {
+    mutex sync.Mutex
+    reports []Report
+    lastID int64
+}
+
+func MakeMemoryStore() *MemoryStore {
+    return &MemoryStore { reports: make([]Report, 0) }
+}
+
+func (s *MemoryStore) Close() error {
+    return nil
+}
+
+func (s *MemoryStore) Add(report *Report) error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    s.lastID++
+    report.ID = s.lastID
+    s.reports = append(s.reports, *report)
+    return nil
+}
+
+func (s *MemoryStore) List(resolved bool, limit int) ([]Report, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    limit = clampLimit(limit)
+    result := make([]Report, 0)
+    for i := len(s.reports) - 1; i >= 0 && len(result) < limit; i-- {
+        if s.reports[i].Resolved == resolved {
+            result = append(result, s.reports[i])
+        }
+    }
+    return result, nil
+}
+
+func (s *MemoryStore) Resolve(id int64, resolution string) error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    i := sort.Search(len(s.reports), func (i int) bool { return s.reports[i].ID >= id })
+    if i >= len(s.reports) || s.reports[i].ID != id {
+        return ErrNotFound
+    }
+    s.reports[i].Resolved = true
+    s.reports[i].Resolution = resolution
+    s.reports[i].ResolvedAt = time.Now().Unix()
+    return nil
+}
+
+//////////////////////////////////////////////////
+
+// Shares the chat DB file
+type SqliteStore struct {
+    db *gorm.DB
+}
+
+func MakeSqliteStore(sqliteDbPath string) (*SqliteStore, error) {
+    db, err := gorm.Open(sqlite.Open(sqliteDbPath), &gorm.Config{})
+    if err != nil {
+        return nil, err
+    }
+    return &SqliteStore { db }, nil
+}
+
+func (s *SqliteStore) Close() error {
+    db, err := s.db.DB()
+    if err != nil {
+        return err
+    }
+    return db.Close()
+}
+
+func (s *SqliteStore) Add(report *Report) error {
+    return s.db.Create(report).Error
+}
+
+func (s *SqliteStore) List(resolved bool, limit int) ([]Report, error) {
+    var result []Report
+    err := s.db.Where("resolved = ?", resolved).Order("created_at desc, id desc").Limit(clampLimit(limit)).Find(&result).Error
+    if err != nil {
+        return nil, err
+    }
+    return result, nil
+}
+
+func (s *SqliteStore) Resolve(id int64, resolution string) error {
+    result := s.db.Model(&Report{}).Where("id = ?", id).Updates(map[string]interface{} {
+        "resolved": true,
+        "resolution": resolution,
+        "resolved_at": time.Now().Unix(),
+    })
+    if result.Error != nil {
+        return result.Error
+    }
+    if result.RowsAffected == 0 {
+        return ErrNotFound
+    }
+    return nil
+}
@@ -0,0 +1,67 @@
+package reports
+
+import (
+    "encoding/json"
+    "testing"
+)
+
+var sqliteStore *SqliteStore
+
+func testStore(t *testing.T, s Store) {
+    for _, name := range []string { "Bob", "Jill", "Jack" } {
+        err := s.Add(&Report {
+            Room: "game1",
+            ReporterName: "Harley",
+            ReportedName: name,
+            Reason: "Rude",
+            Messages: json.RawMessage(`[{"playerName":"` + name + `","text":"hi"}]`),
+            ReporterSession: json.RawMessage(`{}`),
+            ReportedSession: json.RawMessage(`null`),
+        })
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    open, err := s.List(false, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(open) != 3 || open[0].ReportedName != "Jack" {
+        t.Fatalf("Expected 3 open reports newest first, got %v", open)
+    }
+
+    if err := s.Resolve(open[1].ID, "Muted"); err != nil {
+        t.Fatal(err)
+    }
+    if err := s.Resolve(9999, "Muted"); err != ErrNotFound {
+        t.Fatalf("Expected not found, got %v", err)
+    }
+
+    open, _ = s.List(false, 0)
+    resolved, _ := s.List(true, 1)
+    if len(open) != 2 || len(resolved) != 1 {
+        t.Fatalf("Expected 2 open and 1 resolved, got %d and %d", len(open), len(resolved))
+    }
+    if resolved[0].ReportedName != "Jill" || resolved[0].Resolution != "Muted" || resolved[0].ResolvedAt == 0 {
+        t.Fatalf("Unexpected resolved report %v", resolved[0])
+    }
+
+    var messages []map[string]string
+    if err := json.Unmarshal(resolved[0].Messages, &messages); err != nil || messages[0]["playerName"] != "Jill" {
+        t.Fatalf("Expected message snapshot to round trip, got %s", string(resolved[0].Messages))
+    }
+}
+
+func TestMemoryStore(t *testing.T) {
+    testStore(t, MakeMemoryStore())
+}
+
+func TestSqliteStore(t *testing.T) {
+    testStore(t, sqliteStore)
+}
+
+func TestMain(m *testing.M) {
+    sqliteStore = RemakeTestDb()
+    m.Run()
+}
@@ -0,0 +1,151 @@
+package sessions
+
+import (
+    "strings"
+    "time"
+)
+
+//////////////////////////////////////////////////
+// Synchronous methods
+
+func (s *Sessions) moderate(req *ModerateRequest) bool {
+    switch req.Kind {
+    case ModerateMute:
+        found := s.lookup(req.Token)
+        if found == nil {
+            return false
+        }
+        if req.Duration <= 0 {
+            found.MutedUntil = time.Time{}
+        } else {
+            found.MutedUntil = time.Now().Add(req.Duration)
+        }
+        s.db.saveSession(found)
+        logger.Info("Muted", "session", found)
+        s.replicateSession(SessionMuted, found)
+        s.publish(SessionMuted, found)
+        return true
+    case ModerateBanToken:
+        // The session may have already expired, but its ID is still known from the token
+        claims, err := s.signer.Parse(req.Token)
+        if err != nil {
+            return false
+        }
+        ban := &Ban { SessionID: claims.SessionID, Until: banUntil(req.Duration) }
+        s.applyBan(ban)
+        s.replicate(replicaEvent { Kind: replicaBan, Ban: ban })
+        return true
+    case ModerateBanPlayer:
+        if req.PlayerName == "" {
+            return false
+        }
+        ban := &Ban { PlayerName: req.PlayerName, Until: banUntil(req.Duration) }
+        s.applyBan(ban)
+        s.replicate(replicaEvent { Kind: replicaBan, Ban: ban })
+        return true
+    case ModerateUnbanToken:
+        claims, err := s.signer.Parse(req.Token)
+        if err != nil {
+            return false
+        }
+        found := s.applyUnban(claims.SessionID, "")
+        s.replicate(replicaEvent { Kind: replicaUnban, Ban: &Ban { SessionID: claims.SessionID } })
+        return found
+    case ModerateUnbanPlayer:
+        found := s.applyUnban("", strings.ToLower(req.PlayerName))
+        s.replicate(replicaEvent { Kind: replicaUnban, Ban: &Ban { PlayerName: req.PlayerName } })
+        return found
+    default:
+        return false
+    }
+}
+
+// Exactly one of session ID or player name is set
+func (s *Sessions) applyBan(ban *Ban) {
+    s.db.saveBan(ban)
+    if ban.SessionID != "" {
+        s.bannedSessions[ban.SessionID] = ban
+        logger.Info("Banned session", "sessionId", ban.SessionID, "until", ban.Until)
+        if found := s.byID[ban.SessionID]; found != nil {
+            s.publish(SessionBanned, found)
+        }
+        return
+    }
+    name := strings.ToLower(ban.PlayerName)
+    s.bannedPlayers[name] = ban
+    logger.Info("Banned player", "playerName", ban.PlayerName, "until", ban.Until)
+    for _, session := range s.byID {
+        if strings.ToLower(session.PlayerName) == name {
+            s.publish(SessionBanned, session)
+        }
+    }
+}
+
+// Exactly one of session ID or lower case player name is set, returns false if there was no ban
+func (s *Sessions) applyUnban(sessionID string, playerKey string) bool {
+    s.db.deleteBan(sessionID, playerKey)
+    if sessionID != "" {
+        _, found := s.bannedSessions[sessionID]
+        delete(s.bannedSessions, sessionID)
+        return found
+    }
+    _, found := s.bannedPlayers[playerKey]
+    delete(s.bannedPlayers, playerKey)
+    return found
+}
+
+func banUntil(duration time.Duration) time.Time {
+    if duration <= 0 {
+        return time.Time{}
+    }
+    return time.Now().Add(duration)
+}
+
+func isBanActive(ban *Ban, now time.Time) bool {
+    return ban != nil && (ban.Until.IsZero() || now.Before(ban.Until))
+}
+
+func (s *Sessions) listBans() []Ban {
+    result := make([]Ban, 0, len(s.bannedSessions) + len(s.bannedPlayers))
+    for _, ban := range s.bannedSessions {
+        result = append(result, *ban)
+    }
+    for _, ban := range s.bannedPlayers {
+        result = append(result, *ban)
+    }
+    return result
+}
+
+func (s *Sessions) chatCheck(signed string) *ChatCheck {
+    return s.chatCheckSession(s.lookup(signed))
+}
+
+// For clients already authenticated, whose token may since have been replaced
+func (s *Sessions) chatCheckByID(id string) *ChatCheck {
+    return s.chatCheckSession(s.byID[id])
+}
+
+func (s *Sessions) chatCheckSession(found *Session) *ChatCheck {
+    if found == nil {
+        return &ChatCheck{}
+    }
+    sessionCopy := *found
+    now := time.Now()
+    banned := isBanActive(s.bannedSessions[sessionCopy.ID], now) ||
+        isBanActive(s.bannedPlayers[strings.ToLower(sessionCopy.PlayerName)], now)
+    return &ChatCheck { Session: &sessionCopy, Banned: banned }
+}
+
+func (s *Sessions) cleanUpExpiredBans() {
+    now := time.Now()
+    for k, v := range s.bannedSessions {
+        if !isBanActive(v, now) {
+            delete(s.bannedSessions, k)
+        }
+    }
+    for k, v := range s.bannedPlayers {
+        if !isBanActive(v, now) {
+            delete(s.bannedPlayers, k)
+        }
+    }
+}
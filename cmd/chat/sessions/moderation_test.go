@@ -0,0 +1,57 @@
+package sessions
+
+import (
+    "testing"
+    "time"
+)
+
+func TestBanAndMute(t *testing.T) {
+    s := makeTestSessions()
+    events := MakeSubscription()
+    s.subscribers = append(s.subscribers, events)
+
+    token, _ := s.request()
+    name := "Bob"
+    token, _ = s.patchFromJson(token, &PatchSessionRequest{PlayerName: &name})
+    nextEvent(t, events)
+
+    if check := s.chatCheck(token); check.Session == nil || check.Banned {
+        t.Fatal("Expected session to be able to chat")
+    }
+    if check := s.chatCheck("missing"); check.Session != nil {
+        t.Fatal("Expected missing session")
+    }
+
+    s.moderate(&ModerateRequest{Kind: ModerateMute, Token: token, Duration: time.Minute})
+    if event := nextEvent(t, events); event.Kind != SessionMuted || !event.Session.MutedUntil.After(time.Now()) {
+        t.Fatalf("Expected mute event, got %v", event)
+    }
+
+    // Player name bans are case insensitive
+    s.moderate(&ModerateRequest{Kind: ModerateBanPlayer, PlayerName: "BOB"})
+    if event := nextEvent(t, events); event.Kind != SessionBanned {
+        t.Fatalf("Expected ban event, got %v", event)
+    }
+    if check := s.chatCheck(token); !check.Banned {
+        t.Fatal("Expected banned")
+    }
+    if bans := s.listBans(); len(bans) != 1 {
+        t.Fatalf("Expected 1 ban, got %d", len(bans))
+    }
+
+    s.moderate(&ModerateRequest{Kind: ModerateUnbanPlayer, PlayerName: "bob"})
+    if check := s.chatCheck(token); check.Banned {
+        t.Fatal("Expected unbanned")
+    }
+
+    s.moderate(&ModerateRequest{Kind: ModerateBanToken, Token: token, Duration: time.Millisecond})
+    nextEvent(t, events)
+    time.Sleep(2 * time.Millisecond)
+    if check := s.chatCheck(token); check.Banned {
+        t.Fatal("Expected temporary ban to have expired")
+    }
+    s.cleanUpExpiredBans()
+    if bans := s.listBans(); len(bans) != 0 {
+        t.Fatalf("Expected expired ban to be cleaned up, got %d", len(bans))
+    }
+}
@@ -0,0 +1,300 @@
+package sessions
+
+import (
+    "context"
+    "strings"
+    "time"
+    "gorm.io/gorm"
+    "gorm.io/gorm/clause"
+    "gorm.io/driver/sqlite"
+	"github.com/starqi/wi-util-servers/internal/deadline"
+	"github.com/starqi/wi-util-servers/internal/metrics"
+)
+
+// Pending session writes beyond this are dropped, so that a slow disk never blocks the sessions aggregator.
+// Revocations and bans are written synchronously instead, see `queueOrWrite`.
+const persistQueueSize = 10000
+const persistInterval = time.Second
+// How long revocations and bans wait for room in the queue, keeping their order, before writing out of order
+const persistWaitTimeout = time.Second
+
+// Only the claims, since the token is a bearer credential, see `Sessions.restore`
+type storedSession struct {
+    ID string `gorm:"primaryKey"`
+    IsInGame bool
+    GameInstance string
+    PlayerName string
+    Expiry int64
+    MutedUntil int64
+    MaxExpiry int64
+    IssuedAt int64
+    Version int64
+}
+
+func (storedSession) TableName() string { return "sessions" }
+
+type storedRevocation struct {
+    ID string `gorm:"primaryKey"`
+    Expiry int64
+}
+
+func (storedRevocation) TableName() string { return "session_revocations" }
+
+type storedBan struct {
+    SessionID string `gorm:"primaryKey"`
+    PlayerKey string `gorm:"primaryKey"`
+    PlayerName string
+    Until int64
+}
+
+func (storedBan) TableName() string { return "session_bans" }
+
+type persistOp func (tx *gorm.DB) error
+
+var droppedWrites = metrics.Default.Counter("sessions_db_dropped_writes_total", "Session writes dropped while the write queue was full")
+
+// Write-behind store for sessions, revocations and bans, so restarts don't log players out.
+// Game servers are not stored, since they re-register on their next heartbeat failure.
+type SessionsDb struct {
+    db *gorm.DB
+    writes chan persistOp
+    flushChan chan chan bool
+}
+
+// Shares the chat DB file, starts the background writer
+func MakeSessionsDb(sqliteDbPath string) (*SessionsDb, error) {
+    p, err := openSessionsDb(sqliteDbPath)
+    if err != nil {
+        return nil, err
+    }
+    go p.writer()
+    return p, nil
+}
+
+func openSessionsDb(sqliteDbPath string) (*SessionsDb, error) {
+    db, err := gorm.Open(sqlite.Open(sqliteDbPath), &gorm.Config{})
+    if err != nil {
+        return nil, err
+    }
+    return &SessionsDb { db, make(chan persistOp, persistQueueSize), make(chan chan bool) }, nil
+}
+
+// Non-blocking, safe to call from the sessions aggregator.
+// No-op on a nil receiver, for when sessions are not persisted.
+func (p *SessionsDb) queue(op persistOp) {
+    if p == nil {
+        return
+    }
+    select {
+    case p.writes <- op:
+    default:
+        droppedWrites.Inc()
+        logger.Warn("Sessions write queue full, dropping write")
+    }
+}
+
+// Like `queue`, but blocks the aggregator rather than drop, for writes that must survive a restart.
+// Waits for room first, then writes now, possibly before writes still queued, see `load`.
+func (p *SessionsDb) queueOrWrite(op persistOp) {
+    if p == nil {
+        return
+    }
+    select {
+    case p.writes <- op:
+        return
+    default:
+    }
+    timer := time.NewTimer(persistWaitTimeout)
+    defer timer.Stop()
+    select {
+    case p.writes <- op:
+    case <-timer.C:
+        logger.Warn("Sessions write queue full, writing now")
+        p.writeBatch([]persistOp{op})
+    }
+}
+
+// Pending writes, for metrics
+func (p *SessionsDb) QueueDepth() int {
+    if p == nil {
+        return 0
+    }
+    return len(p.writes)
+}
+
+func (p *SessionsDb) writer() {
+    ticker := time.NewTicker(persistInterval)
+    defer ticker.Stop()
+    batch := make([]persistOp, 0)
+    for {
+        select {
+        case op := <-p.writes:
+            batch = append(batch, op)
+        case <-ticker.C:
+            batch = p.writeBatch(batch)
+        case cb := <-p.flushChan:
+            for len(p.writes) > 0 {
+                batch = append(batch, <-p.writes)
+            }
+            p.writeBatch(batch)
+            cb <- true
+            close(cb)
+            return
+        }
+    }
+}
+
+// Writes everything queued so far and stops the writer, then closes the DB.
+// Should be called after the sessions service is closed, since later writes are dropped.
+func (p *SessionsDb) Close(ctx context.Context) error {
+    if p == nil {
+        return nil
+    }
+    cb := make(chan bool, 1)
+    if _, err := deadline.Call(ctx, p.flushChan, cb, cb); err != nil {
+        return err
+    }
+    db, err := p.db.DB()
+    if err != nil {
+        return err
+    }
+    return db.Close()
+}
+
+// Returns the emptied batch for reuse
+func (p *SessionsDb) writeBatch(batch []persistOp) []persistOp {
+    if len(batch) == 0 {
+        return batch
+    }
+    err := p.db.Transaction(func (tx *gorm.DB) error {
+        for _, op := range batch {
+            if err := op(tx); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        logger.Error("Failed to write session changes", "count", len(batch), "err", err)
+    }
+    return batch[:0]
+}
+
+//////////////////////////////////////////////////
+// Queued from the aggregator, values are copied so the aggregator can keep mutating
+
+func (p *SessionsDb) saveSession(session *Session) {
+    row := storedSession {
+        session.ID,
+        session.IsInGame,
+        session.GameInstance,
+        session.PlayerName,
+        session.Expiry.Unix(),
+        unixOrZero(session.MutedUntil),
+        unixOrZero(session.MaxExpiry),
+        session.IssuedAt.Unix(),
+        session.Version,
+    }
+    p.queue(func (tx *gorm.DB) error {
+        return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&row).Error
+    })
+}
+
+func (p *SessionsDb) revokeSession(id string, expiry int64) {
+    row := storedRevocation { id, expiry }
+    p.queueOrWrite(func (tx *gorm.DB) error {
+        if err := tx.Delete(&storedSession{}, "id = ?", id).Error; err != nil {
+            return err
+        }
+        return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&row).Error
+    })
+}
+
+func (p *SessionsDb) saveBan(ban *Ban) {
+    row := storedBan { ban.SessionID, strings.ToLower(ban.PlayerName), ban.PlayerName, unixOrZero(ban.Until) }
+    p.queueOrWrite(func (tx *gorm.DB) error {
+        return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&row).Error
+    })
+}
+
+// Either argument is empty
+func (p *SessionsDb) deleteBan(sessionID string, playerKey string) {
+    p.queueOrWrite(func (tx *gorm.DB) error {
+        return tx.Delete(&storedBan{}, "session_id = ? and player_key = ?", sessionID, playerKey).Error
+    })
+}
+
+// Mirrors the aggregator's clean up tick
+func (p *SessionsDb) deleteExpired(now time.Time) {
+    p.queue(func (tx *gorm.DB) error {
+        if err := tx.Delete(&storedSession{}, "expiry <= ?", now.Unix()).Error; err != nil {
+            return err
+        }
+        if err := tx.Delete(&storedRevocation{}, "expiry <= ?", now.Unix()).Error; err != nil {
+            return err
+        }
+        return tx.Delete(&storedBan{}, "until > 0 and until <= ?", now.Unix()).Error
+    })
+}
+
+//////////////////////////////////////////////////
+
+// Everything still live at `now`, expiry is re-evaluated since the server may have been down for a while
+func (p *SessionsDb) load(now time.Time) ([]Session, map[string]int64, []Ban, error) {
+    var sessionRows []storedSession
+    if err := p.db.Where("expiry > ?", now.Unix()).Find(&sessionRows).Error; err != nil {
+        return nil, nil, nil, err
+    }
+    var revocationRows []storedRevocation
+    if err := p.db.Where("expiry > ?", now.Unix()).Find(&revocationRows).Error; err != nil {
+        return nil, nil, nil, err
+    }
+    var banRows []storedBan
+    if err := p.db.Where("until = 0 or until > ?", now.Unix()).Find(&banRows).Error; err != nil {
+        return nil, nil, nil, err
+    }
+
+    revoked := make(map[string]int64, len(revocationRows))
+    for _, row := range revocationRows {
+        revoked[row.ID] = row.Expiry
+    }
+    sessions := make([]Session, 0, len(sessionRows))
+    for _, row := range sessionRows {
+        // A revocation may have been written before the session's last queued save
+        if _, found := revoked[row.ID]; found {
+            continue
+        }
+        // Token is re-signed by the sessions service
+        sessions = append(sessions, Session {
+            row.ID,
+            "",
+            row.IsInGame,
+            row.GameInstance,
+            row.PlayerName,
+            time.Unix(row.Expiry, 0),
+            timeOrZero(row.MutedUntil),
+            timeOrZero(row.MaxExpiry),
+            time.Unix(row.IssuedAt, 0),
+            row.Version,
+        })
+    }
+    bans := make([]Ban, 0, len(banRows))
+    for _, row := range banRows {
+        bans = append(bans, Ban { row.SessionID, row.PlayerName, timeOrZero(row.Until) })
+    }
+    return sessions, revoked, bans, nil
+}
+
+func unixOrZero(t time.Time) int64 {
+    if t.IsZero() {
+        return 0
+    }
+    return t.Unix()
+}
+
+func timeOrZero(unix int64) time.Time {
+    if unix == 0 {
+        return time.Time{}
+    }
+    return time.Unix(unix, 0)
+}
@@ -0,0 +1,133 @@
+package sessions
+
+import (
+    "context"
+    "testing"
+    "time"
+)
+
+// Writes whatever is queued, in place of the background writer
+func drain(p *SessionsDb) {
+    batch := make([]persistOp, 0)
+    for {
+        select {
+        case op := <-p.writes:
+            batch = append(batch, op)
+        default:
+            p.writeBatch(batch)
+            return
+        }
+    }
+}
+
+func TestRestoreAfterRestart(t *testing.T) {
+    db := RemakeTestDb()
+    s := MakeSessions(testSigner, DefaultLifetimes(), db, nil)
+
+    token, _ := s.request()
+    name := "Bob"
+    inGame := true
+    token, _ = s.patchFromJson(token, &PatchSessionRequest{PlayerName: &name, IsInGame: &inGame})
+    s.moderate(&ModerateRequest{Kind: ModerateMute, Token: token, Duration: time.Hour})
+    s.moderate(&ModerateRequest{Kind: ModerateBanPlayer, PlayerName: "Alice"})
+    s.moderate(&ModerateRequest{Kind: ModerateBanPlayer, PlayerName: "Carol"})
+    s.moderate(&ModerateRequest{Kind: ModerateUnbanPlayer, PlayerName: "carol"})
+
+    revokedToken, _ := s.request()
+    s.revoke(revokedToken)
+
+    // Already expired by the time of the restart
+    expiredToken, _ := s.request()
+    s.lookup(expiredToken).Expiry = time.Now().Add(-time.Second)
+    s.db.saveSession(s.lookup(expiredToken))
+
+    drain(db)
+    var stored int64
+    db.db.Table("sessions").Where("issued_at > 0").Count(&stored)
+    if stored == 0 {
+        t.Fatal("Expected the stored claims")
+    }
+
+    restarted := MakeSessions(testSigner, DefaultLifetimes(), db, nil)
+    session, found := restarted.findAndCopy(token)
+    if !found || session.PlayerName != "Bob" || !session.IsInGame || session.Token != token {
+        t.Fatalf("Expected restored session, got %v", session)
+    }
+    if !session.MutedUntil.After(time.Now()) {
+        t.Fatal("Expected mute to be restored")
+    }
+    if restarted.lookup(revokedToken) != nil || len(restarted.listRevoked()) != 1 {
+        t.Fatal("Expected revocation to be restored")
+    }
+    if restarted.lookup(expiredToken) != nil {
+        t.Fatal("Expected expired session to be dropped")
+    }
+    if bans := restarted.listBans(); len(bans) != 1 || bans[0].PlayerName != "Alice" || !bans[0].Until.IsZero() {
+        t.Fatalf("Expected permanent ban to be restored, got %v", bans)
+    }
+}
+
+func TestCloseFlushesWrites(t *testing.T) {
+    db := RemakeTestDb()
+    go db.writer()
+    s := MakeSessions(testSigner, DefaultLifetimes(), db, nil)
+    ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+    defer cancel()
+
+    token, err := s.Create(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // Well before the writer's next tick
+    if err := s.Close(ctx); err != nil {
+        t.Fatal(err)
+    }
+    if err := db.Close(ctx); err != nil {
+        t.Fatal(err)
+    }
+
+    reopened, err := openSessionsDb(testDbPath)
+    if err != nil {
+        t.Fatal(err)
+    }
+    sessions, _, _, err := reopened.load(time.Now())
+    if err != nil {
+        t.Fatal(err)
+    }
+    claims, _ := testSigner.Parse(token)
+    if len(sessions) != 1 || sessions[0].ID != claims.SessionID || sessions[0].Version != claims.Version {
+        t.Fatalf("Expected the queued session to be written on close, got %v", sessions)
+    }
+
+    // Stopped, so calls only return on their own deadline
+    expired, cancelExpired := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+    defer cancelExpired()
+    if _, err := s.Create(expired); err != context.DeadlineExceeded {
+        t.Fatal("Expected calls after close to time out, got ", err)
+    }
+}
+
+func TestRevocationsSurviveFullQueue(t *testing.T) {
+    full := RemakeTestDb()
+    db := &SessionsDb { full.db, make(chan persistOp, 1), make(chan chan bool) }
+    s := MakeSessions(testSigner, DefaultLifetimes(), db, nil)
+
+    // Without a writer, the request's save fills the queue and the patch's is dropped
+    token, _ := s.request()
+    name := "Bob"
+    token, _ = s.patchFromJson(token, &PatchSessionRequest{PlayerName: &name})
+    if !s.revoke(token) {
+        t.Fatal("Expected revoke to succeed")
+    }
+
+    // Written out of order, before the queued saves
+    _, revoked, _, err := db.load(time.Now())
+    if err != nil || len(revoked) != 1 {
+        t.Fatalf("Expected the revocation to be written despite the full queue, got %v %v", revoked, err)
+    }
+    drain(db)
+    sessions, _, _, err := db.load(time.Now())
+    if err != nil || len(sessions) != 0 {
+        t.Fatalf("Expected the revoked session not to be restored, got %v %v", sessions, err)
+    }
+}
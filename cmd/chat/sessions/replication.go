@@ -0,0 +1,144 @@
+package sessions
+
+import (
+    "encoding/json"
+    "strings"
+    "time"
+	"github.com/starqi/wi-util-servers/internal/token"
+)
+
+// Every change is broadcast to the other nodes, which apply it to their own maps and persistence,
+// and publish the usual session events so their chat kicks and moves their own clients.
+// Last write wins, expiry is evaluated by each node on its own tick.
+
+const sessionsTopic = "sessions"
+
+const (
+    replicaUpsert = iota
+    // Session ID and expiry only
+    replicaRevoke = iota
+    replicaBan = iota
+    replicaUnban = iota
+    // Asks every other node to send everything, for nodes starting up
+    replicaSync = iota
+)
+
+// For upserts which other nodes don't need to react to
+const noSessionEvent = -1
+
+type replicaEvent struct {
+    Node string `json:"node"`
+    Kind int `json:"kind"`
+    // Upserts only, published to local subscribers on the receiving node
+    SessionEvent int `json:"sessionEvent"`
+    Session *Session `json:"session,omitempty"`
+    Ban *Ban `json:"ban,omitempty"`
+}
+
+// Aggregator only, no-op if not replicated
+func (s *Sessions) replicate(event replicaEvent) {
+    if s.broker == nil {
+        return
+    }
+    event.Node = s.node
+    payload, err := json.Marshal(&event)
+    if err != nil {
+        logger.Error("Unexpected replica marshal error", "err", err)
+        return
+    }
+    s.broker.Publish(sessionsTopic, payload)
+}
+
+func (s *Sessions) replicateSession(sessionEvent int, session *Session) {
+    s.replicate(replicaEvent { Kind: replicaUpsert, SessionEvent: sessionEvent, Session: session })
+}
+
+func (s *Sessions) onReplica(payload []byte) {
+    var event replicaEvent
+    if err := json.Unmarshal(payload, &event); err != nil {
+        logger.Warn("Replica JSON parse failed", "err", err)
+        return
+    }
+    if event.Node == s.node {
+        return
+    }
+
+    switch event.Kind {
+    case replicaUpsert:
+        if event.Session == nil {
+            return
+        }
+        if _, revoked := s.revoked[event.Session.ID]; revoked {
+            return
+        }
+        // Replicas may arrive after a newer token was already adopted
+        if existing := s.byID[event.Session.ID]; existing != nil && existing.Version > event.Session.Version {
+            return
+        }
+        session := *event.Session
+        s.byID[session.ID] = &session
+        s.db.saveSession(&session)
+        if event.SessionEvent != noSessionEvent {
+            s.publish(event.SessionEvent, &session)
+        }
+    case replicaRevoke:
+        if event.Session == nil {
+            return
+        }
+        s.applyRevoke(event.Session.ID, event.Session.Expiry.Unix())
+    case replicaBan:
+        if event.Ban != nil {
+            s.applyBan(event.Ban)
+        }
+    case replicaUnban:
+        if event.Ban != nil {
+            s.applyUnban(event.Ban.SessionID, strings.ToLower(event.Ban.PlayerName))
+        }
+    case replicaSync:
+        s.sendSync()
+    }
+}
+
+func (s *Sessions) sendSync() {
+    for _, session := range s.byID {
+        s.replicateSession(noSessionEvent, session)
+    }
+    for id, expiry := range s.revoked {
+        s.replicate(replicaEvent { Kind: replicaRevoke, Session: &Session { ID: id, Expiry: time.Unix(expiry, 0) } })
+    }
+    for _, ban := range s.bannedSessions {
+        s.replicate(replicaEvent { Kind: replicaBan, Ban: ban })
+    }
+    for _, ban := range s.bannedPlayers {
+        s.replicate(replicaEvent { Kind: replicaBan, Ban: ban })
+    }
+}
+
+// A valid token from another node may arrive before its replica does, or after this node missed it,
+// so it is trusted as long as it has not expired or been revoked.
+// The maximum expiry comes from the token, so moving between nodes never extends it.
+func (s *Sessions) adopt(claims *token.Claims, signed string) *Session {
+    now := time.Now()
+    if _, revoked := s.revoked[claims.SessionID]; revoked || now.Unix() >= claims.Expiry {
+        return nil
+    }
+    session := &Session {
+        ID: claims.SessionID,
+        Token: signed,
+        IsInGame: claims.IsInGame,
+        GameInstance: claims.GameInstance,
+        PlayerName: claims.PlayerName,
+        Expiry: time.Unix(claims.Expiry, 0),
+        MaxExpiry: timeOrZero(claims.MaxExpiry),
+        IssuedAt: time.Unix(claims.IssuedAt, 0),
+        Version: claims.Version,
+    }
+    // Tokens signed before the claim existed
+    if s.lifetimes.Max > 0 && claims.MaxExpiry == 0 {
+        session.MaxExpiry = now.Add(s.lifetimes.Max)
+    }
+    logger.Info("Adopted session from token", "session", session)
+    s.byID[session.ID] = session
+    s.db.saveSession(session)
+    return session
+}
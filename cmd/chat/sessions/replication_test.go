@@ -0,0 +1,94 @@
+package sessions
+
+import (
+    "context"
+    "testing"
+    "time"
+	"github.com/starqi/wi-util-servers/internal/broker"
+	"github.com/starqi/wi-util-servers/internal/token"
+)
+
+func find(s *Sessions, signed string) *Session {
+    session, _ := s.Get(context.Background(), signed)
+    return session
+}
+
+func bans(s *Sessions) []Ban {
+    result, _ := s.ListBans(context.Background())
+    return result
+}
+
+// Replicas are applied asynchronously
+func eventually(t *testing.T, what string, condition func () bool) {
+    deadline := time.Now().Add(2 * time.Second)
+    for !condition() {
+        if time.Now().After(deadline) {
+            t.Fatal("Timed out waiting for ", what)
+        }
+        time.Sleep(5 * time.Millisecond)
+    }
+}
+
+func TestReplicationBetweenNodes(t *testing.T) {
+    b := broker.MakeMemoryBroker()
+    nodeA := MakeSessions(testSigner, DefaultLifetimes(), nil, b)
+    nodeB := MakeSessions(testSigner, DefaultLifetimes(), nil, b)
+    events := MakeSubscription()
+    ctx := context.Background()
+    nodeB.Subscribe(ctx, events)
+
+    original, _ := nodeA.Create(ctx)
+
+    // Known to the other node straight from the token, before or without the replica
+    if session := find(nodeB, original); session == nil {
+        t.Fatal("Expected the other node to accept the token")
+    }
+
+    name := "Bob"
+    patched, _ := nodeA.Patch(ctx, original, &PatchSessionRequest{PlayerName: &name})
+    eventually(t, "patch", func () bool {
+        session := find(nodeB, patched)
+        return session != nil && session.PlayerName == "Bob" && session.Token == patched
+    })
+    if find(nodeB, original) != nil {
+        t.Fatal("Expected the pre-patch token to be rejected on the other node")
+    }
+    if event := nextEvent(t, events); event.Kind != SessionPatched {
+        t.Fatalf("Expected patch event on the other node, got %v", event)
+    }
+
+    nodeA.Moderate(ctx, ModerateRequest{Kind: ModerateBanPlayer, PlayerName: "Bob"})
+    eventually(t, "ban", func () bool { return len(bans(nodeB)) == 1 })
+
+    nodeA.Revoke(ctx, patched)
+    eventually(t, "revoke", func () bool { return find(nodeB, patched) == nil })
+
+    // New nodes ask for everything
+    nodeC := MakeSessions(testSigner, DefaultLifetimes(), nil, b)
+    eventually(t, "sync", func () bool { return len(bans(nodeC)) == 1 })
+    if find(nodeC, patched) != nil {
+        t.Fatal("Expected revoked token to be rejected on a new node")
+    }
+}
+
+func TestAdoptKeepsMaxExpiry(t *testing.T) {
+    nodeB := MakeSessions(testSigner, DefaultLifetimes(), nil, broker.MakeMemoryBroker())
+    maxExpiry := time.Now().Add(time.Minute).Unix()
+    signed, _ := testSigner.Sign(&token.Claims {
+        SessionID: "s1",
+        IssuedAt: time.Now().Unix(),
+        Expiry: time.Now().Add(30 * time.Second).Unix(),
+        MaxExpiry: maxExpiry,
+    })
+
+    // Bouncing between nodes must not restart the maximum lifetime
+    session := find(nodeB, signed)
+    if session == nil || session.MaxExpiry.Unix() != maxExpiry {
+        t.Fatalf("Expected the token's maximum expiry, got %v", session)
+    }
+    refreshed, _ := nodeB.Refresh(context.Background(), signed)
+    claims, _ := testSigner.Parse(refreshed)
+    if claims.MaxExpiry != maxExpiry || claims.Expiry > maxExpiry {
+        t.Fatalf("Expected refresh to be capped by the token's maximum expiry, got %v", claims)
+    }
+}
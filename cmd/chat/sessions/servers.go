@@ -0,0 +1,85 @@
+package sessions
+
+import (
+    "sort"
+    "time"
+)
+
+// Game servers must heartbeat more often than this, like sessions
+var serverLifetimeFromHeartbeat = time.Minute
+
+//////////////////////////////////////////////////
+// Synchronous methods
+
+func (s *Sessions) server(req *ServerRequest) bool {
+    switch req.Kind {
+    case ServerRegister:
+        if req.GameInstance == "" || req.Info == nil {
+            return false
+        }
+        server, found := s.servers[req.GameInstance]
+        if !found {
+            server = &GameServer { GameInstance: req.GameInstance }
+            s.servers[req.GameInstance] = server
+            logger.Info("Registered game server", "gameInstance", req.GameInstance)
+        }
+        server.Address = req.Info.Address
+        server.Region = req.Info.Region
+        server.Mode = req.Info.Mode
+        server.Map = req.Info.Map
+        server.Capacity = req.Info.Capacity
+        server.Expiry = time.Now().Add(serverLifetimeFromHeartbeat)
+        return true
+    case ServerHeartbeat:
+        server, found := s.servers[req.GameInstance]
+        if !found {
+            return false
+        }
+        server.Expiry = time.Now().Add(serverLifetimeFromHeartbeat)
+        return true
+    case ServerDeregister:
+        _, found := s.servers[req.GameInstance]
+        delete(s.servers, req.GameInstance)
+        if found {
+            logger.Info("Deregistered game server", "gameInstance", req.GameInstance)
+        }
+        return found
+    default:
+        return false
+    }
+}
+
+// Player counts are sessions in game on each server
+func (s *Sessions) listServers() []GameServerAsJson {
+    players := make(map[string]int)
+    for _, session := range s.byID {
+        if session.IsInGame {
+            players[session.GameInstance]++
+        }
+    }
+
+    result := make([]GameServerAsJson, 0, len(s.servers))
+    for _, server := range s.servers {
+        result = append(result, GameServerAsJson {
+            server.GameInstance,
+            server.Address,
+            server.Region,
+            server.Mode,
+            server.Map,
+            server.Capacity,
+            players[server.GameInstance],
+        })
+    }
+    sort.Slice(result, func (i, j int) bool { return result[i].GameInstance < result[j].GameInstance })
+    return result
+}
+
+func (s *Sessions) cleanUpExpiredServers() {
+    now := time.Now()
+    for k, v := range s.servers {
+        if now.Compare(v.Expiry) >= 0 {
+            logger.Info("Game server heartbeat timed out", "gameInstance", k)
+            delete(s.servers, k)
+        }
+    }
+}
@@ -0,0 +1,46 @@
+package sessions
+
+import (
+    "testing"
+    "time"
+)
+
+func TestServerRegistryPlayerCountsAndExpiry(t *testing.T) {
+    s := makeTestSessions()
+    info := &GameServerRequest { Address: "1.2.3.4:5000", Region: "us", Mode: "ctf", Map: "desert", Capacity: 16 }
+
+    if s.server(&ServerRequest{Kind: ServerHeartbeat, GameInstance: "a"}) {
+        t.Fatal("Expected heartbeat for unregistered server to fail")
+    }
+    s.server(&ServerRequest{Kind: ServerRegister, GameInstance: "a", Info: info})
+    s.server(&ServerRequest{Kind: ServerRegister, GameInstance: "b", Info: info})
+
+    isInGame := true
+    gameInstance := "a"
+    for i := 0; i < 2; i++ {
+        token, _ := s.request()
+        s.patchFromJson(token, &PatchSessionRequest{IsInGame: &isInGame, GameInstance: &gameInstance})
+    }
+    // Not in game yet
+    s.request()
+
+    servers := s.listServers()
+    if len(servers) != 2 || servers[0].Players != 2 || servers[1].Players != 0 {
+        t.Fatalf("Expected 2 players on a and none on b, got %v", servers)
+    }
+    if servers[0].Map != "desert" || servers[0].Capacity != 16 {
+        t.Fatalf("Unexpected server info %v", servers[0])
+    }
+
+    s.servers["b"].Expiry = time.Now().Add(-time.Second)
+    s.cleanUpExpiredServers()
+    if !s.server(&ServerRequest{Kind: ServerHeartbeat, GameInstance: "a"}) {
+        t.Fatal("Expected heartbeat to succeed")
+    }
+    if s.server(&ServerRequest{Kind: ServerDeregister, GameInstance: "b"}) {
+        t.Fatal("Expected b to have expired already")
+    }
+    if servers := s.listServers(); len(servers) != 1 || servers[0].GameInstance != "a" {
+        t.Fatalf("Expected only a, got %v", servers)
+    }
+}
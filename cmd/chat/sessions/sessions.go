@@ -1,16 +1,33 @@
 package sessions
 
 import (
-	"log"
     "fmt"
+    "log/slog"
+    "strings"
 	"time"
 	"github.com/google/uuid"
+	"github.com/starqi/wi-util-servers/internal/broker"
+	"github.com/starqi/wi-util-servers/internal/logging"
+	"github.com/starqi/wi-util-servers/internal/token"
 )
 
+var logger = logging.For("sessions")
+
+// Never includes the token
+func (s *Session) LogValue() slog.Value {
+    return slog.GroupValue(
+        slog.String("id", s.ID),
+        slog.String("gameInstance", s.GameInstance),
+        slog.String("playerName", s.PlayerName),
+        slog.Bool("isInGame", s.IsInGame),
+        slog.Int64("expiry", s.Expiry.Unix()),
+    )
+}
+
 func (s *Session) String() string {
     return fmt.Sprintf(
-        "Token=%s, Game Instance=%s, Player Name=%s, Is In Game=%t, Expiry=%d",
-        s.Token,
+        "ID=%s, Game Instance=%s, Player Name=%s, Is In Game=%t, Expiry=%d",
+        s.ID,
         s.GameInstance,
         s.PlayerName,
         s.IsInGame,
@@ -20,47 +37,157 @@ func (s *Session) String() string {
 
 func SessionToJson(s *Session) SessionAsJson {
     if s == nil {
-        log.Print("Unexpected null session pointer, returning garbage")
+        logger.Error("Unexpected null session pointer, returning garbage")
         return SessionAsJson{}
     }
     return SessionAsJson{
+        s.ID,
         s.Token,
         s.GameInstance,
         s.IsInGame,
         s.PlayerName,
+        mutedUntilToJson(s.MutedUntil),
+        s.Expiry.Unix(),
+        secondsUntil(s.Expiry),
+        secondsUntil(s.MaxExpiry),
+    }
+}
+
+func secondsUntil(t time.Time) int64 {
+    if t.IsZero() {
+        return 0
+    }
+    remaining := time.Until(t)
+    if remaining <= 0 {
+        return 0
+    }
+    return int64(remaining.Seconds())
+}
+
+// Extends the expiry without passing the maximum
+func extendedExpiry(s *Session, lifetime time.Duration) time.Time {
+    expiry := time.Now().Add(lifetime)
+    if !s.MaxExpiry.IsZero() && expiry.After(s.MaxExpiry) {
+        return s.MaxExpiry
+    }
+    return expiry
+}
+
+// For anything not configured
+func DefaultLifetimes() Lifetimes {
+    return Lifetimes {
+        FromRequest: time.Minute,
+        FromPatch: 5 * time.Minute,
+        FromRefresh: time.Minute,
+        Max: 24 * time.Hour,
+        CleanupInterval: time.Minute,
+    }
+}
+
+func mutedUntilToJson(mutedUntil time.Time) int64 {
+    if mutedUntil.Before(time.Now()) {
+        return 0
     }
+    return mutedUntil.Unix()
 }
 
-func MakeSessions() *Sessions {
-    tokens := make(map[string]*Session)
+// Sessions DB and broker are optional
+func MakeSessions(signer *token.Signer, lifetimes Lifetimes, db *SessionsDb, b broker.Broker) *Sessions {
     s := &Sessions{
-        tokens,
-        make(chan PatchFromJsonData),
-        make(chan FindData),
-        make(chan RequestData),
+        signer,
+        lifetimes,
+        make(map[string]*Session),
+        make(chan patchFromJsonData),
+        make(chan findData),
+        make(chan requestData),
+        make(chan refreshData),
+        make(chan revokeData),
+        make(chan subscribeData),
+        make(chan moderateData),
+        make(chan listBansData),
+        make(chan chatCheckData),
+        make(chan findByPlayerNameData),
+        make(chan listData),
+        make(chan serverData),
+        make(chan listServersData),
+        make([]*Subscription, 0),
+        make(map[string]*Ban),
+        make(map[string]*Ban),
+        make(map[string]*GameServer),
+        make(map[string]int64),
+        make(chan revokedData),
+        make(chan chan bool),
+        make(chan chan bool),
+        db,
+        b,
+        uuid.New().String(),
+        nil,
+    }
+    if db != nil {
+        s.restore()
+    }
+    if b != nil {
+        replicas, err := b.Subscribe(sessionsTopic)
+        if err != nil {
+            logger.Error("Failed to subscribe to session replicas, sessions will not be shared", "err", err)
+            s.broker = nil
+        } else {
+            s.replicas = replicas
+            s.replicate(replicaEvent { Kind: replicaSync })
+        }
     }
     go s.aggregator()
     return s
 }
 
+// Tokens only survive if the signing secret is also configured, since they are re-signed from the stored claims
+func (s *Sessions) restore() {
+    sessions, revoked, bans, err := s.db.load(time.Now())
+    if err != nil {
+        logger.Error("Failed to restore sessions", "err", err)
+        return
+    }
+    for i := range sessions {
+        signed, err := s.signer.Sign(claimsOf(&sessions[i]))
+        if err != nil {
+            logger.Error("Failed to re-sign restored token", "err", err)
+            continue
+        }
+        sessions[i].Token = signed
+        s.byID[sessions[i].ID] = &sessions[i]
+    }
+    s.revoked = revoked
+    for i := range bans {
+        if bans[i].SessionID != "" {
+            s.bannedSessions[bans[i].SessionID] = &bans[i]
+        } else {
+            s.bannedPlayers[strings.ToLower(bans[i].PlayerName)] = &bans[i]
+        }
+    }
+    logger.Info("Restored sessions", "sessions", len(sessions), "revocations", len(revoked), "bans", len(bans))
+}
+
 //////////////////////////////////////////////////
 
 // [Timed out tokens]
-// Currently use crude approach after timing out,
-// where the next action which needs a token will fail,
-// but won't actively kick people out of chat for example.
-// Game server must slow but constantly ping the sessions server.
-var tokenLifetimeMinutesFromRequest time.Duration = 1
-var tokenLifetimeMinutesFromPatch time.Duration = 5
+// Expiry, revocation and patches are published to subscribers (eg. chat),
+// which are responsible for kicking out their own clients.
+// Game server must slow but constantly ping the sessions server,
+// and clients outside of a game must refresh, see `Lifetimes`.
 
 func (s *Sessions) aggregator() {
-    ticker := time.NewTicker(time.Minute)
+    ticker := time.NewTicker(s.lifetimes.CleanupInterval)
+    defer ticker.Stop()
     for {
         select {
-        case patch := <-s.PatchFromJsonChan:
-            patch.Cb <- s.patchFromJson(patch.Token, patch.Info)
+        case patch := <-s.patchFromJsonChan:
+            if token, success := s.patchFromJson(patch.Token, patch.Info); success {
+                patch.Cb <- &token
+            } else {
+                patch.Cb <- nil
+            }
             close(patch.Cb)
-        case find := <-s.FindChan:
+        case find := <-s.findChan:
             sessionCopy, found := s.findAndCopy(find.Token)
             if !found {
                 find.Cb <- nil
@@ -68,7 +195,7 @@ func (s *Sessions) aggregator() {
                 find.Cb <- &sessionCopy
             }
             close(find.Cb)
-        case request := <-s.RequestChan:
+        case request := <-s.requestChan:
             token, success := s.request()
             if success {
                 request.Cb <- &token
@@ -76,8 +203,73 @@ func (s *Sessions) aggregator() {
                 request.Cb <- nil
             }
             close(request.Cb)
+        case refresh := <-s.refreshChan:
+            if token, success := s.refresh(refresh.Token); success {
+                refresh.Cb <- &token
+            } else {
+                refresh.Cb <- nil
+            }
+            close(refresh.Cb)
+        case revoke := <-s.revokeChan:
+            revoke.Cb <- s.revoke(revoke.Token)
+            close(revoke.Cb)
+        case revoked := <-s.revokedChan:
+            revoked.Cb <- s.listRevoked()
+            close(revoked.Cb)
+        case subscribe := <-s.subscribeChan:
+            s.subscribers = append(s.subscribers, subscribe.Subscription)
+            subscribe.Cb <- true
+            close(subscribe.Cb)
+        case moderate := <-s.moderateChan:
+            moderate.Cb <- s.moderate(&moderate.Req)
+            close(moderate.Cb)
+        case listBans := <-s.listBansChan:
+            listBans.Cb <- s.listBans()
+            close(listBans.Cb)
+        case chatCheck := <-s.chatCheckChan:
+            if chatCheck.SessionID != "" {
+                chatCheck.Cb <- s.chatCheckByID(chatCheck.SessionID)
+            } else {
+                chatCheck.Cb <- s.chatCheck(chatCheck.Token)
+            }
+            close(chatCheck.Cb)
+        case find := <-s.findByPlayerNameChan:
+            if session := s.findByPlayerName(find.PlayerName, find.GameInstance); session != nil {
+                sessionCopy := *session
+                find.Cb <- &sessionCopy
+            } else {
+                find.Cb <- nil
+            }
+            close(find.Cb)
+        case list := <-s.listChan:
+            list.Cb <- s.list()
+            close(list.Cb)
+        case server := <-s.serverChan:
+            server.Cb <- s.server(&server.Req)
+            close(server.Cb)
+        case listServers := <-s.listServersChan:
+            listServers.Cb <- s.listServers()
+            close(listServers.Cb)
+        case payload, ok := <-s.replicas:
+            if !ok {
+                logger.Warn("Session replicas closed")
+                s.replicas = nil
+                continue
+            }
+            s.onReplica(payload)
+        case cb := <-s.pingChan:
+            cb <- true
+            close(cb)
+        case cb := <-s.closeChan:
+            cb <- true
+            close(cb)
+            return
         case _ = <-ticker.C:
+            s.db.deleteExpired(time.Now())
             s.cleanUpExpired()
+            s.cleanUpExpiredRevocations()
+            s.cleanUpExpiredBans()
+            s.cleanUpExpiredServers()
         }
     }
 }
@@ -85,37 +277,122 @@ func (s *Sessions) aggregator() {
 //////////////////////////////////////////////////
 // Synchronous methods
 
+// Signing is deterministic, so the same claims give the same token
+func claimsOf(session *Session) *token.Claims {
+    return &token.Claims {
+        SessionID: session.ID,
+        PlayerName: session.PlayerName,
+        GameInstance: session.GameInstance,
+        IsInGame: session.IsInGame,
+        IssuedAt: session.IssuedAt.Unix(),
+        Expiry: session.Expiry.Unix(),
+        MaxExpiry: unixOrZero(session.MaxExpiry),
+        Version: session.Version,
+    }
+}
+
+// Token claims are a snapshot, so the token is re-signed whenever the session changes
+func (s *Sessions) sign(session *Session) bool {
+    session.Version++
+    session.IssuedAt = time.Now()
+    signed, err := s.signer.Sign(claimsOf(session))
+    if err != nil {
+        logger.Error("Failed to sign token", "err", err)
+        return false
+    }
+    session.Token = signed
+    return true
+}
+
+// Nil if the signature is invalid, the token has expired or been replaced by a refresh or patch,
+// or the session has expired or been revoked.
+// A newer version may come from another node before its replica, so is accepted.
+// With a broker, unknown sessions may be adopted from the token's claims, see `adopt`.
+func (s *Sessions) lookup(signed string) *Session {
+    claims, err := s.signer.Verify(signed, time.Now())
+    if err != nil {
+        return nil
+    }
+    if session := s.byID[claims.SessionID]; session != nil {
+        if claims.Version < session.Version {
+            return nil
+        }
+        return session
+    }
+    if s.broker == nil {
+        return nil
+    }
+    return s.adopt(claims, signed)
+}
+
 func (s *Sessions) request() (string, bool) {
     u := uuid.New().String()
-    if s.tokens[u] != nil {
-        log.Print("UUID collision, rejecting ", u)
+    if s.byID[u] != nil {
+        logger.Error("UUID collision, rejecting", "sessionId", u)
         return "", false
     }
+    now := time.Now()
     session := Session{
         u,
+        "",
         false,
         "",
         "",
-        time.Now().Add(time.Minute * tokenLifetimeMinutesFromRequest),
+        now.Add(s.lifetimes.FromRequest),
+        time.Time{},
+        time.Time{},
+        time.Time{},
+        0,
+    }
+    if s.lifetimes.Max > 0 {
+        session.MaxExpiry = now.Add(s.lifetimes.Max)
     }
-    s.tokens[session.Token] = &session
+    if !s.sign(&session) {
+        return "", false
+    }
+    s.byID[session.ID] = &session
+    s.db.saveSession(&session)
+    s.replicateSession(noSessionEvent, &session)
     return session.Token, true
 }
 
-func (s *Sessions) findAndCopy(token string) (Session, bool) {
-    if session, found := s.tokens[token]; found {
+func (s *Sessions) findAndCopy(signed string) (Session, bool) {
+    if session := s.lookup(signed); session != nil {
         return *session, true
     } else {
         return Session{}, false
     }
 }
 
-func (s *Sessions) patchFromJson(token string, req *PatchSessionRequest) bool {
+func (s *Sessions) list() []Session {
+    result := make([]Session, 0, len(s.byID))
+    for _, session := range s.byID {
+        result = append(result, *session)
+    }
+    return result
+}
+
+func (s *Sessions) findByPlayerName(playerName string, gameInstance string) *Session {
+    var result *Session
+    for _, session := range s.byID {
+        if session.PlayerName != playerName {
+            continue
+        }
+        if session.IsInGame && session.GameInstance == gameInstance {
+            return session
+        }
+        result = session
+    }
+    return result
+}
+
+// Returns the re-signed token
+func (s *Sessions) patchFromJson(signed string, req *PatchSessionRequest) (string, bool) {
     if req == nil {
-        return false
+        return "", false
     }
 
-    if found := s.tokens[token]; found != nil {
+    if found := s.lookup(signed); found != nil {
         if req.IsInGame != nil {
             found.IsInGame = *req.IsInGame
         }
@@ -126,25 +403,143 @@ func (s *Sessions) patchFromJson(token string, req *PatchSessionRequest) bool {
             found.PlayerName = *req.PlayerName
         }
         // Can send nothing to continue refreshing the expiry
-        found.Expiry = time.Now().Add(time.Minute * tokenLifetimeMinutesFromPatch)
-        return true
+        found.Expiry = extendedExpiry(found, s.lifetimes.FromPatch)
+        if !s.sign(found) {
+            return "", false
+        }
+        s.db.saveSession(found)
+        s.replicateSession(SessionPatched, found)
+        s.publish(SessionPatched, found)
+        return found.Token, true
     } else {
-        return false
+        return "", false
+    }
+}
+
+// Like an empty patch, but with the client's lifetime, and not published since nothing visible changed.
+// Never shortens a longer expiry from a patch.
+func (s *Sessions) refresh(signed string) (string, bool) {
+    found := s.lookup(signed)
+    if found == nil {
+        return "", false
+    }
+    if expiry := extendedExpiry(found, s.lifetimes.FromRefresh); expiry.After(found.Expiry) {
+        found.Expiry = expiry
+    }
+    if !s.sign(found) {
+        return "", false
     }
+    s.db.saveSession(found)
+    s.replicateSession(noSessionEvent, found)
+    return found.Token, true
 }
 
 func (s *Sessions) cleanUpExpired() {
-    if len(s.tokens) <= 0 {
+    if len(s.byID) <= 0 {
         return
     }
-    log.Print("Tick clean up, count=", len(s.tokens))
+    logger.Debug("Tick clean up", "count", len(s.byID))
     now := time.Now()
-    for k, v := range s.tokens {
+    for k, v := range s.byID {
         if now.Compare(v.Expiry) >= 0 {
-            log.Print("Deleting: ", v)
-            delete(s.tokens, k)
-        } else {
-            log.Print("Keeping: ", v)
+            logger.Info("Session expired", "session", v)
+            delete(s.byID, k)
+            s.publish(SessionExpired, v)
+        }
+    }
+}
+
+// Tokens may still pass offline verification until they expire, so they are listed until then
+func (s *Sessions) revoke(signed string) bool {
+    if found := s.lookup(signed); found != nil {
+        logger.Info("Revoking", "session", found)
+        s.applyRevoke(found.ID, found.Expiry.Unix())
+        s.replicate(replicaEvent { Kind: replicaRevoke, Session: &Session { ID: found.ID, Expiry: found.Expiry } })
+        return true
+    } else {
+        return false
+    }
+}
+
+// The session may be unknown, if revoked on another node
+func (s *Sessions) applyRevoke(id string, expiry int64) {
+    s.revoked[id] = expiry
+    s.db.revokeSession(id, expiry)
+    if found := s.byID[id]; found != nil {
+        delete(s.byID, id)
+        s.publish(SessionRevoked, found)
+    }
+}
+
+func (s *Sessions) publish(kind int, session *Session) {
+    for _, subscriber := range s.subscribers {
+        subscriber.add(SessionEvent{Kind: kind, Session: *session})
+    }
+}
+
+func MakeSubscription() *Subscription {
+    return &Subscription{
+        pending: make(map[string]SessionEvent),
+        ready: make(chan struct{}, 1),
+    }
+}
+
+// Signalled when events are pending, then `Drain` them
+func (sub *Subscription) Ready() <-chan struct{} {
+    return sub.ready
+}
+
+// Latest event per session, in no particular order
+func (sub *Subscription) Drain() []SessionEvent {
+    sub.mutex.Lock()
+    defer sub.mutex.Unlock()
+    result := make([]SessionEvent, 0, len(sub.pending))
+    for _, event := range sub.pending {
+        result = append(result, event)
+    }
+    clear(sub.pending)
+    return result
+}
+
+// For metrics
+func (sub *Subscription) Len() int {
+    sub.mutex.Lock()
+    defer sub.mutex.Unlock()
+    return len(sub.pending)
+}
+
+// Latest state wins, except that a pending kick is never replaced by a later update
+func (sub *Subscription) add(event SessionEvent) {
+    sub.mutex.Lock()
+    defer sub.mutex.Unlock()
+    if pending, found := sub.pending[event.Session.ID]; found && isKick(pending.Kind) && !isKick(event.Kind) {
+        return
+    }
+    sub.pending[event.Session.ID] = event
+    select {
+    case sub.ready <- struct{}{}:
+    default:
+        // Already signalled
+    }
+}
+
+func isKick(kind int) bool {
+    return kind == SessionExpired || kind == SessionRevoked || kind == SessionBanned
+}
+
+func (s *Sessions) listRevoked() []RevokedSession {
+    result := make([]RevokedSession, 0, len(s.revoked))
+    for id, expiry := range s.revoked {
+        result = append(result, RevokedSession{id, expiry})
+    }
+    return result
+}
+
+func (s *Sessions) cleanUpExpiredRevocations() {
+    now := time.Now().Unix()
+    for id, expiry := range s.revoked {
+        if now >= expiry {
+            delete(s.revoked, id)
         }
     }
 }
@@ -0,0 +1,186 @@
+package sessions
+
+import (
+    "testing"
+    "time"
+	"github.com/starqi/wi-util-servers/internal/token"
+)
+
+var testSigner *token.Signer
+
+func makeTestSessions() *Sessions {
+    return MakeSessions(testSigner, DefaultLifetimes(), nil, nil)
+}
+
+func TestSignedTokensAcrossPatchAndRevoke(t *testing.T) {
+    s := makeTestSessions()
+
+    original, success := s.request()
+    if !success {
+        t.Fatal("Expected token")
+    }
+    claims, err := testSigner.Parse(original)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if s.lookup(original) == nil || s.lookup(original).ID != claims.SessionID {
+        t.Fatal("Expected token to resolve to its session")
+    }
+
+    name := "Bob"
+    patched, success := s.patchFromJson(original, &PatchSessionRequest{PlayerName: &name})
+    if !success || patched == original {
+        t.Fatal("Expected a re-signed token")
+    }
+    patchedClaims, err := testSigner.Parse(patched)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if patchedClaims.SessionID != claims.SessionID || patchedClaims.PlayerName != "Bob" || patchedClaims.Expiry <= claims.Expiry {
+        t.Fatalf("Unexpected patched claims %v", patchedClaims)
+    }
+
+    // Replaced tokens stop working, even before they expire
+    if s.lookup(original) != nil {
+        t.Fatal("Expected the pre-patch token to be rejected")
+    }
+    if session, found := s.findAndCopy(patched); !found || session.PlayerName != "Bob" {
+        t.Fatal("Expected the patched token to find the session")
+    }
+    if check := s.chatCheckByID(claims.SessionID); check.Session == nil || check.Session.Token != patched {
+        t.Fatal("Expected chat check by ID to find the latest token")
+    }
+
+    other, _ := token.MakeSigner([]byte("fedcba9876543210"))
+    forged, _ := other.Sign(claims)
+    if s.lookup(forged) != nil {
+        t.Fatal("Expected forged token to be rejected")
+    }
+
+    if !s.revoke(patched) {
+        t.Fatal("Expected revoke to succeed")
+    }
+    if s.lookup(patched) != nil {
+        t.Fatal("Expected revoked session to be gone")
+    }
+    revoked := s.listRevoked()
+    if len(revoked) != 1 || revoked[0].ID != claims.SessionID || revoked[0].Expiry != patchedClaims.Expiry {
+        t.Fatalf("Unexpected revocation list %v", revoked)
+    }
+}
+
+func TestRefreshAndMaxLifetime(t *testing.T) {
+    lifetimes := DefaultLifetimes()
+    lifetimes.FromRefresh = 2 * time.Minute
+    lifetimes.FromPatch = time.Hour
+    lifetimes.Max = 10 * time.Minute
+    s := MakeSessions(testSigner, lifetimes, nil, nil)
+
+    signed, _ := s.request()
+    if ttl := SessionToJson(s.lookup(signed)).Ttl; ttl > 60 || ttl < 55 {
+        t.Fatalf("Expected request lifetime, got %d", ttl)
+    }
+
+    refreshed, success := s.refresh(signed)
+    if !success {
+        t.Fatal("Expected refresh to succeed")
+    }
+    if s.lookup(signed) != nil {
+        t.Fatal("Expected the pre-refresh token to be rejected")
+    }
+    if _, success := s.refresh(signed); success {
+        t.Fatal("Expected the pre-refresh token to be unable to refresh")
+    }
+    json := SessionToJson(s.lookup(refreshed))
+    if json.Ttl > 120 || json.Ttl < 115 || json.MaxTtl > 600 || json.MaxTtl < 595 {
+        t.Fatalf("Expected refresh lifetime, got %v", json)
+    }
+
+    // Patches can't pass the maximum
+    patched, _ := s.patchFromJson(refreshed, &PatchSessionRequest{})
+    session := s.lookup(patched)
+    if !session.Expiry.Equal(session.MaxExpiry) {
+        t.Fatalf("Expected expiry capped at %v, got %v", session.MaxExpiry, session.Expiry)
+    }
+    claims, _ := testSigner.Parse(patched)
+    if claims.Expiry != session.MaxExpiry.Unix() {
+        t.Fatal("Expected token expiry to be capped")
+    }
+
+    // Refreshing never shortens a patch
+    refreshed, _ = s.refresh(patched)
+    if !s.lookup(refreshed).Expiry.Equal(session.MaxExpiry) {
+        t.Fatal("Expected refresh to keep the longer expiry")
+    }
+
+    if _, success := s.refresh("missing"); success {
+        t.Fatal("Expected refresh of a missing token to fail")
+    }
+}
+
+// Waits for exactly one pending event
+func nextEvent(t *testing.T, events *Subscription) SessionEvent {
+    t.Helper()
+    select {
+    case <-events.Ready():
+    case <-time.After(time.Second):
+        t.Fatal("Expected an event")
+    }
+    drained := events.Drain()
+    if len(drained) != 1 {
+        t.Fatalf("Expected 1 event, got %v", drained)
+    }
+    return drained[0]
+}
+
+func TestSubscriptionCoalescesPerSession(t *testing.T) {
+    s := makeTestSessions()
+    events := MakeSubscription()
+    s.subscribers = append(s.subscribers, events)
+
+    // Far more events than any buffer, with nobody reading
+    tokens := make([]string, 0)
+    for i := 0; i < 100; i++ {
+        token, _ := s.request()
+        name := "Bob"
+        token, _ = s.patchFromJson(token, &PatchSessionRequest{PlayerName: &name})
+        tokens = append(tokens, token)
+    }
+    name := "Alice"
+    patched, _ := s.patchFromJson(tokens[0], &PatchSessionRequest{PlayerName: &name})
+    s.revoke(tokens[1])
+    // A later update must not hide the kick
+    banned, _ := s.patchFromJson(tokens[2], &PatchSessionRequest{PlayerName: &name})
+    s.moderate(&ModerateRequest{Kind: ModerateBanToken, Token: banned, Duration: time.Minute})
+    s.patchFromJson(banned, &PatchSessionRequest{PlayerName: &name})
+
+    <-events.Ready()
+    drained := events.Drain()
+    if len(drained) != 100 {
+        t.Fatalf("Expected 1 event per session, got %d", len(drained))
+    }
+    byID := make(map[string]SessionEvent)
+    for _, event := range drained {
+        byID[event.Session.ID] = event
+    }
+    first := s.lookup(patched)
+    if event := byID[first.ID]; event.Kind != SessionPatched || event.Session.PlayerName != "Alice" {
+        t.Fatalf("Expected the latest patch to win, got %v", event)
+    }
+    claims, _ := testSigner.Parse(tokens[1])
+    if event := byID[claims.SessionID]; event.Kind != SessionRevoked {
+        t.Fatalf("Expected revocation, got %v", event)
+    }
+    claims, _ = testSigner.Parse(banned)
+    if event := byID[claims.SessionID]; event.Kind != SessionBanned {
+        t.Fatalf("Expected the ban to survive a later patch, got %v", event)
+    }
+    if len(events.Drain()) != 0 {
+        t.Fatal("Expected nothing pending after draining")
+    }
+}
+
+func TestMain(m *testing.M) {
+    testSigner, _ = token.MakeSigner([]byte("0123456789abcdef"))
+    m.Run()
+}
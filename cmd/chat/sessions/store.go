@@ -0,0 +1,187 @@
+package sessions
+
+import (
+    "context"
+    "errors"
+	"github.com/starqi/wi-util-servers/internal/deadline"
+)
+
+var ErrNotFound = errors.New("Session not found")
+var ErrFailed = errors.New("Session request failed")
+
+// The sessions service is split by concern, so that callers and fakes only deal with what they use.
+// Every call waits on the context, both to be accepted and for the result, see `deadline.Call`.
+// A cancelled call may still take effect, if the sessions service accepted it before the cancellation.
+
+type SessionStore interface {
+    // Returns the signed token
+    Create(ctx context.Context) (string, error)
+    Get(ctx context.Context, token string) (*Session, error)
+    // Returns the re-signed token
+    Patch(ctx context.Context, token string, req *PatchSessionRequest) (string, error)
+    Refresh(ctx context.Context, token string) (string, error)
+    Revoke(ctx context.Context, token string) error
+    List(ctx context.Context) ([]Session, error)
+    ListRevoked(ctx context.Context) ([]RevokedSession, error)
+}
+
+type EventSource interface {
+    // See `MakeSubscription`
+    Subscribe(ctx context.Context, subscription *Subscription) error
+}
+
+// For chat, which also needs the moderation state
+type ChatChecks interface {
+    // Nil session if the token is not found
+    ChatCheck(ctx context.Context, token string) (*ChatCheck, error)
+    // For clients already authenticated, since their token may have been replaced by a patch or refresh
+    ChatCheckByID(ctx context.Context, sessionID string) (*ChatCheck, error)
+    // Game instance is a preference, since player names are not unique
+    FindByPlayerName(ctx context.Context, playerName string, gameInstance string) (*Session, error)
+}
+
+type Moderation interface {
+    Moderate(ctx context.Context, req ModerateRequest) error
+    ListBans(ctx context.Context) ([]Ban, error)
+}
+
+type ServerRegistry interface {
+    Server(ctx context.Context, req ServerRequest) error
+    ListServers(ctx context.Context) ([]GameServerAsJson, error)
+}
+
+type Lifecycle interface {
+    // Succeeds if the service is responding, for readiness checks
+    Ping(ctx context.Context) error
+    // Stops the service for shutting down, so nothing more is persisted or replicated.
+    // Calls afterwards wait until their context is done.
+    Close(ctx context.Context) error
+}
+
+// `Sessions` is the in-memory service, where a single aggregator goroutine owns all state
+var _ SessionStore = (*Sessions)(nil)
+var _ EventSource = (*Sessions)(nil)
+var _ ChatChecks = (*Sessions)(nil)
+var _ Moderation = (*Sessions)(nil)
+var _ ServerRegistry = (*Sessions)(nil)
+var _ Lifecycle = (*Sessions)(nil)
+
+func tokenResult(token *string, err error) (string, error) {
+    if err != nil {
+        return "", err
+    }
+    if token == nil {
+        return "", ErrNotFound
+    }
+    return *token, nil
+}
+
+func foundResult(found bool, err error) error {
+    if err != nil {
+        return err
+    }
+    if !found {
+        return ErrNotFound
+    }
+    return nil
+}
+
+func (s *Sessions) Create(ctx context.Context) (string, error) {
+    cb := make(chan *string, 1)
+    token, err := deadline.Call(ctx, s.requestChan, requestData{Cb: cb}, cb)
+    if err == nil && token == nil {
+        return "", ErrFailed
+    }
+    return tokenResult(token, err)
+}
+
+func (s *Sessions) Get(ctx context.Context, token string) (*Session, error) {
+    cb := make(chan *Session, 1)
+    session, err := deadline.Call(ctx, s.findChan, findData{Token: token, Cb: cb}, cb)
+    if err == nil && session == nil {
+        return nil, ErrNotFound
+    }
+    return session, err
+}
+
+func (s *Sessions) Patch(ctx context.Context, token string, req *PatchSessionRequest) (string, error) {
+    cb := make(chan *string, 1)
+    return tokenResult(deadline.Call(ctx, s.patchFromJsonChan, patchFromJsonData{Token: token, Info: req, Cb: cb}, cb))
+}
+
+func (s *Sessions) Refresh(ctx context.Context, token string) (string, error) {
+    cb := make(chan *string, 1)
+    return tokenResult(deadline.Call(ctx, s.refreshChan, refreshData{Token: token, Cb: cb}, cb))
+}
+
+func (s *Sessions) Revoke(ctx context.Context, token string) error {
+    cb := make(chan bool, 1)
+    return foundResult(deadline.Call(ctx, s.revokeChan, revokeData{Token: token, Cb: cb}, cb))
+}
+
+func (s *Sessions) List(ctx context.Context) ([]Session, error) {
+    cb := make(chan []Session, 1)
+    return deadline.Call(ctx, s.listChan, listData{Cb: cb}, cb)
+}
+
+func (s *Sessions) ListRevoked(ctx context.Context) ([]RevokedSession, error) {
+    cb := make(chan []RevokedSession, 1)
+    return deadline.Call(ctx, s.revokedChan, revokedData{Cb: cb}, cb)
+}
+
+func (s *Sessions) Subscribe(ctx context.Context, subscription *Subscription) error {
+    cb := make(chan bool, 1)
+    _, err := deadline.Call(ctx, s.subscribeChan, subscribeData{Subscription: subscription, Cb: cb}, cb)
+    return err
+}
+
+func (s *Sessions) ChatCheck(ctx context.Context, token string) (*ChatCheck, error) {
+    cb := make(chan *ChatCheck, 1)
+    return deadline.Call(ctx, s.chatCheckChan, chatCheckData{Token: token, Cb: cb}, cb)
+}
+
+func (s *Sessions) ChatCheckByID(ctx context.Context, sessionID string) (*ChatCheck, error) {
+    cb := make(chan *ChatCheck, 1)
+    return deadline.Call(ctx, s.chatCheckChan, chatCheckData{SessionID: sessionID, Cb: cb}, cb)
+}
+
+func (s *Sessions) FindByPlayerName(ctx context.Context, playerName string, gameInstance string) (*Session, error) {
+    cb := make(chan *Session, 1)
+    session, err := deadline.Call(ctx, s.findByPlayerNameChan, findByPlayerNameData{PlayerName: playerName, GameInstance: gameInstance, Cb: cb}, cb)
+    if err == nil && session == nil {
+        return nil, ErrNotFound
+    }
+    return session, err
+}
+
+func (s *Sessions) Moderate(ctx context.Context, req ModerateRequest) error {
+    cb := make(chan bool, 1)
+    return foundResult(deadline.Call(ctx, s.moderateChan, moderateData{Req: req, Cb: cb}, cb))
+}
+
+func (s *Sessions) ListBans(ctx context.Context) ([]Ban, error) {
+    cb := make(chan []Ban, 1)
+    return deadline.Call(ctx, s.listBansChan, listBansData{Cb: cb}, cb)
+}
+
+func (s *Sessions) Server(ctx context.Context, req ServerRequest) error {
+    cb := make(chan bool, 1)
+    return foundResult(deadline.Call(ctx, s.serverChan, serverData{Req: req, Cb: cb}, cb))
+}
+
+func (s *Sessions) ListServers(ctx context.Context) ([]GameServerAsJson, error) {
+    cb := make(chan []GameServerAsJson, 1)
+    return deadline.Call(ctx, s.listServersChan, listServersData{Cb: cb}, cb)
+}
+
+func (s *Sessions) Ping(ctx context.Context) error {
+    cb := make(chan bool, 1)
+    _, err := deadline.Call(ctx, s.pingChan, cb, cb)
+    return err
+}
+
+func (s *Sessions) Close(ctx context.Context) error {
+    cb := make(chan bool, 1)
+    _, err := deadline.Call(ctx, s.closeChan, cb, cb)
+    return err
+}
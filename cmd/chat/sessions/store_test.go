@@ -0,0 +1,66 @@
+package sessions
+
+import (
+    "context"
+    "testing"
+    "time"
+)
+
+func TestStoreErrors(t *testing.T) {
+    s := makeTestSessions()
+    ctx := context.Background()
+
+    if _, err := s.Get(ctx, "missing"); err != ErrNotFound {
+        t.Fatalf("Expected not found, got %v", err)
+    }
+    if err := s.Revoke(ctx, "missing"); err != ErrNotFound {
+        t.Fatalf("Expected not found, got %v", err)
+    }
+    if _, err := s.Patch(ctx, "missing", &PatchSessionRequest{}); err != ErrNotFound {
+        t.Fatalf("Expected not found, got %v", err)
+    }
+
+    signed, err := s.Create(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if session, err := s.Get(ctx, signed); err != nil || session.Token != signed {
+        t.Fatalf("Expected session, got %v %v", session, err)
+    }
+}
+
+func TestStoreCancellation(t *testing.T) {
+    // No aggregator, as if it were stuck
+    s := &Sessions { findChan: make(chan findData), requestChan: make(chan requestData, 1), pingChan: make(chan chan bool) }
+
+    pingCtx, cancelPing := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+    defer cancelPing()
+    if err := s.Ping(pingCtx); err != context.DeadlineExceeded {
+        t.Fatalf("Expected ping to time out, got %v", err)
+    }
+    if err := makeTestSessions().Ping(context.Background()); err != nil {
+        t.Fatal(err)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+    defer cancel()
+    if _, err := s.Get(ctx, "token"); err != context.DeadlineExceeded {
+        t.Fatalf("Expected deadline while sending, got %v", err)
+    }
+
+    // Accepted but never answered
+    ctx, cancel = context.WithTimeout(context.Background(), 10 * time.Millisecond)
+    defer cancel()
+    if _, err := s.Create(ctx); err != context.DeadlineExceeded {
+        t.Fatalf("Expected deadline while waiting, got %v", err)
+    }
+
+    // The aggregator can still answer the abandoned call without blocking
+    request := <-s.requestChan
+    token := "late"
+    select {
+    case request.Cb <- &token:
+    default:
+        t.Fatal("Expected callback to be buffered")
+    }
+}
@@ -0,0 +1,35 @@
+package sessions
+
+import (
+    "os"
+    "log"
+    "github.com/golang-migrate/migrate/v4"
+    _ "github.com/golang-migrate/migrate/v4/database/sqlite3"
+    _ "github.com/golang-migrate/migrate/v4/source/file"
+)
+
+const testDbPath = "../../../dist/sessions-test-db.db"
+
+// Without the background writer, so tests decide when writes land
+func RemakeTestDb() *SessionsDb {
+    err := os.Remove(testDbPath)
+    if err != nil {
+        log.Print("Failed to remove existing DB - ", err)
+    }
+
+    migrate, err := migrate.New("file://../../../db/chat-migrations", "sqlite3://" + testDbPath)
+    if err != nil {
+        log.Fatal("Failed to create migration class - ", err)
+    }
+
+    err = migrate.Up()
+    if err != nil {
+        log.Fatal("Failed to create test DB - ", err)
+    }
+
+    p, err := openSessionsDb(testDbPath)
+    if err != nil {
+        log.Fatal("Could not access DB - ", err)
+    }
+    return p
+}
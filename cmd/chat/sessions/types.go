@@ -1,22 +1,45 @@
 package sessions
 
 import (
+    "sync"
     "time"
+	"github.com/starqi/wi-util-servers/internal/broker"
+	"github.com/starqi/wi-util-servers/internal/token"
 )
 
 type Session struct {
+    // Stable, unlike the token
+    ID string
+    // Latest signed token, see `token.Claims`
     Token string
     IsInGame bool
     GameInstance string
     PlayerName string
     Expiry time.Time
+    // Zero if never muted
+    MutedUntil time.Time
+    // No refresh or patch extends the expiry past this, zero if unbounded, see `Lifetimes.Max`
+    MaxExpiry time.Time
+    // Of the latest token, so it can be re-signed identically, see `restore`
+    IssuedAt time.Time
+    // Of the latest token, older tokens are rejected, see `lookup`
+    Version int64
 }
 
 type SessionAsJson struct {
-    Token string `json:"token"`
+    ID string `json:"id"`
+    // Bearer credential, blanked wherever the JSON is kept, eg. in reports
+    Token string `json:"token,omitempty"`
     GameInstance string `json:"gameInstance"`
     IsInGame bool `json:"isInGame"`
     PlayerName string `json:"playerName"`
+    // Unix seconds, omitted if not muted
+    MutedUntil int64 `json:"mutedUntil,omitempty"`
+    // Unix seconds
+    Expiry int64 `json:"expiry"`
+    // Seconds until expiry, and until the maximum expiry, which is omitted if unbounded
+    Ttl int64 `json:"ttl"`
+    MaxTtl int64 `json:"maxTtl,omitempty"`
 }
 
 type PatchSessionRequest struct {
@@ -25,13 +48,169 @@ type PatchSessionRequest struct {
     PlayerName *string `json:"playerName"`
 }
 
-type PatchFromJsonData struct{Token string; Info *PatchSessionRequest; Cb chan bool}
-type FindData struct{Token string; Cb chan *Session}
-type RequestData struct{Cb chan *string}
+type ModerateRequest struct {
+    Kind int
+    Token string
+    PlayerName string
+    Duration time.Duration
+}
+
+type ServerRequest struct {
+    Kind int
+    GameInstance string
+    Info *GameServerRequest
+}
+
+// Aggregator requests, see `store.go`. Callbacks must be buffered, so the aggregator never waits for a caller that gave up.
+// Callbacks with the re-signed token
+type patchFromJsonData struct{Token string; Info *PatchSessionRequest; Cb chan *string}
+type findData struct{Token string; Cb chan *Session}
+type requestData struct{Cb chan *string}
+// Callback with the re-signed token
+type refreshData struct{Token string; Cb chan *string}
+type revokeData struct{Token string; Cb chan bool}
+type revokedData struct{Cb chan []RevokedSession}
+type subscribeData struct{Subscription *Subscription; Cb chan bool}
+type moderateData struct{Req ModerateRequest; Cb chan bool}
+type listBansData struct{Cb chan []Ban}
+// Either the token or, for clients already authenticated, the session ID
+type chatCheckData struct{Token string; SessionID string; Cb chan *ChatCheck}
+type listData struct{Cb chan []Session}
+type serverData struct{Req ServerRequest; Cb chan bool}
+type listServersData struct{Cb chan []GameServerAsJson}
+// Game instance is a preference, since player names are not unique
+type findByPlayerNameData struct{PlayerName string; GameInstance string; Cb chan *Session}
+
+const (
+    // Zero duration unmutes
+    ModerateMute = iota
+    // Zero duration bans permanently
+    ModerateBanToken = iota
+    ModerateBanPlayer = iota
+    ModerateUnbanToken = iota
+    ModerateUnbanPlayer = iota
+)
+
+const (
+    // Also refreshes the expiry
+    ServerRegister = iota
+    ServerHeartbeat = iota
+    ServerDeregister = iota
+)
+
+// Keyed by game instance, which sessions reference
+type GameServer struct {
+    GameInstance string
+    Address string
+    Region string
+    Mode string
+    Map string
+    Capacity int
+    Expiry time.Time
+}
+
+type GameServerRequest struct {
+    Address string `json:"address"`
+    Region string `json:"region"`
+    Mode string `json:"mode"`
+    Map string `json:"map"`
+    Capacity int `json:"capacity"`
+}
+
+type GameServerAsJson struct {
+    GameInstance string `json:"gameInstance"`
+    Address string `json:"address"`
+    Region string `json:"region"`
+    Mode string `json:"mode"`
+    Map string `json:"map"`
+    Capacity int `json:"capacity"`
+    Players int `json:"players"`
+}
+
+// Exactly one of session ID or player name is set
+type Ban struct {
+    SessionID string `json:"sessionId,omitempty"`
+    PlayerName string `json:"playerName,omitempty"`
+    // Zero if permanent
+    Until time.Time `json:"until"`
+}
+
+// Revoked tokens up until the session's last expiry, after which they fail offline verification anyway
+type RevokedSession struct {
+    ID string `json:"id"`
+    Expiry int64 `json:"expiry"`
+}
+
+// Nil session if the token is not found
+type ChatCheck struct {
+    Session *Session
+    Banned bool
+}
+
+const (
+    SessionExpired = iota
+    SessionRevoked = iota
+    SessionPatched = iota
+    SessionMuted = iota
+    SessionBanned = iota
+)
+
+// Session is a copy, safe to read from the subscriber's goroutine
+type SessionEvent struct {
+    Kind int
+    Session Session
+}
+
+// Events are coalesced per session ID, so the aggregator never blocks and nothing can overflow, see `publish`
+type Subscription struct {
+    mutex sync.Mutex
+    // Session ID -> latest event
+    pending map[string]SessionEvent
+    // Buffered, signalled when events become pending
+    ready chan struct{}
+}
+
+// Zero max means no maximum
+type Lifetimes struct {
+    FromRequest time.Duration
+    FromPatch time.Duration
+    FromRefresh time.Duration
+    Max time.Duration
+    CleanupInterval time.Duration
+}
 
 type Sessions struct {
-    tokens map[string]*Session
-    PatchFromJsonChan chan PatchFromJsonData
-    FindChan chan FindData
-    RequestChan chan RequestData
+    signer *token.Signer
+    lifetimes Lifetimes
+    byID map[string]*Session
+    patchFromJsonChan chan patchFromJsonData
+    findChan chan findData
+    requestChan chan requestData
+    refreshChan chan refreshData
+    revokeChan chan revokeData
+    subscribeChan chan subscribeData
+    moderateChan chan moderateData
+    listBansChan chan listBansData
+    chatCheckChan chan chatCheckData
+    findByPlayerNameChan chan findByPlayerNameData
+    listChan chan listData
+    serverChan chan serverData
+    listServersChan chan listServersData
+    subscribers []*Subscription
+    // Session ID -> ban
+    bannedSessions map[string]*Ban
+    // Lower case player names
+    bannedPlayers map[string]*Ban
+    servers map[string]*GameServer
+    // Session ID -> expiry, unix seconds
+    revoked map[string]int64
+    revokedChan chan revokedData
+    closeChan chan chan bool
+    pingChan chan chan bool
+    // Nil if not persisted
+    db *SessionsDb
+    // Nil if not replicated to other nodes
+    broker broker.Broker
+    node string
+    replicas <-chan []byte
 }
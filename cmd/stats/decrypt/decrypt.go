@@ -6,9 +6,14 @@ import (
 	"errors"
 )
 
+var ErrNoSharedKey = errors.New("Cannot decrypt since no shared key is set up")
+var ErrTooShort = errors.New("Too few bytes, rejecting")
+// Tampered, or encrypted with a different key
+var ErrAuthentication = errors.New("Message authentication failed")
+
 func DecryptHandlePostedHiscores(sharedSecret []byte, rawData []byte) ([]byte, error) {
     if sharedSecret == nil {
-        return nil, errors.New("Cannot decrypt since no shared key is set up")
+        return nil, ErrNoSharedKey
     } else {
         block, err := aes.NewCipher(sharedSecret)
         if err != nil {
@@ -19,7 +24,7 @@ func DecryptHandlePostedHiscores(sharedSecret []byte, rawData []byte) ([]byte, e
 
         lenRawData := len(rawData)
         if lenRawData < 29 {
-            return nil, errors.New("Too few bytes, rejecting")
+            return nil, ErrTooShort
         }
         iv := rawData[:12]
         ctWithTag := rawData[12:]
@@ -30,7 +35,7 @@ func DecryptHandlePostedHiscores(sharedSecret []byte, rawData []byte) ([]byte, e
         }
         p, err := gcm.Open(nil, iv, ctWithTag, nil)
         if err != nil {
-            return nil, err
+            return nil, ErrAuthentication
         }
 
         return p, nil
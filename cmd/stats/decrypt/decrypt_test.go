@@ -24,6 +24,19 @@ func TestEncryptedDataFromGameServerFake(t *testing.T) {
     t.Log(string(decrypted))
 }
 
+func TestRejectionReasons(t *testing.T) {
+    sharedSecret := make([]byte, 16)
+    if _, err := DecryptHandlePostedHiscores(nil, make([]byte, 64)); err != ErrNoSharedKey {
+        t.Fatal("Expected no shared key, got ", err)
+    }
+    if _, err := DecryptHandlePostedHiscores(sharedSecret, make([]byte, 28)); err != ErrTooShort {
+        t.Fatal("Expected too short, got ", err)
+    }
+    if _, err := DecryptHandlePostedHiscores(sharedSecret, make([]byte, 64)); err != ErrAuthentication {
+        t.Fatal("Expected authentication failure, got ", err)
+    }
+}
+
 func TestMain(m *testing.M) {
     m.Run()
 }
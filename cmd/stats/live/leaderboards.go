@@ -0,0 +1,308 @@
+package live
+
+import (
+    "context"
+    "errors"
+    "time"
+	"github.com/starqi/wi-util-servers/internal/deadline"
+	"github.com/starqi/wi-util-servers/internal/logging"
+	"github.com/starqi/wi-util-servers/internal/metrics"
+)
+
+// Pushes leaderboard changes to subscribers. Boards are only loaded while someone is subscribed,
+// and reloaded whenever the hiscores may have changed, eg. after an insert or a cull.
+
+var logger = logging.For("live")
+
+var subscribersGauge = metrics.Default.Gauge("hiscore_stream_subscribers", "Open leaderboard streams")
+var boardsGauge = metrics.Default.Gauge("hiscore_stream_boards", "Leaderboards with subscribers")
+
+// Updates beyond this are not waited on, the subscriber is dropped and should reconnect
+const subscriberBufferSize = 8
+// Each board is reloaded on every change, so they are capped
+const maxBoards = 100
+
+var ErrTooManyBoards = errors.New("Too many leaderboards with subscribers")
+var ErrTooManySubscriptions = errors.New("Too many leaderboard streams from this client")
+
+// Field and time group, as for top hiscores
+type Board struct {
+    Field string
+    By int
+}
+
+// One hiscore on a board, in order
+type Row struct {
+    ID int64
+    // Of the board's field, for ranking
+    Value int64
+    // Sent as-is
+    Hiscore any
+}
+
+type Loader func (ctx context.Context, board Board) ([]Row, error)
+
+type RankedRow struct {
+    // Ties share a rank
+    Rank int `json:"rank"`
+    // Zero if new to the board
+    PreviousRank int `json:"previousRank"`
+    ID int64 `json:"id"`
+    Hiscore any `json:"hiscore"`
+}
+
+type Update struct {
+    Field string `json:"field"`
+    By int `json:"by"`
+    Rows []RankedRow `json:"rows"`
+    // IDs no longer on the board
+    Dropped []int64 `json:"dropped"`
+}
+
+type Subscriber struct {
+    // Closed if the subscriber is dropped or the service is closed
+    Updates chan *Update
+    board Board
+    client string
+}
+
+type board struct {
+    subscribers map[*Subscriber]bool
+    // Last sent, nil until loaded
+    rows []RankedRow
+}
+
+type subscribeData struct {
+    board Board
+    client string
+    cb chan subscribeResult
+}
+
+type subscribeResult struct {
+    subscriber *Subscriber
+    err error
+}
+
+type Leaderboards struct {
+    subscribe chan subscribeData
+    unsubscribe chan *Subscriber
+    // Buffered, so changes coalesce while boards are reloading
+    changed chan bool
+    closing chan chan bool
+    // Closed once the aggregator stops
+    done chan struct{}
+    boards map[Board]*board
+    // Client -> open subscriptions
+    clients map[string]int
+    load Loader
+    loadTimeout time.Duration
+    maxPerClient int
+}
+
+// Clients are eg. IPs, each may only have `maxPerClient` subscriptions open
+func MakeLeaderboards(load Loader, loadTimeout time.Duration, maxPerClient int) *Leaderboards {
+    l := Leaderboards {
+        make(chan subscribeData),
+        make(chan *Subscriber),
+        make(chan bool, 1),
+        make(chan chan bool),
+        make(chan struct{}),
+        make(map[Board]*board),
+        make(map[string]int),
+        load,
+        loadTimeout,
+        maxPerClient,
+    }
+    go l.aggregator()
+    return &l
+}
+
+func (l *Leaderboards) aggregator() {
+    defer close(l.done)
+    for {
+        select {
+        case s := <-l.subscribe:
+            subscriber, err := l.onSubscribe(s.board, s.client)
+            s.cb <- subscribeResult { subscriber, err }
+            close(s.cb)
+        case s := <-l.unsubscribe:
+            l.drop(s)
+        case <-l.changed:
+            for key, b := range l.boards {
+                l.refresh(key, b)
+            }
+        case cb := <-l.closing:
+            for _, b := range l.boards {
+                for s := range b.subscribers {
+                    l.drop(s)
+                }
+            }
+            cb <- true
+            close(cb)
+            return
+        }
+    }
+}
+
+// The first update is the current board
+func (l *Leaderboards) Subscribe(ctx context.Context, b Board, client string) (*Subscriber, error) {
+    cb := make(chan subscribeResult, 1)
+    result, err := deadline.Call(ctx, l.subscribe, subscribeData { b, client, cb }, cb)
+    if err != nil {
+        return nil, err
+    }
+    return result.subscriber, result.err
+}
+
+// Safe to call more than once, and after the service is closed
+func (l *Leaderboards) Unsubscribe(s *Subscriber) {
+    select {
+    case l.unsubscribe <- s:
+    case <-l.done:
+    }
+}
+
+// Non-blocking, safe to call from request handlers
+func (l *Leaderboards) Changed() {
+    select {
+    case l.changed <- true:
+    default:
+    }
+}
+
+// Ends every subscription
+func (l *Leaderboards) Close(ctx context.Context) error {
+    cb := make(chan bool, 1)
+    _, err := deadline.Call(ctx, l.closing, cb, cb)
+    return err
+}
+
+func (l *Leaderboards) onSubscribe(key Board, client string) (*Subscriber, error) {
+    if l.clients[client] >= l.maxPerClient {
+        return nil, ErrTooManySubscriptions
+    }
+    b, found := l.boards[key]
+    if !found {
+        if len(l.boards) >= maxBoards {
+            return nil, ErrTooManyBoards
+        }
+        rows, err := l.loadRanked(key, nil)
+        if err != nil {
+            return nil, err
+        }
+        b = &board { make(map[*Subscriber]bool), rows }
+        l.boards[key] = b
+        boardsGauge.Set(float64(len(l.boards)))
+    }
+    s := &Subscriber { make(chan *Update, subscriberBufferSize), key, client }
+    b.subscribers[s] = true
+    l.clients[client]++
+    subscribersGauge.Add(1)
+    // Nothing moved yet from this subscriber's point of view
+    current := make([]RankedRow, len(b.rows))
+    for i, row := range b.rows {
+        row.PreviousRank = row.Rank
+        current[i] = row
+    }
+    s.Updates <- &Update { key.Field, key.By, current, []int64{} }
+    return s, nil
+}
+
+func (l *Leaderboards) drop(s *Subscriber) {
+    b, found := l.boards[s.board]
+    if !found || !b.subscribers[s] {
+        return
+    }
+    delete(b.subscribers, s)
+    close(s.Updates)
+    if l.clients[s.client]--; l.clients[s.client] <= 0 {
+        delete(l.clients, s.client)
+    }
+    subscribersGauge.Add(-1)
+    if len(b.subscribers) == 0 {
+        delete(l.boards, s.board)
+        boardsGauge.Set(float64(len(l.boards)))
+    }
+}
+
+func (l *Leaderboards) refresh(key Board, b *board) {
+    rows, err := l.loadRanked(key, b.rows)
+    if err != nil {
+        logger.Error("Failed to reload leaderboard", "field", key.Field, "by", key.By, "err", err)
+        return
+    }
+    dropped := droppedIDs(b.rows, rows)
+    if len(dropped) == 0 && sameRanks(b.rows, rows) {
+        return
+    }
+    b.rows = rows
+    update := &Update { key.Field, key.By, rows, dropped }
+    for s := range b.subscribers {
+        select {
+        case s.Updates <- update:
+        default:
+            logger.Warn("Leaderboard subscriber too slow, dropping", "field", key.Field, "by", key.By)
+            l.drop(s)
+        }
+    }
+}
+
+func (l *Leaderboards) loadRanked(key Board, previous []RankedRow) ([]RankedRow, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), l.loadTimeout)
+    defer cancel()
+    rows, err := l.load(ctx, key)
+    if err != nil {
+        return nil, err
+    }
+    return rank(rows, previous), nil
+}
+
+//////////////////////////////////////////////////
+
+// Rows must be sorted by value, descending
+func rank(rows []Row, previous []RankedRow) []RankedRow {
+    previousRanks := make(map[int64]int, len(previous))
+    for _, row := range previous {
+        previousRanks[row.ID] = row.Rank
+    }
+    ranked := make([]RankedRow, 0, len(rows))
+    for i, row := range rows {
+        r := i + 1
+        if i > 0 && row.Value == rows[i - 1].Value {
+            r = ranked[i - 1].Rank
+        }
+        ranked = append(ranked, RankedRow { r, previousRanks[row.ID], row.ID, row.Hiscore })
+    }
+    return ranked
+}
+
+func droppedIDs(previous []RankedRow, current []RankedRow) []int64 {
+    ids := make(map[int64]bool, len(current))
+    for _, row := range current {
+        ids[row.ID] = true
+    }
+    dropped := make([]int64, 0)
+    for _, row := range previous {
+        if !ids[row.ID] {
+            dropped = append(dropped, row.ID)
+        }
+    }
+    return dropped
+}
+
+// Same IDs at the same ranks, hiscores are never updated so the rest is the same too
+func sameRanks(previous []RankedRow, current []RankedRow) bool {
+    if len(previous) != len(current) {
+        return false
+    }
+    ranks := make(map[int64]int, len(previous))
+    for _, row := range previous {
+        ranks[row.ID] = row.Rank
+    }
+    for _, row := range current {
+        if r, found := ranks[row.ID]; !found || r != row.Rank {
+            return false
+        }
+    }
+    return true
+}
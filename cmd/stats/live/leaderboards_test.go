@@ -0,0 +1,187 @@
+package live
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "sync"
+    "testing"
+    "time"
+)
+
+// Boards served from memory, swapped by tests
+type fakeBoards struct {
+    lock sync.Mutex
+    rows map[Board][]Row
+    err error
+}
+
+func (f *fakeBoards) set(b Board, rows []Row) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    f.rows[b] = rows
+}
+
+func (f *fakeBoards) load(ctx context.Context, b Board) ([]Row, error) {
+    f.lock.Lock()
+    defer f.lock.Unlock()
+    return f.rows[b], f.err
+}
+
+func rows(idValues ...int64) []Row {
+    result := make([]Row, 0)
+    for i := 0; i < len(idValues); i += 2 {
+        result = append(result, Row { ID: idValues[i], Value: idValues[i + 1], Hiscore: idValues[i] })
+    }
+    return result
+}
+
+func next(t *testing.T, s *Subscriber) *Update {
+    select {
+    case update := <-s.Updates:
+        return update
+    case <-time.After(time.Second):
+        t.Fatal("Expected an update")
+        return nil
+    }
+}
+
+func expectNone(t *testing.T, s *Subscriber) {
+    select {
+    case update := <-s.Updates:
+        t.Fatalf("Expected no update, got %+v", update)
+    case <-time.After(20 * time.Millisecond):
+    }
+}
+
+var kills = Board { Field: "kills", By: 0 }
+
+func TestUpdates(t *testing.T) {
+    fake := &fakeBoards { rows: make(map[Board][]Row) }
+    fake.set(kills, rows(1, 30, 2, 20, 3, 10))
+    l := MakeLeaderboards(fake.load, time.Second, 2)
+    ctx := context.Background()
+
+    s, err := l.Subscribe(ctx, kills, "1.2.3.4")
+    if err != nil {
+        t.Fatal(err)
+    }
+    initial := next(t, s)
+    if len(initial.Rows) != 3 || initial.Rows[0].ID != 1 || initial.Rows[2].Rank != 3 || initial.Rows[2].PreviousRank != 3 {
+        t.Fatalf("Unexpected initial board %+v", initial)
+    }
+
+    // Unrelated change
+    l.Changed()
+    expectNone(t, s)
+
+    // 4 enters tied for first, 3 drops off
+    fake.set(kills, rows(4, 30, 1, 30, 2, 20))
+    l.Changed()
+    update := next(t, s)
+    if len(update.Dropped) != 1 || update.Dropped[0] != 3 {
+        t.Fatalf("Expected 3 to be dropped, got %v", update.Dropped)
+    }
+    expected := []RankedRow {
+        { 1, 0, 4, int64(4) },
+        { 1, 1, 1, int64(1) },
+        { 3, 2, 2, int64(2) },
+    }
+    for i, row := range update.Rows {
+        if row != expected[i] {
+            t.Fatalf("Expected %+v, got %+v", expected[i], row)
+        }
+    }
+
+    // A second subscriber starts from the latest board, with no changes
+    s2, _ := l.Subscribe(ctx, kills, "1.2.3.4")
+    if update := next(t, s2); update.Rows[0].PreviousRank != 1 || len(update.Dropped) != 0 {
+        t.Fatalf("Unexpected initial board %+v", update)
+    }
+
+    // Failed reloads keep the last board
+    fake.err = errors.New("DB down")
+    l.Changed()
+    expectNone(t, s)
+
+    l.Unsubscribe(s2)
+    if _, ok := <-s2.Updates; ok {
+        t.Fatal("Expected updates to be closed")
+    }
+
+    if err := l.Close(ctx); err != nil {
+        t.Fatal(err)
+    }
+    if _, ok := <-s.Updates; ok {
+        t.Fatal("Expected updates to be closed")
+    }
+    // Handlers unsubscribe after close
+    l.Unsubscribe(s)
+}
+
+func TestSlowSubscriberDropped(t *testing.T) {
+    fake := &fakeBoards { rows: make(map[Board][]Row) }
+    // No aggregator, so each change is seen on its own rather than coalesced
+    l := &Leaderboards {
+        boards: make(map[Board]*board),
+        clients: make(map[string]int),
+        load: fake.load,
+        loadTimeout: time.Second,
+        maxPerClient: 1,
+    }
+    s, err := l.onSubscribe(kills, "1.2.3.4")
+    if err != nil {
+        t.Fatal(err)
+    }
+    // Never read, the initial board already takes a slot
+    for i := int64(1); i <= subscriberBufferSize; i++ {
+        fake.set(kills, rows(i, i))
+        l.refresh(kills, l.boards[kills])
+    }
+    if len(l.boards) != 0 || len(l.clients) != 0 {
+        t.Fatal("Expected the board and client to be removed with its last subscriber")
+    }
+    count := 0
+    for range s.Updates {
+        count++
+    }
+    if count != subscriberBufferSize {
+        t.Fatalf("Expected %d buffered updates before the drop, got %d", subscriberBufferSize, count)
+    }
+}
+
+func TestSubscribeErrors(t *testing.T) {
+    fake := &fakeBoards { rows: make(map[Board][]Row), err: errors.New("DB down") }
+    l := MakeLeaderboards(fake.load, time.Second, 2)
+    ctx := context.Background()
+    if _, err := l.Subscribe(ctx, kills, "1.2.3.4"); err == nil {
+        t.Fatal("Expected load error")
+    }
+
+    // Failed subscriptions don't count against the client
+    fake.err = nil
+    first, _ := l.Subscribe(ctx, kills, "1.2.3.4")
+    if _, err := l.Subscribe(ctx, kills, "1.2.3.4"); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := l.Subscribe(ctx, kills, "1.2.3.4"); err != ErrTooManySubscriptions {
+        t.Fatalf("Expected too many subscriptions, got %v", err)
+    }
+    l.Unsubscribe(first)
+    if _, err := l.Subscribe(ctx, kills, "1.2.3.4"); err != nil {
+        t.Fatalf("Expected a slot after unsubscribing, got %v", err)
+    }
+
+    for i := 1; i < maxBoards; i++ {
+        if _, err := l.Subscribe(ctx, Board { Field: "kills", By: i }, fmt.Sprint(i)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if _, err := l.Subscribe(ctx, Board { Field: "deaths", By: 0 }, "5.6.7.8"); err != ErrTooManyBoards {
+        t.Fatalf("Expected too many boards, got %v", err)
+    }
+}
+
+func TestMain(m *testing.M) {
+    m.Run()
+}
@@ -2,18 +2,28 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/starqi/wi-util-servers/cmd/stats/live"
 	hsql "github.com/starqi/wi-util-servers/cmd/stats/sql"
     decrypt "github.com/starqi/wi-util-servers/cmd/stats/decrypt"
+	"github.com/starqi/wi-util-servers/internal/config"
+	"github.com/starqi/wi-util-servers/internal/cors"
+	"github.com/starqi/wi-util-servers/internal/deadline"
+	"github.com/starqi/wi-util-servers/internal/health"
+	"github.com/starqi/wi-util-servers/internal/logging"
+	"github.com/starqi/wi-util-servers/internal/metrics"
+	"github.com/starqi/wi-util-servers/internal/shutdown"
 )
 
 // Required does not work unless value can contain nil?
@@ -30,73 +40,134 @@ type HiscoreEntry struct {
     ExtraData map[string]string `json:"extraData"`
 }
 
-const maxTopHiscores = 10
-const cullTickerSeconds = 60
-const topNToKeep = 10
-const relativeDbPathEnv = "relativeDbPath"
-const sharedSecretEnv = "sharedSecret"
+const readinessTimeout = 2 * time.Second
 
-var cullColumns = []string{ "kills", "healed", "bounty" }
+var logger = logging.For("main")
+
+var cfg Config
 var hdb *hsql.HiscoresDb
 var cullTicker *time.Ticker
+var cullStop = make(chan struct{})
+var cullDone = make(chan struct{})
 var sharedSecret []byte
 
 func cullTickerFunc() {
+    defer close(cullDone)
     for {
-        <-cullTicker.C
-        _, err := hdb.Transaction(func (tx *hsql.HiscoresDbTransaction) (interface{}, error) {
-            return tx.Cull(topNToKeep, cullColumns)
+        select {
+        case <-cullStop:
+            return
+        case <-cullTicker.C:
+        }
+        // Must not overlap the next tick
+        ctx, cancel := context.WithTimeout(context.Background(), cfg.CullInterval.D())
+        start := time.Now()
+        culled, err := hdb.Transaction(ctx, func (tx *hsql.HiscoresDbTransaction) (interface{}, error) {
+            return tx.Cull(cfg.TopNToKeep, cfg.CullColumns)
         })
+        cancel()
+        cullDuration.Observe(time.Since(start).Seconds())
         if err != nil {
-            log.Print("Failed to cull, rolled back - ", err)
+            logger.Error("Failed to cull, rolled back", "err", err)
+            cullFailures.Inc()
+        } else if rows, ok := culled.(int64); ok {
+            hiscoresCulled.Add(float64(rows))
+            if rows > 0 {
+                leaderboards.Changed()
+            }
         }
     }
 }
 
+// Lets a cull in progress finish
+func stopCull(ctx context.Context) {
+    cullTicker.Stop()
+    close(cullStop)
+    select {
+    case <-cullDone:
+    case <-ctx.Done():
+        logger.Warn("Cull did not finish before shutdown")
+    }
+}
+
+func closeDb(ctx context.Context) {
+    if err := hdb.Close(); err != nil {
+        logger.Error("Failed to close DB", "err", err)
+    }
+}
+
 func main() {
 
-    sharedSecretInput := os.Getenv(sharedSecretEnv)
-    if sharedSecretInput == "" {
-        log.Printf("Missing %s, will not be able to update hiscores", sharedSecretEnv)
-    } else {
-        _sharedSecret, err := base64.StdEncoding.DecodeString(sharedSecretInput)
-        if err != nil {
-            log.Print("Failed to parse shared secret, will not be able to update hiscores")
-        } else {
-            sharedSecret = _sharedSecret
-            log.Print("Found shared secret")
-        }
+    cfg = defaultConfig()
+    args, err := config.Load("stats", &cfg, os.Args[1:])
+    if err != nil {
+        logging.Fatal(logger, "Invalid config", "err", err)
     }
+    if exit, err := config.Command(args, &cfg, os.Stdout); err != nil {
+        logging.Fatal(logger, "Invalid config", "err", err)
+    } else if exit {
+        return
+    }
+    // Already validated
+    logConfig, _ := cfg.logging()
+    logging.Setup(logConfig)
 
-    relativeDbPath := os.Getenv(relativeDbPathEnv)
-    if relativeDbPath == "" {
-        log.Fatalf("Missing %s", relativeDbPathEnv)
+    if sharedSecret, _ = cfg.sharedSecret(); sharedSecret == nil {
+        logger.Warn("Missing sharedSecret, will not be able to update hiscores")
+    } else {
+        logger.Info("Found shared secret")
     }
 
-    _hdb, err := hsql.MakeHiscoresDb(relativeDbPath)
+    _hdb, err := hsql.MakeHiscoresDb(cfg.RelativeDbPath)
     hdb = _hdb
     if err != nil {
-        log.Fatal("Could not access DB", err)
+        logging.Fatal(logger, "Could not access DB", "err", err)
+    }
+    if err := hdb.Instrument(dbQueryDuration); err != nil {
+        logging.Fatal(logger, "Could not instrument DB", "err", err)
     }
 
-    cullTicker = time.NewTicker(cullTickerSeconds * time.Second)
+    leaderboards = live.MakeLeaderboards(loadBoard, cfg.RequestTimeout.D(), cfg.StreamMaxPerClient)
+    cullTicker = time.NewTicker(cfg.CullInterval.D())
     go cullTickerFunc()
 
-    // TODO CORS is for ease of local testing not behind Nginx, or else Chrome blocks requests to different ports
-    router := gin.Default()
-    router.Use(func (c *gin.Context) {
-        c.Header("Access-Control-Allow-Origin", "*")
-        c.Header("Access-Control-Allow-Methods", "*")
-        c.Header("Access-Control-Allow-Headers", "Authorization, *")
-        if c.Request.Method == "OPTIONS" {
-            c.AbortWithStatus(http.StatusNoContent)
-        } else {
-            c.Next()
-        }
-    })
+    // Already validated
+    corsOrigins, _ := cors.MakeAllowlist(cfg.CorsOrigins)
+    corsPolicy := cors.MakePolicy(corsOrigins, cfg.CorsHeaders, cfg.CorsMaxAge.D())
+
+    router := gin.New()
+    // Nil trusts none, otherwise anyone could pick their client IP
+    if err := router.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+        logging.Fatal(logger, "Invalid trusted proxies", "err", err)
+    }
+    router.Use(gin.Recovery(), logging.Middleware(logging.For("http")))
+    router.Use(corsPolicy.Middleware())
+    router.Use(metrics.Middleware(metrics.Default))
     router.POST("hiscore", postHiscore)
     router.GET("hiscore/top", getTopHiscores)
-    router.Run() // Will use PORT env var
+    router.GET(streamRoute, getHiscoreStream)
+    router.GET("healthz", health.Liveness)
+    router.GET("readyz", health.Readiness(readinessTimeout, readinessChecks()...))
+    // Private, via Nginx
+    router.GET("metrics", metrics.Handler(metrics.Default))
+    if err := corsPolicy.Preflight(router); err != nil {
+        logging.Fatal(logger, "Invalid CORS rules", "err", err)
+    }
+    handler := deadline.Handler(router, cfg.RequestTimeout.D(), streamRoute)
+    if err := shutdown.Run(handler, fmt.Sprintf(":%d", cfg.Port), cfg.ShutdownTimeout.D(), stopCull, closeLeaderboards, closeDb); err != nil {
+        logging.Fatal(logger, "Could not serve", "err", err)
+    }
+}
+
+func readinessChecks() []health.Check {
+    // Posts are rejected without it
+    secretCheck := health.Check { Name: "sharedSecret", Run: func (ctx context.Context) error {
+        if sharedSecret == nil {
+            return errors.New("Shared secret not loaded")
+        }
+        return nil
+    }}
+    return append(hdb.Checks(cfg.MigrationsDir), secretCheck)
 }
 
 func getTopHiscores(c *gin.Context) {
@@ -109,8 +180,8 @@ func getTopHiscores(c *gin.Context) {
 
     _num := c.Query("num")
     num, err := strconv.Atoi(_num)
-    if err != nil || num > maxTopHiscores {
-        num = maxTopHiscores
+    if err != nil || num > cfg.MaxTopHiscores {
+        num = cfg.MaxTopHiscores
     }
 
     _by := c.Query("by")
@@ -120,18 +191,22 @@ func getTopHiscores(c *gin.Context) {
     }
 
     // Pass "by" (the time group) as-is, no meaning here
-    result, err := hdb.Transaction(func (tx *hsql.HiscoresDbTransaction) (interface{}, error) {
+    result, err := hdb.Transaction(c.Request.Context(), func (tx *hsql.HiscoresDbTransaction) (interface{}, error) {
         return tx.Select(num, field, by)
     })
-    if err != nil {
-        log.Print("Failed to get top hiscores - ", err)
+    if deadline.IsExceeded(err) {
+        logger.WarnContext(c.Request.Context(), "Get top hiscores timed out")
+        deadline.Abort(c)
+        return
+    } else if err != nil {
+        logger.ErrorContext(c.Request.Context(), "Failed to get top hiscores", "err", err)
         c.Status(http.StatusInternalServerError)
         return
     }
 
     hiscores, ok := result.([]hsql.HiscoreWithMap)
     if !ok {
-        log.Print("Unexpected cast error")
+        logger.ErrorContext(c.Request.Context(), "Unexpected cast error")
         c.Status(http.StatusInternalServerError)
         return
     }
@@ -142,7 +217,7 @@ func getTopHiscores(c *gin.Context) {
 func postHiscore(c *gin.Context) {
     rawData, err := ioutil.ReadAll(c.Request.Body)
     if err != nil {
-        log.Print("Body parse error ", err)
+        logger.InfoContext(c.Request.Context(), "Body parse error", "err", err)
         c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
         return
     }
@@ -153,19 +228,21 @@ func postHiscore(c *gin.Context) {
     n, err := base64.StdEncoding.Decode(binaryData, rawData)
     binaryData = binaryData[:n]
     if err != nil {
-        log.Print("Base64 error ", err)
+        logger.InfoContext(c.Request.Context(), "Base64 error", "err", err)
+        decryptFailures.Inc("base64")
         c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
         return
     }
 
     payload, err := decrypt.DecryptHandlePostedHiscores(sharedSecret, binaryData)
     if err != nil {
-        log.Print("Decrypt failed! ", err, " ", string(rawData))
+        logger.WarnContext(c.Request.Context(), "Decrypt failed", "err", err, "body", string(rawData))
+        decryptFailures.Inc(decryptFailureReason(err))
         c.AbortWithStatus(http.StatusUnauthorized)
         return
     }
     payloadStr := string(payload)
-    log.Print(payloadStr)
+    logger.DebugContext(c.Request.Context(), "Posted hiscores", "payload", payloadStr)
 
     var hiscores []HiscoreEntry
     err = json.Unmarshal(payload, &hiscores)
@@ -174,15 +251,23 @@ func postHiscore(c *gin.Context) {
         return
     }
 
-    rowsAffected, err := hdb.Transaction(func (tx *hsql.HiscoresDbTransaction) (interface{}, error) {
+    rowsAffected, err := hdb.Transaction(c.Request.Context(), func (tx *hsql.HiscoresDbTransaction) (interface{}, error) {
         return tx.Insert(jsonHiscoresToDb(hiscores))
     })
-    if err != nil {
-        log.Print("Failed to POST - ", err)
+    if deadline.IsExceeded(err) {
+        logger.WarnContext(c.Request.Context(), "Post hiscores timed out")
+        deadline.Abort(c)
+        return
+    } else if err != nil {
+        logger.ErrorContext(c.Request.Context(), "Failed to post hiscores", "err", err)
         c.Status(http.StatusInternalServerError)
         return
     }
-    log.Printf("Posted %d rows", rowsAffected)
+    logger.InfoContext(c.Request.Context(), "Posted hiscores", "rows", rowsAffected)
+    if rows, ok := rowsAffected.(int64); ok {
+        hiscoresInserted.Add(float64(rows))
+    }
+    leaderboards.Changed()
     c.Status(http.StatusOK)
 }
 
@@ -0,0 +1,97 @@
+package main
+
+import (
+    "encoding/base64"
+    "time"
+	"github.com/starqi/wi-util-servers/internal/config"
+	"github.com/starqi/wi-util-servers/internal/cors"
+	"github.com/starqi/wi-util-servers/internal/logging"
+)
+
+// Names are also the env vars and flags, see `config.Load`
+type Config struct {
+    Port int `yaml:"port" env:"PORT"`
+    RelativeDbPath string `yaml:"relativeDbPath"`
+    // Base64 AES key shared with game servers, hiscores can't be posted without it
+    SharedSecret string `yaml:"sharedSecret" secret:"true"`
+    // Eg. https://example.com or https://*.example.com, any origin if empty outside of GIN_MODE=release
+    CorsOrigins []string `yaml:"corsOrigins"`
+    // Request headers allowed cross-origin
+    CorsHeaders []string `yaml:"corsHeaders"`
+    CorsMaxAge config.Duration `yaml:"corsMaxAge"`
+    // Cap on `num` for top hiscores
+    MaxTopHiscores int `yaml:"maxTopHiscores"`
+    // Every interval, rows outside the top N of every cull column are deleted
+    CullInterval config.Duration `yaml:"cullInterval"`
+    TopNToKeep int `yaml:"topNToKeep"`
+    // Also the only fields with live leaderboards, since other fields' boards are not kept
+    CullColumns []string `yaml:"cullColumns"`
+    // Open leaderboard streams per client IP
+    StreamMaxPerClient int `yaml:"streamMaxPerClient"`
+    // CIDRs or IPs of reverse proxies trusted to set X-Forwarded-For, none if empty so client IPs can't be spoofed
+    TrustedProxies []string `yaml:"trustedProxies"`
+    // After which requests waiting on the DB get a 503
+    RequestTimeout config.Duration `yaml:"requestTimeout"`
+    // To finish in-flight requests and the cull on SIGTERM
+    ShutdownTimeout config.Duration `yaml:"shutdownTimeout"`
+    // golang-migrate files, for the readiness schema check
+    MigrationsDir string `yaml:"migrationsDir"`
+    LogLevel string `yaml:"logLevel"`
+    // Eg. "hiscores=debug"
+    LogLevels string `yaml:"logLevels"`
+    // Off to log secrets and payloads
+    LogRedact bool `yaml:"logRedact"`
+}
+
+func defaultConfig() Config {
+    return Config {
+        Port: 8080,
+        CorsHeaders: []string { "Content-Type" },
+        CorsMaxAge: config.Duration(10 * time.Minute),
+        MaxTopHiscores: 10,
+        CullInterval: config.Duration(time.Minute),
+        TopNToKeep: 10,
+        CullColumns: []string { "kills", "healed", "bounty" },
+        StreamMaxPerClient: 4,
+        RequestTimeout: config.Duration(5 * time.Second),
+        ShutdownTimeout: config.Duration(10 * time.Second),
+        MigrationsDir: "./db/stats-migrations",
+        LogLevel: "info",
+        LogRedact: true,
+    }
+}
+
+func (c *Config) Validate() error {
+    var p config.Problems
+    p.Check(c.Port > 0 && c.Port < 65536, "port", "must be between 1 and 65535")
+    p.Check(c.RelativeDbPath != "", "relativeDbPath", "is required")
+    if c.SharedSecret != "" {
+        _, err := c.sharedSecret()
+        p.Check(err == nil, "sharedSecret", "must be base64")
+    }
+    _, err := cors.MakeAllowlist(c.CorsOrigins)
+    p.Add("corsOrigins", err)
+    p.Check(c.CorsMaxAge >= 0, "corsMaxAge", "must not be negative")
+    p.Check(c.MaxTopHiscores > 0, "maxTopHiscores", "must be positive")
+    p.Check(c.CullInterval > 0, "cullInterval", "must be positive")
+    p.Check(c.TopNToKeep >= c.MaxTopHiscores, "topNToKeep", "must be at least maxTopHiscores")
+    p.Check(len(c.CullColumns) > 0, "cullColumns", "must not be empty")
+    p.Check(c.StreamMaxPerClient > 0, "streamMaxPerClient", "must be positive")
+    p.Check(c.RequestTimeout > 0, "requestTimeout", "must be positive")
+    p.Check(c.ShutdownTimeout > 0, "shutdownTimeout", "must be positive")
+    _, err = c.logging()
+    p.Check(err == nil, "logLevel and logLevels", "must be debug, info, warn or error")
+    return p.Err()
+}
+
+// Nil if not set
+func (c *Config) sharedSecret() ([]byte, error) {
+    if c.SharedSecret == "" {
+        return nil, nil
+    }
+    return base64.StdEncoding.DecodeString(c.SharedSecret)
+}
+
+func (c *Config) logging() (logging.Config, error) {
+    return logging.MakeConfig(c.LogLevel, c.LogLevels, c.LogRedact)
+}
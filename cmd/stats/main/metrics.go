@@ -0,0 +1,27 @@
+package main
+
+import (
+	"errors"
+	decrypt "github.com/starqi/wi-util-servers/cmd/stats/decrypt"
+	"github.com/starqi/wi-util-servers/internal/metrics"
+)
+
+var hiscoresInserted = metrics.Default.Counter("hiscores_inserted_total", "Hiscore rows inserted")
+var hiscoresCulled = metrics.Default.Counter("hiscores_culled_total", "Hiscore rows culled")
+var cullDuration = metrics.Default.Histogram("hiscores_cull_duration_seconds", "Cull transaction durations", metrics.DefaultBuckets)
+var cullFailures = metrics.Default.Counter("hiscores_cull_failures_total", "Culls rolled back")
+var decryptFailures = metrics.Default.Counter("hiscores_decrypt_failures_total", "Rejected hiscore posts", "reason")
+var dbQueryDuration = metrics.Default.Histogram("db_query_duration_seconds", "DB statement durations", metrics.DefaultBuckets, "operation")
+
+func decryptFailureReason(err error) string {
+    switch {
+    case errors.Is(err, decrypt.ErrNoSharedKey):
+        return "no_key"
+    case errors.Is(err, decrypt.ErrTooShort):
+        return "too_short"
+    case errors.Is(err, decrypt.ErrAuthentication):
+        return "authentication"
+    default:
+        return "invalid_key"
+    }
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "slices"
+    "strconv"
+    "time"
+    "github.com/gin-gonic/gin"
+	"github.com/starqi/wi-util-servers/cmd/stats/live"
+	hsql "github.com/starqi/wi-util-servers/cmd/stats/sql"
+	"github.com/starqi/wi-util-servers/internal/deadline"
+	"github.com/starqi/wi-util-servers/internal/shutdown"
+)
+
+// Live leaderboards over Server-Sent Events, so the lobby doesn't have to poll hiscore/top
+
+const streamRoute = "/hiscore/stream"
+// Comment lines, so proxies don't time out idle streams
+const keepaliveInterval = 15 * time.Second
+
+var leaderboards *live.Leaderboards
+
+func loadBoard(ctx context.Context, board live.Board) ([]live.Row, error) {
+    result, err := hdb.Transaction(ctx, func (tx *hsql.HiscoresDbTransaction) (interface{}, error) {
+        return tx.Select(cfg.MaxTopHiscores, board.Field, board.By)
+    })
+    if err != nil {
+        return nil, err
+    }
+    hiscores, ok := result.([]hsql.HiscoreWithMap)
+    if !ok {
+        return nil, errors.New("Unexpected cast error")
+    }
+    entries := dbHiscoresToJson(hiscores)
+    rows := make([]live.Row, 0, len(hiscores))
+    for i, h := range hiscores {
+        rows = append(rows, live.Row { ID: h.Hiscore.ID, Value: h.ValueMap[board.Field], Hiscore: entries[i] })
+    }
+    return rows, nil
+}
+
+func closeLeaderboards(ctx context.Context) {
+    if err := leaderboards.Close(ctx); err != nil {
+        logger.Error("Leaderboards did not close", "err", err)
+    }
+}
+
+// Same params as hiscore/top except num, and the field must be a cull column.
+// Sends a "board" event with the current board, then one whenever it changes.
+func getHiscoreStream(c *gin.Context) {
+    field := c.Query("field")
+    if !slices.Contains(cfg.CullColumns, field) {
+        c.Status(http.StatusBadRequest)
+        c.Writer.Write([]byte("Missing or unknown field param"))
+        return
+    }
+    by, err := strconv.Atoi(c.Query("by"))
+    if err != nil {
+        by = 0
+    }
+    if by < 0 || by > hsql.AllTime {
+        c.Status(http.StatusBadRequest)
+        c.Writer.Write([]byte("Invalid by param"))
+        return
+    }
+
+    // Exempt from the request deadline, which would end the stream
+    ctx, cancel := context.WithTimeout(c.Request.Context(), cfg.RequestTimeout.D())
+    subscriber, err := leaderboards.Subscribe(ctx, live.Board { Field: field, By: by }, c.ClientIP())
+    cancel()
+    if err == live.ErrTooManySubscriptions {
+        logger.InfoContext(c.Request.Context(), "Too many leaderboard streams", "clientIp", c.ClientIP())
+        c.AbortWithStatus(http.StatusTooManyRequests)
+        return
+    } else if deadline.IsExceeded(err) || err == live.ErrTooManyBoards {
+        logger.WarnContext(c.Request.Context(), "Leaderboard subscribe failed", "field", field, "err", err)
+        deadline.Abort(c)
+        return
+    } else if err != nil {
+        logger.ErrorContext(c.Request.Context(), "Failed to load leaderboard", "field", field, "err", err)
+        c.Status(http.StatusInternalServerError)
+        return
+    }
+    defer leaderboards.Unsubscribe(subscriber)
+
+    c.Header("Content-Type", "text/event-stream")
+    c.Header("Cache-Control", "no-cache")
+    // Nginx would otherwise buffer events
+    c.Header("X-Accel-Buffering", "no")
+    c.Status(http.StatusOK)
+    c.Writer.Flush()
+
+    keepalive := time.NewTicker(keepaliveInterval)
+    defer keepalive.Stop()
+    for {
+        select {
+        case update, ok := <-subscriber.Updates:
+            if !ok {
+                return
+            }
+            c.SSEvent("board", update)
+        case <-keepalive.C:
+            c.Writer.Write([]byte(": keepalive\n\n"))
+        case <-c.Request.Context().Done():
+            return
+        case <-shutdown.Draining():
+            return
+        }
+        c.Writer.Flush()
+    }
+}
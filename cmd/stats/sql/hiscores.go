@@ -1,12 +1,15 @@
 package sql
 
 import (
+    "context"
     "time"
     "errors"
-    "log"
     "gorm.io/gorm"
     "gorm.io/driver/sqlite"
     "sort"
+	"github.com/starqi/wi-util-servers/internal/health"
+	"github.com/starqi/wi-util-servers/internal/logging"
+	"github.com/starqi/wi-util-servers/internal/metrics"
 )
 
 //////////////////////////////////////////////////
@@ -55,6 +58,8 @@ func (r *MaxSortedHiscores) Swap(i, j int) {
 
 //////////////////////////////////////////////////
 
+var logger = logging.For("hiscores")
+
 const secondsPerDay = 24 * 3600
 
 var timeGroupSeconds = [3]int64{ secondsPerDay, 7 * secondsPerDay, 30 * secondsPerDay }
@@ -90,27 +95,49 @@ func MakeHiscoresDb(sqliteDbPath string) (*HiscoresDb, error) {
     return &HiscoresDb { db }, nil
 }
 
-func (hdb *HiscoresDb) MakeTransaction() HiscoresDbTransaction {
-    return HiscoresDbTransaction { hdb: hdb, db: hdb.db.Begin() }
+// Writable and migrated to the latest file in the directory
+func (hdb *HiscoresDb) Checks(migrationsDir string) []health.Check {
+    return []health.Check { health.Writable(hdb.db), health.Schema(hdb.db, migrationsDir) }
+}
+
+// Query durations by operation
+func (hdb *HiscoresDb) Instrument(durations *metrics.Histogram) error {
+    return metrics.InstrumentGorm(hdb.db, durations)
+}
+
+func (hdb *HiscoresDb) Close() error {
+    db, err := hdb.db.DB()
+    if err != nil {
+        return err
+    }
+    return db.Close()
+}
+
+// Every statement in the transaction fails once the context is done
+func (hdb *HiscoresDb) MakeTransaction(ctx context.Context) HiscoresDbTransaction {
+    return HiscoresDbTransaction { hdb: hdb, db: hdb.db.WithContext(ctx).Begin() }
 }
 
 func (hdb *HiscoresDbTransaction) Rollback() {
     hdb.db.Rollback()
 }
 
-func (hdb *HiscoresDbTransaction) Commit() {
-    hdb.db.Commit()
+// Fails if the context was cancelled before the commit, then nothing was written
+func (hdb *HiscoresDbTransaction) Commit() error {
+    return hdb.db.Commit().Error
 }
 
-func (hdb *HiscoresDb) Transaction(do func (tx *HiscoresDbTransaction) (interface{}, error)) (interface{}, error) {
-    tx := hdb.MakeTransaction()
+func (hdb *HiscoresDb) Transaction(ctx context.Context, do func (tx *HiscoresDbTransaction) (interface{}, error)) (interface{}, error) {
+    tx := hdb.MakeTransaction(ctx)
     result, err := do(&tx)
     if err != nil {
         tx.Rollback()
-    } else {
-        tx.Commit()
+        return result, err
+    }
+    if err := tx.Commit(); err != nil {
+        return nil, err
     }
-    return result, err
+    return result, nil
 }
 
 // TODO More tests for time groups
@@ -119,7 +146,7 @@ func (hdb *HiscoresDbTransaction) Cull(topNToKeep int, columns []string) (int64,
         return 0, errors.New("Column count must be > 0")
     }
 
-    log.Printf("Starting cull for top %d, columns %v", topNToKeep, columns)
+    logger.Info("Starting cull", "topN", topNToKeep, "columns", columns)
 
     now := time.Now().Unix()
     pks := make([]int64, 0)
@@ -145,7 +172,7 @@ func (hdb *HiscoresDbTransaction) Cull(topNToKeep int, columns []string) (int64,
         return 0, result.Error
     }
 
-    log.Printf("Culled %d rows", result.RowsAffected)
+    logger.Info("Culled", "rows", result.RowsAffected)
     return result.RowsAffected, nil
 }
 
@@ -1,6 +1,7 @@
 package sql
 
 import (
+    "context"
     "testing"
     "time"
 )
@@ -56,7 +57,7 @@ var hdb *HiscoresDb
 
 // For manual tests
 func _TestInsertData(t *testing.T) {
-    tx := hdb.MakeTransaction()
+    tx := hdb.MakeTransaction(context.Background())
     tx.Insert([]Hiscore {
         {
             Name: "Bob",
@@ -88,7 +89,7 @@ func _TestInsertData(t *testing.T) {
 }
 
 func TestCullWeeklyAllTime(t *testing.T) {
-    tx := hdb.MakeTransaction()
+    tx := hdb.MakeTransaction(context.Background())
     defer tx.Rollback()
     tx.Insert(testData1)
 
@@ -114,7 +115,7 @@ func TestCullWeeklyAllTime(t *testing.T) {
 }
 
 func TestCullAllTime(t *testing.T) {
-    tx := hdb.MakeTransaction()
+    tx := hdb.MakeTransaction(context.Background())
     defer tx.Rollback()
     tx.Insert([]Hiscore {
         {
@@ -171,7 +172,7 @@ func TestCullAllTime(t *testing.T) {
 }
 
 func TestInsertAndSelectTopVsWeekly(t *testing.T) {
-    tx := hdb.MakeTransaction()
+    tx := hdb.MakeTransaction(context.Background())
     defer tx.Rollback()
 
     tx.Insert(testData1)
@@ -202,7 +203,7 @@ func TestInsertAndSelectTopVsWeekly(t *testing.T) {
 }
 
 func TestInsertAndSelectTopAllTime(t *testing.T) {
-    tx := hdb.MakeTransaction()
+    tx := hdb.MakeTransaction(context.Background())
     defer tx.Rollback()
     tx.Insert([]Hiscore {
         {
@@ -280,6 +281,34 @@ func TestInsertAndSelectTopAllTime(t *testing.T) {
     }
 }
 
+func TestCancelledTransaction(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    _, err := hdb.Transaction(ctx, func (tx *HiscoresDbTransaction) (interface{}, error) {
+        return tx.Select(5, "Kills", AllTime)
+    })
+    if err != context.Canceled {
+        t.Fatalf("Expected cancelled, got %v", err)
+    }
+}
+
+func TestCancelledBeforeCommit(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    _, err := hdb.Transaction(ctx, func (tx *HiscoresDbTransaction) (interface{}, error) {
+        inserted, err := tx.Insert([]Hiscore { { Name: "Uncommitted", CreatedAt: now } })
+        cancel()
+        return inserted, err
+    })
+    if err == nil {
+        t.Fatal("Expected the commit to fail")
+    }
+    var count int64
+    hdb.db.Model(&Hiscore{}).Where("name = ?", "Uncommitted").Count(&count)
+    if count != 0 {
+        t.Fatalf("Expected nothing written, got %d rows", count)
+    }
+}
+
 func TestMain(m *testing.M) {
     hdb = RemakeTestDb()
     m.Run()
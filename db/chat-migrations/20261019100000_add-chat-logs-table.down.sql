@@ -0,0 +1 @@
+drop table chat_logs;
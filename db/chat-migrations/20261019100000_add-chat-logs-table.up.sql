@@ -0,0 +1,12 @@
+create table chat_logs (
+    id integer not null primary key autoincrement,
+    room text not null,
+    token text not null,
+    player_name text not null,
+    text text not null,
+    created_at integer not null
+);
+
+create index chat_logs_room_created_at_idx on chat_logs (room, created_at);
+create index chat_logs_player_name_idx on chat_logs (player_name);
+create index chat_logs_created_at_idx on chat_logs (created_at);
@@ -0,0 +1,19 @@
+create table reports (
+    id integer not null primary key autoincrement,
+    room text not null,
+    reporter_token text not null,
+    reporter_name text not null,
+    reported_token text not null,
+    reported_name text not null,
+    reason text not null,
+    -- JSON snapshots at the time of the report
+    messages blob not null,
+    reporter_session blob not null,
+    reported_session blob not null,
+    created_at integer not null,
+    resolved integer not null default 0,
+    resolution text not null default '',
+    resolved_at integer not null default 0
+);
+
+create index reports_resolved_created_at_idx on reports (resolved, created_at);
@@ -0,0 +1,3 @@
+drop table session_bans;
+drop table session_revocations;
+drop table sessions;
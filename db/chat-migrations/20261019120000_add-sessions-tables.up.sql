@@ -0,0 +1,27 @@
+create table sessions (
+    id text not null primary key,
+    token text not null,
+    is_in_game integer not null,
+    game_instance text not null,
+    player_name text not null,
+    expiry integer not null,
+    muted_until integer not null default 0
+);
+
+create index sessions_expiry_idx on sessions (expiry);
+
+create table session_revocations (
+    id text not null primary key,
+    expiry integer not null
+);
+
+-- Exactly one of session ID or player key is non-empty
+create table session_bans (
+    session_id text not null,
+    -- Lower case player name
+    player_key text not null,
+    player_name text not null,
+    -- Zero if permanent
+    until integer not null,
+    primary key (session_id, player_key)
+);
@@ -0,0 +1 @@
+alter table sessions drop column max_expiry;
@@ -0,0 +1,2 @@
+-- Zero if unbounded, which existing sessions are
+alter table sessions add column max_expiry integer not null default 0;
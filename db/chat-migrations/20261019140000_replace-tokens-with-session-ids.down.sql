@@ -0,0 +1,5 @@
+drop index chat_logs_session_id_idx;
+alter table chat_logs rename column session_id to token;
+
+alter table reports rename column reporter_session_id to reporter_token;
+alter table reports rename column reported_session_id to reported_token;
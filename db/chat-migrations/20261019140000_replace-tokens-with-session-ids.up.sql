@@ -0,0 +1,13 @@
+-- Tokens are bearer credentials, so logs and reports keep the stable session ID instead.
+-- Chat log tokens are cleared since their session IDs are not recoverable here, reports have them in the snapshots.
+alter table chat_logs rename column token to session_id;
+update chat_logs set session_id = '';
+create index chat_logs_session_id_idx on chat_logs (session_id);
+
+alter table reports rename column reporter_token to reporter_session_id;
+alter table reports rename column reported_token to reported_session_id;
+update reports set
+    reporter_session_id = coalesce(json_extract(cast(reporter_session as text), '$.id'), ''),
+    reported_session_id = coalesce(json_extract(cast(reported_session as text), '$.id'), ''),
+    reporter_session = json_remove(cast(reporter_session as text), '$.token'),
+    reported_session = json_remove(cast(reported_session as text), '$.token');
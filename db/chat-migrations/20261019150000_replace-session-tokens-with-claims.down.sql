@@ -0,0 +1,4 @@
+delete from sessions;
+alter table sessions drop column version;
+alter table sessions drop column issued_at;
+alter table sessions add column token text not null default '';
@@ -0,0 +1,7 @@
+-- Tokens are bearer credentials, so only their claims are kept and tokens are re-signed on restore.
+-- Existing sessions are dropped since their issue time and version are only in the token, so those players sign in again.
+delete from sessions;
+alter table sessions drop column token;
+-- Unix seconds
+alter table sessions add column issued_at integer not null default 0;
+alter table sessions add column version integer not null default 0;
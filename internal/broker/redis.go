@@ -0,0 +1,288 @@
+package broker
+
+import (
+    "bufio"
+    "bytes"
+    "errors"
+    "fmt"
+    "io"
+    "net"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Minimal Redis pub/sub client, speaking just enough RESP for AUTH, PUBLISH and SUBSCRIBE.
+// One connection for publishing, and one per subscription since subscribed connections can't publish.
+
+// Publishes beyond this are dropped while Redis is slow or down
+const publishQueueSize = 1000
+const dialTimeout = 5 * time.Second
+var reconnectDelay = time.Second
+
+type redisPublish struct {
+    topic string
+    payload []byte
+}
+
+type RedisBroker struct {
+    addr string
+    // Empty username for the default user, empty password for no AUTH
+    username string
+    password string
+    publishes chan redisPublish
+    done chan struct{}
+    mutex sync.Mutex
+    // Closed on close, to unblock reads
+    conns map[net.Conn]bool
+    closed bool
+}
+
+// Connects lazily, and reconnects forever until closed
+func MakeRedisBroker(addr string, username string, password string) *RedisBroker {
+    b := &RedisBroker {
+        addr: addr,
+        username: username,
+        password: password,
+        publishes: make(chan redisPublish, publishQueueSize),
+        done: make(chan struct{}),
+        conns: make(map[net.Conn]bool),
+    }
+    go b.publisher()
+    return b
+}
+
+func (b *RedisBroker) dial() (net.Conn, *bufio.Reader, error) {
+    conn, err := net.DialTimeout("tcp", b.addr, dialTimeout)
+    if err != nil {
+        return nil, nil, err
+    }
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    if b.closed {
+        conn.Close()
+        return nil, nil, ErrClosed
+    }
+    b.conns[conn] = true
+    return conn, bufio.NewReader(conn), nil
+}
+
+// Connects and authenticates, before any other command on the connection
+func (b *RedisBroker) connect() (net.Conn, *bufio.Reader, error) {
+    conn, reader, err := b.dial()
+    if err != nil || b.password == "" {
+        return conn, reader, err
+    }
+    if b.username == "" {
+        err = writeCommand(conn, "AUTH", b.password)
+    } else {
+        err = writeCommand(conn, "AUTH", b.username, b.password)
+    }
+    if err == nil {
+        _, err = readValue(reader)
+    }
+    if err != nil {
+        b.hangUp(conn)
+        return nil, nil, err
+    }
+    return conn, reader, nil
+}
+
+func (b *RedisBroker) hangUp(conn net.Conn) {
+    b.mutex.Lock()
+    delete(b.conns, conn)
+    b.mutex.Unlock()
+    conn.Close()
+}
+
+func (b *RedisBroker) isClosed() bool {
+    select {
+    case <-b.done:
+        return true
+    default:
+        return false
+    }
+}
+
+func (b *RedisBroker) Publish(topic string, payload []byte) {
+    if b.isClosed() {
+        return
+    }
+    select {
+    case b.publishes <- redisPublish { topic, payload }:
+    default:
+        logger.Warn("Redis publish queue full, dropping message", "topic", topic)
+    }
+}
+
+// Messages that fail are dropped, not retried
+func (b *RedisBroker) publisher() {
+    var conn net.Conn
+    var reader *bufio.Reader
+    for {
+        select {
+        case <-b.done:
+            return
+        case p := <-b.publishes:
+            if conn == nil {
+                var err error
+                if conn, reader, err = b.connect(); err != nil {
+                    logger.Error("Redis publish connection failed", "err", err)
+                    continue
+                }
+            }
+            err := writeCommand(conn, "PUBLISH", p.topic, string(p.payload))
+            if err == nil {
+                _, err = readValue(reader)
+            }
+            if err != nil {
+                logger.Error("Redis publish failed", "err", err)
+                b.hangUp(conn)
+                conn = nil
+            }
+        }
+    }
+}
+
+func (b *RedisBroker) subscribe(topic string) (net.Conn, *bufio.Reader, error) {
+    conn, reader, err := b.connect()
+    if err != nil {
+        return nil, nil, err
+    }
+    err = writeCommand(conn, "SUBSCRIBE", topic)
+    if err == nil {
+        // Confirmation, ["subscribe", topic, count]
+        _, err = readValue(reader)
+    }
+    if err != nil {
+        b.hangUp(conn)
+        return nil, nil, err
+    }
+    return conn, reader, nil
+}
+
+// Fails if the first connection fails, after that reconnects in the background.
+// Messages published while reconnecting are missed.
+func (b *RedisBroker) Subscribe(topic string) (<-chan []byte, error) {
+    conn, reader, err := b.subscribe(topic)
+    if err != nil {
+        return nil, err
+    }
+    out := make(chan []byte, subscriberBufferSize)
+    go b.subscriber(topic, conn, reader, out)
+    return out, nil
+}
+
+func (b *RedisBroker) subscriber(topic string, conn net.Conn, reader *bufio.Reader, out chan []byte) {
+    defer close(out)
+    for {
+        value, err := readValue(reader)
+        if err != nil {
+            b.hangUp(conn)
+            if b.isClosed() {
+                return
+            }
+            logger.Warn("Redis subscription lost, reconnecting", "topic", topic, "err", err)
+            for {
+                select {
+                case <-b.done:
+                    return
+                case <-time.After(reconnectDelay):
+                }
+                if conn, reader, err = b.subscribe(topic); err == nil {
+                    break
+                }
+                logger.Error("Redis resubscribe failed", "topic", topic, "err", err)
+            }
+            continue
+        }
+
+        // ["message", topic, payload]
+        if message, ok := value.([]interface{}); ok && len(message) == 3 && message[0] == "message" {
+            if payload, ok := message[2].(string); ok {
+                deliver(out, topic, []byte(payload))
+            }
+        }
+    }
+}
+
+func (b *RedisBroker) Close() error {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    if b.closed {
+        return nil
+    }
+    b.closed = true
+    close(b.done)
+    for conn := range b.conns {
+        conn.Close()
+    }
+    return nil
+}
+
+//////////////////////////////////////////////////
+// RESP
+
+// Commands are arrays of bulk strings
+func writeCommand(w io.Writer, args ...string) error {
+    var buf bytes.Buffer
+    fmt.Fprintf(&buf, "*%d\r\n", len(args))
+    for _, arg := range args {
+        fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+    }
+    _, err := w.Write(buf.Bytes())
+    return err
+}
+
+// Simple and bulk strings are strings, integers are int64, arrays are []interface{}, nulls are nil.
+// Error replies are returned as errors.
+func readValue(r *bufio.Reader) (interface{}, error) {
+    line, err := r.ReadString('\n')
+    if err != nil {
+        return nil, err
+    }
+    line = strings.TrimSuffix(line, "\r\n")
+    if len(line) == 0 {
+        return nil, errors.New("Empty RESP line")
+    }
+
+    switch line[0] {
+    case '+':
+        return line[1:], nil
+    case '-':
+        return nil, errors.New("Redis error " + line[1:])
+    case ':':
+        return strconv.ParseInt(line[1:], 10, 64)
+    case '$':
+        n, err := strconv.Atoi(line[1:])
+        if err != nil {
+            return nil, err
+        }
+        if n < 0 {
+            return nil, nil
+        }
+        buf := make([]byte, n + 2)
+        if _, err := io.ReadFull(r, buf); err != nil {
+            return nil, err
+        }
+        return string(buf[:n]), nil
+    case '*':
+        n, err := strconv.Atoi(line[1:])
+        if err != nil {
+            return nil, err
+        }
+        if n < 0 {
+            return nil, nil
+        }
+        values := make([]interface{}, n)
+        for i := range values {
+            if values[i], err = readValue(r); err != nil {
+                return nil, err
+            }
+        }
+        return values, nil
+    default:
+        return nil, fmt.Errorf("Unknown RESP type %q", line[0])
+    }
+}
@@ -0,0 +1,288 @@
+package config
+
+import (
+    "encoding"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "os"
+    "reflect"
+    "strconv"
+    "strings"
+    "time"
+    "gopkg.in/yaml.v3"
+)
+
+// Typed server config, shared by the servers. Each field is overridden by, in order, an optional YAML file,
+// the env and then flags. Fields are named by their yaml tag, which is also the env var and flag name,
+// so the env vars from before the config file keep working.
+//
+// Tags:
+//  `yaml:"name"` required on every field
+//  `env:"NAME"` for a different env var, eg. PORT
+//  `secret:"true"` to redact when printed
+//
+// Supports strings, ints, floats, bools, comma separated string lists and `Duration`.
+
+// Also settable with the `-config` flag
+const pathEnv = "configPath"
+const pathFlag = "config"
+
+const redacted = "[redacted]"
+
+type Validator interface {
+    // Should report every problem, see `Problems`
+    Validate() error
+}
+
+type field struct {
+    name string
+    env string
+    secret bool
+    value reflect.Value
+}
+
+func fields(target any) ([]field, error) {
+    v := reflect.ValueOf(target)
+    if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+        return nil, errors.New("Config must be a pointer to a struct")
+    }
+    v = v.Elem()
+    result := make([]field, 0, v.NumField())
+    for i := 0; i < v.NumField(); i++ {
+        structField := v.Type().Field(i)
+        name := strings.Split(structField.Tag.Get("yaml"), ",")[0]
+        if name == "" || name == "-" {
+            return nil, fmt.Errorf("Config field %s has no yaml name", structField.Name)
+        }
+        env := structField.Tag.Get("env")
+        if env == "" {
+            env = name
+        }
+        result = append(result, field { name, env, structField.Tag.Get("secret") == "true", v.Field(i) })
+    }
+    return result, nil
+}
+
+// Flags are only applied after the file and env, so they are held until then
+type pendingFlag struct {
+    f *field
+    input *string
+}
+
+func (p pendingFlag) String() string {
+    if p.input == nil {
+        return ""
+    }
+    return *p.input
+}
+
+func (p pendingFlag) Set(input string) error {
+    *p.input = input
+    // Fails early for usage errors, the real set happens later
+    return set(reflect.New(p.f.value.Type()).Elem(), input)
+}
+
+// `target` should hold the defaults. Returns the args left after flags, eg. a command.
+// Not validated yet, so that an invalid config can still be printed, see `Command`.
+func Load(name string, target Validator, args []string) ([]string, error) {
+    fs, err := fields(target)
+    if err != nil {
+        return nil, err
+    }
+
+    flags := flag.NewFlagSet(name, flag.ContinueOnError)
+    path := flags.String(pathFlag, os.Getenv(pathEnv), "YAML config file, also " + pathEnv)
+    pending := make(map[string]pendingFlag)
+    for i := range fs {
+        p := pendingFlag { &fs[i], new(string) }
+        pending[p.f.name] = p
+        flags.Var(p, p.f.name, "Overrides env " + p.f.env)
+    }
+    if err := flags.Parse(args); err != nil {
+        return nil, err
+    }
+
+    if *path != "" {
+        if err := loadFile(*path, target); err != nil {
+            return nil, err
+        }
+    }
+
+    for _, f := range fs {
+        if input := os.Getenv(f.env); input != "" {
+            if err := set(f.value, input); err != nil {
+                return nil, fmt.Errorf("Invalid env %s - %w", f.env, err)
+            }
+        }
+    }
+
+    flags.Visit(func (visited *flag.Flag) {
+        if p, found := pending[visited.Name]; found {
+            // Already checked while parsing
+            set(p.f.value, *p.input)
+        }
+    })
+
+    return flags.Args(), nil
+}
+
+func loadFile(path string, target any) error {
+    file, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+    decoder := yaml.NewDecoder(file)
+    // Typos should not silently fall back to defaults
+    decoder.KnownFields(true)
+    if err := decoder.Decode(target); err != nil && err != io.EOF {
+        return fmt.Errorf("Invalid config file %s - %w", path, err)
+    }
+    return nil
+}
+
+// For env and flags
+func set(v reflect.Value, input string) error {
+    if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+        return u.UnmarshalText([]byte(input))
+    }
+    switch v.Kind() {
+    case reflect.String:
+        v.SetString(input)
+    case reflect.Int, reflect.Int64:
+        n, err := strconv.ParseInt(input, 10, 64)
+        if err != nil {
+            return err
+        }
+        v.SetInt(n)
+    case reflect.Float64:
+        n, err := strconv.ParseFloat(input, 64)
+        if err != nil {
+            return err
+        }
+        v.SetFloat(n)
+    case reflect.Bool:
+        b, err := strconv.ParseBool(input)
+        if err != nil {
+            return err
+        }
+        v.SetBool(b)
+    case reflect.Slice:
+        if v.Type().Elem().Kind() != reflect.String {
+            return fmt.Errorf("Unsupported list type %s", v.Type())
+        }
+        list := make([]string, 0)
+        for _, item := range strings.Split(input, ",") {
+            if item = strings.TrimSpace(item); item != "" {
+                list = append(list, item)
+            }
+        }
+        v.Set(reflect.ValueOf(list))
+    default:
+        return fmt.Errorf("Unsupported type %s", v.Type())
+    }
+    return nil
+}
+
+// Writes the effective config as YAML, in field order, with secrets redacted
+func Print(w io.Writer, target any) error {
+    fs, err := fields(target)
+    if err != nil {
+        return err
+    }
+    doc := &yaml.Node { Kind: yaml.MappingNode }
+    for _, f := range fs {
+        key := &yaml.Node { Kind: yaml.ScalarNode, Value: f.name }
+        value := &yaml.Node{}
+        if f.secret && !f.value.IsZero() {
+            value.SetString(redacted)
+        } else if err := value.Encode(f.value.Interface()); err != nil {
+            return err
+        }
+        doc.Content = append(doc.Content, key, value)
+    }
+    encoder := yaml.NewEncoder(w)
+    encoder.SetIndent(2)
+    if err := encoder.Encode(doc); err != nil {
+        return err
+    }
+    return encoder.Close()
+}
+
+// Handles commands left after the flags, true if the server should exit instead of serving.
+// Also validates, after printing for `config print`, since an invalid config is what needs inspecting.
+func Command(args []string, target Validator, w io.Writer) (bool, error) {
+    if len(args) == 0 {
+        return false, target.Validate()
+    }
+    if len(args) == 2 && args[0] == "config" && args[1] == "print" {
+        if err := Print(w, target); err != nil {
+            return true, err
+        }
+        return true, target.Validate()
+    }
+    return true, fmt.Errorf("Unknown command %s, expected none or config print", strings.Join(args, " "))
+}
+
+//////////////////////////////////////////////////
+
+// Whole seconds, as the env vars always were, or a Go duration, eg. 500ms
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+    input := strings.TrimSpace(string(text))
+    if seconds, err := strconv.ParseInt(input, 10, 64); err == nil {
+        *d = Duration(time.Duration(seconds) * time.Second)
+        return nil
+    }
+    parsed, err := time.ParseDuration(input)
+    if err != nil {
+        return err
+    }
+    *d = Duration(parsed)
+    return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+    return []byte(d.D().String()), nil
+}
+
+// yaml.v3 decodes ints without the text unmarshaler
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+    return d.UnmarshalText([]byte(node.Value))
+}
+
+func (d Duration) MarshalYAML() (any, error) {
+    return d.D().String(), nil
+}
+
+func (d Duration) D() time.Duration {
+    return time.Duration(d)
+}
+
+//////////////////////////////////////////////////
+
+// Collects every problem, so that startup reports them all at once
+type Problems struct {
+    errs []error
+}
+
+// Adds `name reason` unless ok
+func (p *Problems) Check(ok bool, name string, reason string) {
+    if !ok {
+        p.errs = append(p.errs, fmt.Errorf("%s %s", name, reason))
+    }
+}
+
+// Adds `name - err` if err is not nil
+func (p *Problems) Add(name string, err error) {
+    if err != nil {
+        p.errs = append(p.errs, fmt.Errorf("%s - %w", name, err))
+    }
+}
+
+func (p *Problems) Err() error {
+    return errors.Join(p.errs...)
+}
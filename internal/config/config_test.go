@@ -0,0 +1,136 @@
+package config
+
+import (
+    "bytes"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+type testConfig struct {
+    Port int `yaml:"port" env:"TEST_PORT"`
+    Name string `yaml:"testName"`
+    Secret string `yaml:"testSecret" secret:"true"`
+    Timeout Duration `yaml:"testTimeout"`
+    Columns []string `yaml:"testColumns"`
+    Enabled bool `yaml:"testEnabled"`
+}
+
+func (c *testConfig) Validate() error {
+    var p Problems
+    p.Check(c.Port > 0, "port", "must be positive")
+    p.Check(c.Timeout > 0, "testTimeout", "must be positive")
+    return p.Err()
+}
+
+func defaults() testConfig {
+    return testConfig { 8080, "default", "", Duration(5 * time.Second), []string { "a" }, true }
+}
+
+func writeFile(t *testing.T, content string) string {
+    path := filepath.Join(t.TempDir(), "config.yaml")
+    if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+        t.Fatal(err)
+    }
+    return path
+}
+
+func TestPrecedence(t *testing.T) {
+    path := writeFile(t, "port: 1\ntestName: file\ntestTimeout: 500ms\ntestColumns: [x, y]\n")
+    t.Setenv("TEST_PORT", "2")
+    t.Setenv("testTimeout", "3")
+
+    c := defaults()
+    args, err := Load("test", &c, []string { "-config", path, "-testName", "flag", "config", "print" })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if c.Port != 2 || c.Name != "flag" || c.Timeout.D() != 3 * time.Second || c.Enabled != true {
+        t.Fatalf("Unexpected config %+v", c)
+    }
+    if len(c.Columns) != 2 || c.Columns[1] != "y" {
+        t.Fatalf("Expected columns from file, got %v", c.Columns)
+    }
+    if len(args) != 2 || args[0] != "config" {
+        t.Fatalf("Expected command args, got %v", args)
+    }
+
+    t.Setenv("configPath", path)
+    t.Setenv("testColumns", "p, q,")
+    c = defaults()
+    if _, err := Load("test", &c, []string { "-testTimeout", "250ms" }); err != nil {
+        t.Fatal(err)
+    }
+    if c.Name != "file" || c.Timeout.D() != 250 * time.Millisecond || len(c.Columns) != 2 || c.Columns[1] != "q" {
+        t.Fatalf("Unexpected config %+v", c)
+    }
+}
+
+func TestErrors(t *testing.T) {
+    c := defaults()
+    if _, err := Load("test", &c, []string { "-port", "x" }); err == nil {
+        t.Fatal("Expected flag error")
+    }
+
+    c = defaults()
+    if _, err := Load("test", &c, []string { "-config", writeFile(t, "tpyo: 1\n") }); err == nil {
+        t.Fatal("Expected unknown field error")
+    }
+
+    t.Setenv("TEST_PORT", "0")
+    t.Setenv("testTimeout", "0")
+    c = defaults()
+    if _, err := Load("test", &c, nil); err != nil {
+        t.Fatalf("Expected validation to wait for the command, got %v", err)
+    }
+    var buffer bytes.Buffer
+    _, err := Command(nil, &c, &buffer)
+    if err == nil || !strings.Contains(err.Error(), "port must be positive") || !strings.Contains(err.Error(), "testTimeout must be positive") {
+        t.Fatalf("Expected every problem, got %v", err)
+    }
+
+    // Printed anyway, since that's when it's needed
+    exit, err := Command([]string { "config", "print" }, &c, &buffer)
+    if !exit || err == nil || !strings.HasPrefix(buffer.String(), "port: 0") {
+        t.Fatalf("Expected print then problems, got %v %v %s", exit, err, buffer.String())
+    }
+}
+
+func TestPrint(t *testing.T) {
+    c := defaults()
+    c.Secret = "hunter2"
+    var buffer bytes.Buffer
+    exit, err := Command([]string { "config", "print" }, &c, &buffer)
+    if err != nil || !exit {
+        t.Fatalf("Expected print, got %v %v", exit, err)
+    }
+    printed := buffer.String()
+    if strings.Contains(printed, "hunter2") || !strings.Contains(printed, redacted) {
+        t.Fatalf("Expected secret to be redacted, got %s", printed)
+    }
+    if !strings.Contains(printed, "testTimeout: 5s") || !strings.HasPrefix(printed, "port: 8080") {
+        t.Fatalf("Unexpected output %s", printed)
+    }
+
+    // Printed config loads back the same
+    loaded := testConfig{}
+    if _, err := Load("test", &loaded, []string { "-config", writeFile(t, strings.Replace(printed, redacted, "hunter2", 1)) }); err != nil {
+        t.Fatal(err)
+    }
+    if loaded.Timeout != c.Timeout || loaded.Secret != "hunter2" || loaded.Port != 8080 {
+        t.Fatalf("Unexpected config %+v", loaded)
+    }
+
+    if exit, _ := Command(nil, &c, &buffer); exit {
+        t.Fatal("Expected no command to serve")
+    }
+    if _, err := Command([]string { "bogus" }, &c, &buffer); err == nil {
+        t.Fatal("Expected unknown command error")
+    }
+}
+
+func TestMain(m *testing.M) {
+    m.Run()
+}
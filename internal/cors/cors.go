@@ -0,0 +1,184 @@
+package cors
+
+import (
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+    "github.com/gin-gonic/gin"
+	"github.com/starqi/wi-util-servers/internal/logging"
+)
+
+// Origin allowlist, shared by the servers for CORS and websocket upgrades.
+// Requests without an Origin, eg. game servers and curl, or from the same host are always allowed,
+// anything else cross-origin must be on the list or gets a 403.
+
+var logger = logging.For("cors")
+
+// Eg. https://example.com, https://*.example.com for subdomains only, or * for any origin
+type Allowlist struct {
+    any bool
+    exact map[string]bool
+    // Scheme -> host suffixes with the leading dot, port included if any
+    wildcards map[string][]string
+}
+
+// Empty allows any origin outside of gin's release mode, and none in release mode
+func MakeAllowlist(patterns []string) (*Allowlist, error) {
+    a := &Allowlist { false, make(map[string]bool), make(map[string][]string) }
+    if len(patterns) == 0 {
+        a.any = gin.Mode() != gin.ReleaseMode
+        return a, nil
+    }
+    for _, pattern := range patterns {
+        pattern = strings.ToLower(strings.TrimSpace(pattern))
+        if pattern == "*" {
+            a.any = true
+            continue
+        }
+        scheme, rest, _ := strings.Cut(pattern, "://")
+        wildcard := strings.HasPrefix(rest, "*.")
+        u, err := url.Parse(scheme + "://" + strings.TrimPrefix(rest, "*."))
+        if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") || strings.Contains(u.Host, "*") {
+            return nil, fmt.Errorf("Invalid origin %s, expected eg. https://example.com or https://*.example.com", pattern)
+        }
+        if wildcard {
+            a.wildcards[u.Scheme] = append(a.wildcards[u.Scheme], "." + u.Host)
+        } else {
+            a.exact[u.Scheme + "://" + u.Host] = true
+        }
+    }
+    return a, nil
+}
+
+// Any origin is allowed, for warnings
+func (a *Allowlist) Any() bool {
+    return a.any
+}
+
+func (a *Allowlist) Allows(origin string) bool {
+    if a.any {
+        return true
+    }
+    u, err := url.Parse(strings.ToLower(origin))
+    if err != nil || u.Scheme == "" || u.Host == "" {
+        return false
+    }
+    if a.exact[u.Scheme + "://" + u.Host] {
+        return true
+    }
+    for _, suffix := range a.wildcards[u.Scheme] {
+        if strings.HasSuffix(u.Host, suffix) {
+            return true
+        }
+    }
+    return false
+}
+
+// Behind a TLS-terminating proxy the scheme is unknown, so only the host is compared
+func sameHost(origin string, host string) bool {
+    u, err := url.Parse(origin)
+    return err == nil && u.Host != "" && strings.EqualFold(u.Host, host)
+}
+
+// Browsers can't check websocket upgrades, so the upgrader must
+func (a *Allowlist) CheckOrigin(r *http.Request) bool {
+    origin := r.Header.Get("Origin")
+    return origin == "" || sameHost(origin, r.Host) || a.Allows(origin)
+}
+
+//////////////////////////////////////////////////
+
+type Rule struct {
+    // Empty for the methods registered on the route
+    Methods []string
+    // Request headers allowed beyond the CORS-safelisted ones, empty for the policy's default
+    Headers []string
+}
+
+type Policy struct {
+    origins *Allowlist
+    defaultHeaders []string
+    maxAge time.Duration
+    // Route -> rule, routes as in `c.FullPath()`
+    rules map[string]Rule
+    // Route -> methods, filled by `Preflight`
+    methods map[string][]string
+}
+
+func MakePolicy(origins *Allowlist, defaultHeaders []string, maxAge time.Duration) *Policy {
+    if origins.Any() {
+        logger.Warn("Allowing any origin, set allowed origins before exposing this server")
+    }
+    return &Policy { origins, defaultHeaders, maxAge, make(map[string]Rule), make(map[string][]string) }
+}
+
+// Should be called before `Preflight`
+func (p *Policy) Route(route string, rule Rule) {
+    p.rules[route] = rule
+}
+
+// Registers OPTIONS on every route so preflights are matched to their route, must be called after every other
+// route is registered
+func (p *Policy) Preflight(router *gin.Engine) error {
+    for _, info := range router.Routes() {
+        if info.Method != http.MethodOptions {
+            p.methods[info.Path] = append(p.methods[info.Path], info.Method)
+        }
+    }
+    for route, methods := range p.methods {
+        sort.Strings(methods)
+        if rule, found := p.rules[route]; found && len(rule.Methods) > 0 {
+            p.methods[route] = rule.Methods
+        }
+        router.OPTIONS(route, func (c *gin.Context) {
+            c.Status(http.StatusNoContent)
+        })
+    }
+    for route := range p.rules {
+        if _, found := p.methods[route]; !found {
+            return errors.New("CORS rule for unknown route " + route)
+        }
+    }
+    return nil
+}
+
+func (p *Policy) headers(route string) []string {
+    if rule, found := p.rules[route]; found && len(rule.Headers) > 0 {
+        return rule.Headers
+    }
+    return p.defaultHeaders
+}
+
+func (p *Policy) Middleware() gin.HandlerFunc {
+    return func (c *gin.Context) {
+        origin := c.GetHeader("Origin")
+        if origin == "" || sameHost(origin, c.Request.Host) {
+            c.Next()
+            return
+        }
+        c.Header("Vary", "Origin")
+        if !p.origins.Allows(origin) {
+            logger.InfoContext(c.Request.Context(), "Origin not allowed", "origin", origin, "route", c.FullPath())
+            c.AbortWithStatus(http.StatusForbidden)
+            return
+        }
+        c.Header("Access-Control-Allow-Origin", origin)
+        if c.Request.Method != http.MethodOptions || c.GetHeader("Access-Control-Request-Method") == "" {
+            c.Next()
+            return
+        }
+
+        route := c.FullPath()
+        c.Header("Access-Control-Allow-Methods", strings.Join(p.methods[route], ", "))
+        if headers := p.headers(route); len(headers) > 0 {
+            c.Header("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+        }
+        c.Header("Access-Control-Max-Age", strconv.Itoa(int(p.maxAge.Seconds())))
+        c.AbortWithStatus(http.StatusNoContent)
+    }
+}
@@ -0,0 +1,130 @@
+package cors
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+    "github.com/gin-gonic/gin"
+)
+
+func TestAllowlist(t *testing.T) {
+    a, err := MakeAllowlist([]string { "https://example.com", "https://*.game.io", "http://localhost:3000" })
+    if err != nil {
+        t.Fatal(err)
+    }
+    for origin, expected := range map[string]bool {
+        "https://example.com": true,
+        "https://EXAMPLE.com": true,
+        "http://example.com": false,
+        "https://sub.example.com": false,
+        "https://a.game.io": true,
+        "https://a.b.game.io": true,
+        "https://game.io": false,
+        "https://evilgame.io": false,
+        "http://localhost:3000": true,
+        "http://localhost:3001": false,
+        "null": false,
+    } {
+        if a.Allows(origin) != expected {
+            t.Fatalf("Expected %s to be %v", origin, expected)
+        }
+    }
+
+    for _, pattern := range []string { "example.com", "https://*", "https://example.com/path", "https://a.*.com" } {
+        if _, err := MakeAllowlist([]string { pattern }); err == nil {
+            t.Fatalf("Expected %s to be invalid", pattern)
+        }
+    }
+
+    gin.SetMode(gin.ReleaseMode)
+    defer gin.SetMode(gin.TestMode)
+    strict, _ := MakeAllowlist(nil)
+    if strict.Any() || strict.Allows("https://example.com") {
+        t.Fatal("Expected empty allowlist to be strict in release mode")
+    }
+}
+
+func TestCheckOrigin(t *testing.T) {
+    a, _ := MakeAllowlist([]string { "https://example.com" })
+    request := httptest.NewRequest(http.MethodGet, "http://chat.internal/chat", nil)
+    if !a.CheckOrigin(request) {
+        t.Fatal("Expected no origin to be allowed")
+    }
+    request.Header.Set("Origin", "https://chat.internal")
+    if !a.CheckOrigin(request) {
+        t.Fatal("Expected same host to be allowed")
+    }
+    request.Header.Set("Origin", "https://evil.com")
+    if a.CheckOrigin(request) {
+        t.Fatal("Expected other origin to be rejected")
+    }
+}
+
+func serve(router *gin.Engine, method string, path string, headers map[string]string) *httptest.ResponseRecorder {
+    request := httptest.NewRequest(method, "http://api.internal" + path, nil)
+    for k, v := range headers {
+        request.Header.Set(k, v)
+    }
+    w := httptest.NewRecorder()
+    router.ServeHTTP(w, request)
+    return w
+}
+
+func TestPolicy(t *testing.T) {
+    a, _ := MakeAllowlist([]string { "https://example.com" })
+    policy := MakePolicy(a, []string { "Content-Type" }, time.Minute)
+    router := gin.New()
+    router.Use(policy.Middleware())
+    ok := func (c *gin.Context) { c.Status(http.StatusOK) }
+    router.GET("/things/:id", ok)
+    router.DELETE("/things/:id", ok)
+    router.POST("/private", ok)
+    policy.Route("/private", Rule { Headers: []string { "Authorization" } })
+    if err := policy.Preflight(router); err != nil {
+        t.Fatal(err)
+    }
+
+    w := serve(router, http.MethodOptions, "/things/1", map[string]string {
+        "Origin": "https://example.com",
+        "Access-Control-Request-Method": "DELETE",
+    })
+    if w.Code != http.StatusNoContent ||
+        w.Header().Get("Access-Control-Allow-Origin") != "https://example.com" ||
+        w.Header().Get("Access-Control-Allow-Methods") != "DELETE, GET" ||
+        w.Header().Get("Access-Control-Allow-Headers") != "Content-Type" ||
+        w.Header().Get("Access-Control-Max-Age") != "60" {
+        t.Fatalf("Unexpected preflight %d %v", w.Code, w.Header())
+    }
+
+    w = serve(router, http.MethodOptions, "/private", map[string]string {
+        "Origin": "https://example.com",
+        "Access-Control-Request-Method": "POST",
+    })
+    if w.Header().Get("Access-Control-Allow-Headers") != "Authorization" || w.Header().Get("Access-Control-Allow-Methods") != "POST" {
+        t.Fatalf("Expected route rule, got %v", w.Header())
+    }
+
+    w = serve(router, http.MethodGet, "/things/1", map[string]string { "Origin": "https://example.com" })
+    if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "https://example.com" {
+        t.Fatalf("Unexpected response %d %v", w.Code, w.Header())
+    }
+    w = serve(router, http.MethodGet, "/things/1", map[string]string { "Origin": "https://evil.com" })
+    if w.Code != http.StatusForbidden || w.Header().Get("Access-Control-Allow-Origin") != "" {
+        t.Fatalf("Expected forbidden, got %d %v", w.Code, w.Header())
+    }
+    w = serve(router, http.MethodGet, "/things/1", nil)
+    if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "" {
+        t.Fatalf("Expected no CORS headers without an origin, got %d %v", w.Code, w.Header())
+    }
+
+    policy.Route("/missing", Rule{})
+    if err := policy.Preflight(gin.New()); err == nil {
+        t.Fatal("Expected unknown route error")
+    }
+}
+
+func TestMain(m *testing.M) {
+    gin.SetMode(gin.TestMode)
+    m.Run()
+}
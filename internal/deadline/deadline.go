@@ -0,0 +1,145 @@
+package deadline
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+    "github.com/gin-gonic/gin"
+)
+
+// Request deadlines, shared by the servers. Handlers pass `c.Request.Context()` to anything that can block,
+// and map deadline errors to 503 with `Abort`.
+
+// Retry-After hint in seconds
+const RetryAfterSeconds = 1
+
+// Also true if the client hung up, which cancels the request context
+func IsExceeded(err error) bool {
+    return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)
+}
+
+func Abort(c *gin.Context) {
+    c.Header("Retry-After", strconv.Itoa(RetryAfterSeconds))
+    c.AbortWithStatus(http.StatusServiceUnavailable)
+}
+
+// Buffers the response, so that it can be replaced by a 503 if the deadline fires first
+type timeoutWriter struct {
+    mutex sync.Mutex
+    header http.Header
+    body bytes.Buffer
+    status int
+    timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+    return tw.header
+}
+
+// Fails once timed out, the handler's response is discarded
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+    tw.mutex.Lock()
+    defer tw.mutex.Unlock()
+    if tw.timedOut {
+        return 0, http.ErrHandlerTimeout
+    }
+    if tw.status == 0 {
+        tw.status = http.StatusOK
+    }
+    return tw.body.Write(b)
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+    tw.mutex.Lock()
+    defer tw.mutex.Unlock()
+    if tw.timedOut || tw.status != 0 {
+        return
+    }
+    tw.status = status
+}
+
+// Wraps the whole router, since gin contexts are reused once the router returns, so a gin middleware can't
+// answer while the handler is still running. Handlers run with the deadline on their context, and the client gets
+// a 503 when it fires, even if the handler ignores the context and is still blocked, eg. on a stalled aggregator.
+// Responses are buffered, so exempt paths are for anything long-lived, flushed or hijacked, eg. event streams and
+// websockets.
+func Handler(next http.Handler, timeout time.Duration, exempt ...string) http.Handler {
+    exemptPaths := make(map[string]bool)
+    for _, path := range exempt {
+        exemptPaths[path] = true
+    }
+    return http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+        if exemptPaths[r.URL.Path] {
+            next.ServeHTTP(w, r)
+            return
+        }
+        ctx, cancel := context.WithTimeout(r.Context(), timeout)
+        defer cancel()
+        tw := &timeoutWriter { header: make(http.Header) }
+        done := make(chan struct{})
+        panics := make(chan any, 1)
+        go func () {
+            defer func () {
+                if p := recover(); p != nil {
+                    panics <- p
+                }
+            }()
+            next.ServeHTTP(tw, r.WithContext(ctx))
+            close(done)
+        }()
+
+        select {
+        case p := <-panics:
+            // For the server to log and close the connection
+            panic(p)
+        case <-done:
+            tw.mutex.Lock()
+            defer tw.mutex.Unlock()
+            for k, v := range tw.header {
+                w.Header()[k] = v
+            }
+            if tw.status == 0 {
+                tw.status = http.StatusOK
+            }
+            w.WriteHeader(tw.status)
+            w.Write(tw.body.Bytes())
+        case <-ctx.Done():
+            tw.mutex.Lock()
+            defer tw.mutex.Unlock()
+            tw.timedOut = true
+            w.Header().Set("Retry-After", strconv.Itoa(RetryAfterSeconds))
+            w.WriteHeader(http.StatusServiceUnavailable)
+        }
+    })
+}
+
+//////////////////////////////////////////////////
+// Aggregator requests
+
+func Send[T any](ctx context.Context, ch chan T, value T) error {
+    select {
+    case ch <- value:
+        return nil
+    case <-ctx.Done():
+        return ctx.Err()
+    }
+}
+
+// Waits to be accepted and for the result. Callbacks must be buffered, so aggregators are never stuck on a
+// caller that gave up.
+func Call[T any, R any](ctx context.Context, ch chan T, value T, cb chan R) (R, error) {
+    var zero R
+    if err := Send(ctx, ch, value); err != nil {
+        return zero, err
+    }
+    select {
+    case result := <-cb:
+        return result, nil
+    case <-ctx.Done():
+        return zero, ctx.Err()
+    }
+}
@@ -0,0 +1,96 @@
+package deadline
+
+import (
+    "context"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+    "github.com/gin-gonic/gin"
+)
+
+func TestCallTimesOut(t *testing.T) {
+    ch := make(chan chan int)
+    ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+    defer cancel()
+    cb := make(chan int, 1)
+    if _, err := Call(ctx, ch, cb, cb); !IsExceeded(err) {
+        t.Fatal("Expected timeout while nothing receives, got ", err)
+    }
+
+    // Accepted, but the result never comes
+    go func () { <-ch }()
+    ctx2, cancel2 := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+    defer cancel2()
+    if _, err := Call(ctx2, ch, cb, cb); !IsExceeded(err) {
+        t.Fatal("Expected timeout while waiting for the result, got ", err)
+    }
+}
+
+func TestCall(t *testing.T) {
+    ch := make(chan chan int)
+    go func () { (<-ch) <- 5 }()
+    cb := make(chan int, 1)
+    if result, err := Call(context.Background(), ch, cb, cb); err != nil || result != 5 {
+        t.Fatal("Expected 5, got ", result, err)
+    }
+}
+
+func TestHandler(t *testing.T) {
+    const timeout = 10 * time.Millisecond
+    // Nothing ever receives, and the handler ignores the context
+    stalled := make(chan chan int)
+    router := gin.New()
+    // Respects the context
+    router.GET("/slow", func (c *gin.Context) {
+        <-c.Request.Context().Done()
+        Abort(c)
+    })
+    router.GET("/stuck", func (c *gin.Context) {
+        cb := make(chan int, 1)
+        stalled <- cb
+        c.JSON(http.StatusOK, <-cb)
+    })
+    router.GET("/fast", func (c *gin.Context) {
+        c.Header("X-Test", "yes")
+        c.String(http.StatusCreated, "done")
+    })
+    router.GET("/stream", func (c *gin.Context) {
+        if _, found := c.Request.Context().Deadline(); found {
+            t.Error("Expected exempt route to have no deadline")
+        }
+        time.Sleep(2 * timeout)
+        c.Status(http.StatusOK)
+        c.Writer.Flush()
+    })
+    handler := Handler(router, timeout, "/stream")
+
+    for _, path := range []string{ "/slow", "/stuck" } {
+        w := httptest.NewRecorder()
+        start := time.Now()
+        handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+        if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+            t.Fatalf("Expected 503 with Retry-After for %s, got %d", path, w.Code)
+        }
+        if elapsed := time.Since(start); elapsed > 10 * timeout {
+            t.Fatalf("Expected 503 at the deadline for %s, took %s", path, elapsed)
+        }
+    }
+
+    w := httptest.NewRecorder()
+    handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/fast", nil))
+    if w.Code != http.StatusCreated || w.Header().Get("X-Test") != "yes" || w.Body.String() != "done" {
+        t.Fatalf("Expected the buffered response, got %d %v %s", w.Code, w.Header(), w.Body.String())
+    }
+
+    w = httptest.NewRecorder()
+    handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stream", nil))
+    if w.Code != http.StatusOK || !w.Flushed {
+        t.Fatalf("Expected exempt route to be written directly, got %d", w.Code)
+    }
+}
+
+func TestMain(m *testing.M) {
+    gin.SetMode(gin.TestMode)
+    m.Run()
+}
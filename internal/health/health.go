@@ -0,0 +1,72 @@
+package health
+
+import (
+    "context"
+    "net/http"
+    "sync"
+    "time"
+    "github.com/gin-gonic/gin"
+)
+
+// Liveness is just the process answering, readiness runs every dependency check within a deadline.
+
+type Check struct {
+    Name string
+    // Should give up when the context is done
+    Run func (ctx context.Context) error
+}
+
+const statusOk = "ok"
+
+func Liveness(c *gin.Context) {
+    c.JSON(http.StatusOK, gin.H{"status": statusOk})
+}
+
+// Checks run concurrently, 503 if any fails or is still running at the deadline
+func Readiness(timeout time.Duration, checks ...Check) gin.HandlerFunc {
+    return func (c *gin.Context) {
+        ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+        defer cancel()
+        results := run(ctx, checks)
+
+        status := http.StatusOK
+        for _, result := range results {
+            if result != statusOk {
+                status = http.StatusServiceUnavailable
+            }
+        }
+        c.JSON(status, gin.H{"ready": status == http.StatusOK, "checks": results})
+    }
+}
+
+// Check name -> "ok" or the error
+func run(ctx context.Context, checks []Check) map[string]string {
+    var mutex sync.Mutex
+    results := make(map[string]string)
+    var wg sync.WaitGroup
+    for _, check := range checks {
+        wg.Add(1)
+        go func (check Check) {
+            defer wg.Done()
+            done := make(chan error, 1)
+            go func () {
+                done <- check.Run(ctx)
+            }()
+            var err error
+            select {
+            case err = <-done:
+            case <-ctx.Done():
+                err = ctx.Err()
+            }
+            result := statusOk
+            if err != nil {
+                result = err.Error()
+            }
+            mutex.Lock()
+            results[check.Name] = result
+            mutex.Unlock()
+        }(check)
+    }
+    wg.Wait()
+    return results
+}
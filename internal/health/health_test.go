@@ -0,0 +1,91 @@
+package health
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+    "github.com/gin-gonic/gin"
+    "gorm.io/driver/sqlite"
+    "gorm.io/gorm"
+)
+
+type readiness struct {
+    Ready bool `json:"ready"`
+    Checks map[string]string `json:"checks"`
+}
+
+func probe(t *testing.T, checks ...Check) (int, readiness) {
+    router := gin.New()
+    router.GET("/readyz", Readiness(20 * time.Millisecond, checks...))
+    w := httptest.NewRecorder()
+    router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+    var result readiness
+    if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+        t.Fatal(err)
+    }
+    return w.Code, result
+}
+
+func TestReadiness(t *testing.T) {
+    ok := Check { "ok", func (ctx context.Context) error { return nil } }
+    failing := Check { "failing", func (ctx context.Context) error { return errors.New("Down") } }
+    // Ignores the context, like a stuck aggregator
+    stuck := Check { "stuck", func (ctx context.Context) error {
+        time.Sleep(time.Second)
+        return nil
+    }}
+
+    if code, result := probe(t, ok); code != http.StatusOK || !result.Ready || result.Checks["ok"] != "ok" {
+        t.Fatalf("Expected ready, got %d %v", code, result)
+    }
+    code, result := probe(t, ok, failing, stuck)
+    if code != http.StatusServiceUnavailable || result.Ready {
+        t.Fatalf("Expected unavailable, got %d", code)
+    }
+    if result.Checks["ok"] != "ok" || result.Checks["failing"] != "Down" || result.Checks["stuck"] != context.DeadlineExceeded.Error() {
+        t.Fatalf("Unexpected checks %v", result.Checks)
+    }
+}
+
+func TestSqliteChecks(t *testing.T) {
+    latest, err := LatestMigration("../../db/stats-migrations")
+    if err != nil || latest != 20201023204111 {
+        t.Fatal("Expected the stats migration version, got ", latest, err)
+    }
+
+    db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    // Every connection would get its own in-memory DB
+    sqlDb, _ := db.DB()
+    sqlDb.SetMaxOpenConns(1)
+    schema := Schema(db, "../../db/stats-migrations")
+    writable := Writable(db)
+    ctx := context.Background()
+    if schema.Run(ctx) == nil || writable.Run(ctx) == nil {
+        t.Fatal("Expected checks to fail without a migrations table")
+    }
+
+    db.Exec("create table schema_migrations (version uint64, dirty bool)")
+    db.Exec("insert into schema_migrations values (?, ?)", latest, true)
+    if schema.Run(ctx) == nil {
+        t.Fatal("Expected dirty schema to fail")
+    }
+    db.Exec("update schema_migrations set dirty = false")
+    if err := schema.Run(ctx); err != nil {
+        t.Fatal(err)
+    }
+    if err := writable.Run(ctx); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestMain(m *testing.M) {
+    gin.SetMode(gin.TestMode)
+    m.Run()
+}
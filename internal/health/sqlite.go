@@ -0,0 +1,87 @@
+package health
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "os"
+    "strconv"
+    "strings"
+    "gorm.io/gorm"
+)
+
+// Only used to roll back the write probe
+var errProbe = errors.New("Probe")
+
+// Pings, then writes in a transaction that is rolled back, since a read-only file still answers reads
+func Writable(db *gorm.DB) Check {
+    return Check { "db", func (ctx context.Context) error {
+        sqlDb, err := db.DB()
+        if err != nil {
+            return err
+        }
+        if err := sqlDb.PingContext(ctx); err != nil {
+            return err
+        }
+        err = db.WithContext(ctx).Transaction(func (tx *gorm.DB) error {
+            if err := tx.Exec("update schema_migrations set dirty = dirty").Error; err != nil {
+                return err
+            }
+            return errProbe
+        })
+        if err != errProbe {
+            return err
+        }
+        return nil
+    }}
+}
+
+// Highest version of the golang-migrate files in the directory
+func LatestMigration(migrationsDir string) (uint64, error) {
+    entries, err := os.ReadDir(migrationsDir)
+    if err != nil {
+        return 0, err
+    }
+    var latest uint64
+    for _, entry := range entries {
+        name := entry.Name()
+        if !strings.HasSuffix(name, ".up.sql") {
+            continue
+        }
+        version, err := strconv.ParseUint(strings.SplitN(name, "_", 2)[0], 10, 64)
+        if err != nil {
+            return 0, fmt.Errorf("Unexpected migration file name %s", name)
+        }
+        if version > latest {
+            latest = version
+        }
+    }
+    if latest == 0 {
+        return 0, errors.New("No migrations in " + migrationsDir)
+    }
+    return latest, nil
+}
+
+// The DB must be migrated to the latest file, and not left dirty by a failed migration
+func Schema(db *gorm.DB, migrationsDir string) Check {
+    return Check { "schema", func (ctx context.Context) error {
+        latest, err := LatestMigration(migrationsDir)
+        if err != nil {
+            return err
+        }
+        var row struct {
+            Version uint64
+            Dirty bool
+        }
+        if err := db.WithContext(ctx).Raw("select version, dirty from schema_migrations limit 1").Scan(&row).Error; err != nil {
+            return err
+        }
+        if row.Dirty {
+            return fmt.Errorf("Schema version %d is dirty", row.Version)
+        }
+        if row.Version != latest {
+            return fmt.Errorf("Schema version %d, expected %d", row.Version, latest)
+        }
+        return nil
+    }}
+}
@@ -0,0 +1,36 @@
+package logging
+
+import (
+    "log/slog"
+    "time"
+    "github.com/gin-gonic/gin"
+    "github.com/google/uuid"
+)
+
+const requestIDHeader = "X-Request-ID"
+// Longer IDs from clients are replaced
+const maxRequestIDLength = 64
+
+// Takes the request ID from the proxy, or makes one, and logs every request by route rather than path,
+// since paths may contain tokens
+func Middleware(logger *slog.Logger) gin.HandlerFunc {
+    return func (c *gin.Context) {
+        id := c.GetHeader(requestIDHeader)
+        if id == "" || len(id) > maxRequestIDLength {
+            id = uuid.NewString()
+        }
+        c.Header(requestIDHeader, id)
+        ctx := WithRequestID(c.Request.Context(), id)
+        c.Request = c.Request.WithContext(ctx)
+
+        start := time.Now()
+        c.Next()
+        logger.InfoContext(ctx, "Request",
+            "method", c.Request.Method,
+            "route", c.FullPath(),
+            "status", c.Writer.Status(),
+            "latencyMs", time.Since(start).Milliseconds(),
+            "clientIp", c.ClientIP(),
+        )
+    }
+}
@@ -0,0 +1,170 @@
+package logging
+
+import (
+    "context"
+    "fmt"
+    "io"
+    "log"
+    "log/slog"
+    "os"
+    "strings"
+    "sync/atomic"
+)
+
+// JSON logs through slog, one logger per subsystem, each with its own level.
+// Loggers may be made before `Setup`, eg. in package vars, since they look up the configuration on every record.
+
+type Config struct {
+    // Default for subsystems without their own level
+    Level slog.Level
+    // Subsystem -> level
+    Levels map[string]slog.Level
+    // Off for local debugging only
+    Redact bool
+}
+
+func DefaultConfig() Config {
+    return Config { slog.LevelInfo, make(map[string]slog.Level), true }
+}
+
+// From the servers' config, `levels` like ParseLevels
+func MakeConfig(level string, levels string, redact bool) (Config, error) {
+    config := DefaultConfig()
+    if err := config.Level.UnmarshalText([]byte(level)); err != nil {
+        return config, fmt.Errorf("Invalid level - %w", err)
+    }
+    parsed, err := ParseLevels(levels)
+    if err != nil {
+        return config, fmt.Errorf("Invalid levels - %w", err)
+    }
+    config.Levels = parsed
+    config.Redact = redact
+    return config, nil
+}
+
+const redacted = "[redacted]"
+
+// Attribute keys whose values are never logged when redacting, matched case-insensitively
+var sensitiveKeys = map[string]bool {
+    "token": true,
+    "secret": true,
+    "key": true,
+    "authorization": true,
+    "payload": true,
+    "body": true,
+}
+
+type state struct {
+    config Config
+    root slog.Handler
+}
+
+var current atomic.Pointer[state]
+
+func init() {
+    setup(os.Stderr, DefaultConfig())
+}
+
+// Also sends the standard logger through slog, eg. gin and libraries, at info level
+func Setup(config Config) {
+    setup(os.Stdout, config)
+}
+
+func setup(w io.Writer, config Config) {
+    redact := config.Redact
+    root := slog.NewJSONHandler(w, &slog.HandlerOptions {
+        // Subsystem handlers filter by level
+        Level: slog.Level(-100),
+        ReplaceAttr: func (groups []string, a slog.Attr) slog.Attr {
+            if redact && sensitiveKeys[strings.ToLower(a.Key)] {
+                return slog.String(a.Key, redacted)
+            }
+            return a
+        },
+    })
+    current.Store(&state { config, root })
+    slog.SetDefault(For("default"))
+    log.SetFlags(0)
+}
+
+func levelOf(subsystem string) slog.Level {
+    config := current.Load().config
+    if level, found := config.Levels[subsystem]; found {
+        return level
+    }
+    return config.Level
+}
+
+// Parses levels like "chat=debug,sessions=warn"
+func ParseLevels(input string) (map[string]slog.Level, error) {
+    levels := make(map[string]slog.Level)
+    for _, pair := range strings.Split(input, ",") {
+        pair = strings.TrimSpace(pair)
+        if pair == "" {
+            continue
+        }
+        subsystem, levelName, found := strings.Cut(pair, "=")
+        if !found {
+            return nil, fmt.Errorf("Expected subsystem=level, got %s", pair)
+        }
+        var level slog.Level
+        if err := level.UnmarshalText([]byte(levelName)); err != nil {
+            return nil, err
+        }
+        levels[strings.TrimSpace(subsystem)] = level
+    }
+    return levels, nil
+}
+
+//////////////////////////////////////////////////
+
+type requestIDKey struct{}
+
+func WithRequestID(ctx context.Context, id string) context.Context {
+    return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func RequestID(ctx context.Context) string {
+    id, _ := ctx.Value(requestIDKey{}).(string)
+    return id
+}
+
+//////////////////////////////////////////////////
+
+type subsystemHandler struct {
+    subsystem string
+    // Applied to the root handler on every record, since the root may change
+    wrap func (slog.Handler) slog.Handler
+}
+
+func For(subsystem string) *slog.Logger {
+    return slog.New(&subsystemHandler { subsystem, func (h slog.Handler) slog.Handler { return h } })
+}
+
+func (h *subsystemHandler) Enabled(ctx context.Context, level slog.Level) bool {
+    return level >= levelOf(h.subsystem)
+}
+
+func (h *subsystemHandler) Handle(ctx context.Context, record slog.Record) error {
+    record.AddAttrs(slog.String("subsystem", h.subsystem))
+    if id := RequestID(ctx); id != "" {
+        record.AddAttrs(slog.String("requestId", id))
+    }
+    return h.wrap(current.Load().root).Handle(ctx, record)
+}
+
+func (h *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+    wrap := h.wrap
+    return &subsystemHandler { h.subsystem, func (root slog.Handler) slog.Handler { return wrap(root).WithAttrs(attrs) } }
+}
+
+func (h *subsystemHandler) WithGroup(name string) slog.Handler {
+    wrap := h.wrap
+    return &subsystemHandler { h.subsystem, func (root slog.Handler) slog.Handler { return wrap(root).WithGroup(name) } }
+}
+
+// Logs at error level then exits, for startup failures
+func Fatal(logger *slog.Logger, msg string, args ...any) {
+    logger.Error(msg, args...)
+    os.Exit(1)
+}
@@ -0,0 +1,126 @@
+package logging
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "github.com/gin-gonic/gin"
+)
+
+func capture(config Config) *bytes.Buffer {
+    buffer := &bytes.Buffer{}
+    setup(buffer, config)
+    return buffer
+}
+
+func lines(t *testing.T, buffer *bytes.Buffer) []map[string]any {
+    result := make([]map[string]any, 0)
+    for _, line := range strings.Split(strings.TrimSpace(buffer.String()), "\n") {
+        if line == "" {
+            continue
+        }
+        var record map[string]any
+        if err := json.Unmarshal([]byte(line), &record); err != nil {
+            t.Fatal(err)
+        }
+        result = append(result, record)
+    }
+    return result
+}
+
+func TestRedaction(t *testing.T) {
+    buffer := capture(DefaultConfig())
+    For("test").Info("Hello", "token", "abc", "Authorization", "Bearer abc", "playerName", "Bob")
+    record := lines(t, buffer)[0]
+    if record["token"] != redacted || record["Authorization"] != redacted {
+        t.Fatalf("Expected redaction, got %v", record)
+    }
+    if record["playerName"] != "Bob" || record["subsystem"] != "test" {
+        t.Fatalf("Expected other attrs to be kept, got %v", record)
+    }
+
+    config := DefaultConfig()
+    config.Redact = false
+    buffer = capture(config)
+    For("test").Info("Hello", "token", "abc")
+    if record := lines(t, buffer)[0]; record["token"] != "abc" {
+        t.Fatalf("Expected no redaction, got %v", record)
+    }
+}
+
+func TestLevels(t *testing.T) {
+    levels, err := ParseLevels("chat=debug, sessions=warn")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := ParseLevels("chat"); err == nil {
+        t.Fatal("Expected error for missing level")
+    }
+
+    config := DefaultConfig()
+    config.Levels = levels
+    // Made before setup, as package vars would be
+    chat := For("chat")
+    buffer := capture(config)
+    chat.Debug("Shown")
+    For("sessions").Info("Hidden")
+    For("other").Debug("Hidden")
+    For("other").Info("Shown")
+    records := lines(t, buffer)
+    if len(records) != 2 {
+        t.Fatalf("Expected 2 records, got %v", records)
+    }
+    for _, record := range records {
+        if record["msg"] != "Shown" {
+            t.Fatalf("Unexpected record %v", record)
+        }
+    }
+}
+
+func TestRequestID(t *testing.T) {
+    buffer := capture(DefaultConfig())
+    logger := For("test").With("a", 1)
+    logger.InfoContext(WithRequestID(context.Background(), "id1"), "Hello")
+    record := lines(t, buffer)[0]
+    if record["requestId"] != "id1" || record["a"] != float64(1) {
+        t.Fatalf("Expected request ID and attrs, got %v", record)
+    }
+
+    router := gin.New()
+    router.Use(Middleware(For("http")))
+    router.GET("/things/:token", func (c *gin.Context) {
+        For("handler").InfoContext(c.Request.Context(), "Handled")
+        c.Status(http.StatusOK)
+    })
+
+    buffer.Reset()
+    w := httptest.NewRecorder()
+    request := httptest.NewRequest(http.MethodGet, "/things/secret", nil)
+    request.Header.Set(requestIDHeader, "fromProxy")
+    router.ServeHTTP(w, request)
+    if w.Header().Get(requestIDHeader) != "fromProxy" {
+        t.Fatalf("Expected request ID to be echoed, got %s", w.Header().Get(requestIDHeader))
+    }
+    records := lines(t, buffer)
+    if len(records) != 2 || records[0]["requestId"] != "fromProxy" || records[1]["requestId"] != "fromProxy" {
+        t.Fatalf("Expected both records to have the request ID, got %v", records)
+    }
+    if records[1]["route"] != "/things/:token" || strings.Contains(buffer.String(), "/things/secret") {
+        t.Fatalf("Expected route instead of path, got %v", records[1])
+    }
+
+    w = httptest.NewRecorder()
+    router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/things/secret", nil))
+    if id := w.Header().Get(requestIDHeader); id == "" || id == "fromProxy" {
+        t.Fatalf("Expected a new request ID, got %s", id)
+    }
+}
+
+func TestMain(m *testing.M) {
+    gin.SetMode(gin.TestMode)
+    m.Run()
+}
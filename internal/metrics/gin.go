@@ -0,0 +1,30 @@
+package metrics
+
+import (
+    "strconv"
+    "time"
+    "github.com/gin-gonic/gin"
+)
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+func Handler(r *Registry) gin.HandlerFunc {
+    return func (c *gin.Context) {
+        c.Header("Content-Type", contentType)
+        r.Write(c.Writer)
+    }
+}
+
+// Latencies by route pattern rather than path, so IDs don't make a series each
+func Middleware(r *Registry) gin.HandlerFunc {
+    latencies := r.Histogram("http_request_duration_seconds", "HTTP request latencies", DefaultBuckets, "method", "route", "status")
+    return func (c *gin.Context) {
+        start := time.Now()
+        c.Next()
+        route := c.FullPath()
+        if route == "" {
+            route = "unmatched"
+        }
+        latencies.Observe(time.Since(start).Seconds(), c.Request.Method, route, strconv.Itoa(c.Writer.Status()))
+    }
+}
@@ -0,0 +1,43 @@
+package metrics
+
+import (
+    "time"
+    "gorm.io/gorm"
+)
+
+const gormStartKey = "metrics:start"
+
+type gormRegister func (name string, fn func (*gorm.DB)) error
+
+// Times every statement through gorm callbacks, by operation
+func InstrumentGorm(db *gorm.DB, durations *Histogram) error {
+    before := func (tx *gorm.DB) {
+        tx.InstanceSet(gormStartKey, time.Now())
+    }
+    after := func (operation string) func (*gorm.DB) {
+        return func (tx *gorm.DB) {
+            if start, ok := tx.InstanceGet(gormStartKey); ok {
+                durations.Observe(time.Since(start.(time.Time)).Seconds(), operation)
+            }
+        }
+    }
+
+    c := db.Callback()
+    operations := []struct { name string; before gormRegister; after gormRegister } {
+        { "create", c.Create().Before("gorm:create").Register, c.Create().After("gorm:create").Register },
+        { "query", c.Query().Before("gorm:query").Register, c.Query().After("gorm:query").Register },
+        { "update", c.Update().Before("gorm:update").Register, c.Update().After("gorm:update").Register },
+        { "delete", c.Delete().Before("gorm:delete").Register, c.Delete().After("gorm:delete").Register },
+        { "row", c.Row().Before("gorm:row").Register, c.Row().After("gorm:row").Register },
+        { "raw", c.Raw().Before("gorm:raw").Register, c.Raw().After("gorm:raw").Register },
+    }
+    for _, op := range operations {
+        if err := op.before("metrics:before_" + op.name, before); err != nil {
+            return err
+        }
+        if err := op.after("metrics:after_" + op.name, after(op.name)); err != nil {
+            return err
+        }
+    }
+    return nil
+}
@@ -0,0 +1,222 @@
+package metrics
+
+import (
+    "fmt"
+    "io"
+    "math"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// Just enough of the Prometheus text format for counters, gauges and histograms with labels.
+// Metrics are registered once at startup, then updated from any goroutine, including aggregators.
+
+// Seconds, for latencies
+var DefaultBuckets = []float64{ .001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10 }
+
+const (
+    kindCounter = "counter"
+    kindGauge = "gauge"
+    kindHistogram = "histogram"
+)
+
+type series struct {
+    labelValues []string
+    // Counters and gauges
+    value float64
+    // Histograms, cumulative counts are computed on write
+    bucketCounts []uint64
+    sum float64
+    count uint64
+}
+
+type metric struct {
+    name string
+    help string
+    kind string
+    labels []string
+    buckets []float64
+    mutex sync.Mutex
+    // Label values joined by a separator that can't appear in them -> series
+    series map[string]*series
+}
+
+type Registry struct {
+    mutex sync.Mutex
+    metrics []*metric
+    collectors []func ()
+}
+
+func MakeRegistry() *Registry {
+    return &Registry {}
+}
+
+// Each server is its own process, so one registry is enough
+var Default = MakeRegistry()
+
+func (r *Registry) register(name string, help string, kind string, buckets []float64, labels []string) *metric {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    for _, m := range r.metrics {
+        if m.name == name {
+            panic("Duplicate metric " + name)
+        }
+    }
+    m := &metric { name: name, help: help, kind: kind, labels: labels, buckets: buckets, series: make(map[string]*series) }
+    r.metrics = append(r.metrics, m)
+    return m
+}
+
+// Runs before every write, for gauges that are cheaper to read on demand, eg. queue lengths
+func (r *Registry) Collect(collector func ()) {
+    r.mutex.Lock()
+    defer r.mutex.Unlock()
+    r.collectors = append(r.collectors, collector)
+}
+
+// Must be called with the metric locked
+func (m *metric) get(labelValues []string) *series {
+    if len(labelValues) != len(m.labels) {
+        panic(fmt.Sprintf("Metric %s expects %d label values, got %d", m.name, len(m.labels), len(labelValues)))
+    }
+    key := strings.Join(labelValues, "\xff")
+    s, found := m.series[key]
+    if !found {
+        s = &series { labelValues: append([]string{}, labelValues...) }
+        if m.kind == kindHistogram {
+            s.bucketCounts = make([]uint64, len(m.buckets))
+        }
+        m.series[key] = s
+    }
+    return s
+}
+
+//////////////////////////////////////////////////
+
+type Counter struct { m *metric }
+
+func (r *Registry) Counter(name string, help string, labels ...string) *Counter {
+    return &Counter { r.register(name, help, kindCounter, nil, labels) }
+}
+
+func (c *Counter) Add(value float64, labelValues ...string) {
+    if value < 0 {
+        return
+    }
+    c.m.mutex.Lock()
+    defer c.m.mutex.Unlock()
+    c.m.get(labelValues).value += value
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+    c.Add(1, labelValues...)
+}
+
+type Gauge struct { m *metric }
+
+func (r *Registry) Gauge(name string, help string, labels ...string) *Gauge {
+    return &Gauge { r.register(name, help, kindGauge, nil, labels) }
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+    g.m.mutex.Lock()
+    defer g.m.mutex.Unlock()
+    g.m.get(labelValues).value = value
+}
+
+func (g *Gauge) Add(value float64, labelValues ...string) {
+    g.m.mutex.Lock()
+    defer g.m.mutex.Unlock()
+    g.m.get(labelValues).value += value
+}
+
+type Histogram struct { m *metric }
+
+// Buckets are upper bounds in increasing order, +Inf is implied
+func (r *Registry) Histogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+    return &Histogram { r.register(name, help, kindHistogram, buckets, labels) }
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+    h.m.mutex.Lock()
+    defer h.m.mutex.Unlock()
+    s := h.m.get(labelValues)
+    for i, bound := range h.m.buckets {
+        if value <= bound {
+            s.bucketCounts[i]++
+            break
+        }
+    }
+    s.sum += value
+    s.count++
+}
+
+//////////////////////////////////////////////////
+// Text format
+
+func formatFloat(value float64) string {
+    if math.IsInf(value, 1) {
+        return "+Inf"
+    }
+    return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func formatLabels(names []string, values []string, extraName string, extraValue string) string {
+    pairs := make([]string, 0, len(names) + 1)
+    for i, name := range names {
+        pairs = append(pairs, name + `="` + labelEscaper.Replace(values[i]) + `"`)
+    }
+    if extraName != "" {
+        pairs = append(pairs, extraName + `="` + extraValue + `"`)
+    }
+    if len(pairs) == 0 {
+        return ""
+    }
+    return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (m *metric) write(w io.Writer) {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, helpEscaper.Replace(m.help), m.name, m.kind)
+
+    keys := make([]string, 0, len(m.series))
+    for key := range m.series {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    for _, key := range keys {
+        s := m.series[key]
+        if m.kind != kindHistogram {
+            fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, s.labelValues, "", ""), formatFloat(s.value))
+            continue
+        }
+        var cumulative uint64
+        for i, bound := range m.buckets {
+            cumulative += s.bucketCounts[i]
+            fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "le", formatFloat(bound)), cumulative)
+        }
+        fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "le", "+Inf"), s.count)
+        fmt.Fprintf(w, "%s_sum%s %s\n", m.name, formatLabels(m.labels, s.labelValues, "", ""), formatFloat(s.sum))
+        fmt.Fprintf(w, "%s_count%s %d\n", m.name, formatLabels(m.labels, s.labelValues, "", ""), s.count)
+    }
+}
+
+func (r *Registry) Write(w io.Writer) {
+    r.mutex.Lock()
+    collectors := append([]func (){}, r.collectors...)
+    metrics := append([]*metric{}, r.metrics...)
+    r.mutex.Unlock()
+
+    for _, collector := range collectors {
+        collector()
+    }
+    for _, m := range metrics {
+        m.write(w)
+    }
+}
@@ -0,0 +1,98 @@
+package metrics
+
+import (
+    "bytes"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "github.com/gin-gonic/gin"
+    "gorm.io/driver/sqlite"
+    "gorm.io/gorm"
+)
+
+func expectLines(t *testing.T, output string, lines ...string) {
+    for _, line := range lines {
+        if !strings.Contains(output, line + "\n") {
+            t.Fatalf("Expected %q in:\n%s", line, output)
+        }
+    }
+}
+
+func TestWrite(t *testing.T) {
+    r := MakeRegistry()
+    inserted := r.Counter("inserted_total", "Rows inserted")
+    failures := r.Counter("failures_total", "Failures by reason", "reason")
+    clients := r.Gauge("clients", "Connected clients")
+    durations := r.Histogram("duration_seconds", "Durations", []float64{ 0.1, 1 })
+    queued := 0
+    r.Collect(func () {
+        clients.Set(float64(queued))
+    })
+
+    inserted.Add(3)
+    inserted.Inc()
+    inserted.Add(-5)
+    failures.Inc("bad \"quote\"")
+    durations.Observe(0.05)
+    durations.Observe(0.5)
+    durations.Observe(5)
+    queued = 7
+
+    var buf bytes.Buffer
+    r.Write(&buf)
+    expectLines(t, buf.String(),
+        "# HELP inserted_total Rows inserted",
+        "# TYPE inserted_total counter",
+        "inserted_total 4",
+        `failures_total{reason="bad \"quote\""} 1`,
+        "# TYPE clients gauge",
+        "clients 7",
+        "# TYPE duration_seconds histogram",
+        `duration_seconds_bucket{le="0.1"} 1`,
+        `duration_seconds_bucket{le="1"} 2`,
+        `duration_seconds_bucket{le="+Inf"} 3`,
+        "duration_seconds_sum 5.55",
+        "duration_seconds_count 3",
+    )
+}
+
+func TestMiddleware(t *testing.T) {
+    gin.SetMode(gin.TestMode)
+    r := MakeRegistry()
+    router := gin.New()
+    router.Use(Middleware(r))
+    router.GET("/token/:id", func (c *gin.Context) {
+        c.Status(http.StatusNotFound)
+    })
+    router.GET("/metrics", Handler(r))
+
+    router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/token/abc", nil))
+    router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/token/def", nil))
+    router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/missing", nil))
+    w := httptest.NewRecorder()
+    router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+    expectLines(t, w.Body.String(),
+        `http_request_duration_seconds_count{method="GET",route="/token/:id",status="404"} 2`,
+        `http_request_duration_seconds_count{method="GET",route="unmatched",status="404"} 1`,
+    )
+}
+
+func TestInstrumentGorm(t *testing.T) {
+    db, err := gorm.Open(sqlite.Open(":memory:"), &gorm.Config{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    r := MakeRegistry()
+    if err := InstrumentGorm(db, r.Histogram("db_query_duration_seconds", "Durations", DefaultBuckets, "operation")); err != nil {
+        t.Fatal(err)
+    }
+    db.Exec("create table t (id integer)")
+    var count int64
+    db.Raw("select count(*) from t").Scan(&count)
+
+    var buf bytes.Buffer
+    r.Write(&buf)
+    expectLines(t, buf.String(), `db_query_duration_seconds_count{operation="raw"} 1`)
+}
@@ -0,0 +1,73 @@
+package shutdown
+
+import (
+    "context"
+    "errors"
+    "net"
+    "net/http"
+    "os"
+    "os/signal"
+    "sync"
+    "syscall"
+    "time"
+	"github.com/starqi/wi-util-servers/internal/logging"
+)
+
+// Graceful shutdown on SIGINT or SIGTERM, shared by the servers.
+// HTTP requests are drained first, then hooks stop everything the HTTP server doesn't own, eg. websockets,
+// tickers and DBs, in order and within the same deadline.
+
+var logger = logging.For("shutdown")
+
+// Should give up when the context is done, and log their own errors
+type Hook func (ctx context.Context)
+
+var draining = make(chan struct{})
+var drainOnce sync.Once
+
+// Closed when shutdown starts. Long-lived responses, eg. event streams, should end on it, or else
+// they hold up draining until the deadline.
+func Draining() <-chan struct{} {
+    return draining
+}
+
+// Blocks until shut down, only returns an error if the server could not start
+func Run(handler http.Handler, addr string, timeout time.Duration, hooks ...Hook) error {
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+    listener, err := net.Listen("tcp", addr)
+    if err != nil {
+        return err
+    }
+    logger.Info("Listening", "addr", listener.Addr().String())
+    return serve(ctx, listener, &http.Server { Handler: handler }, timeout, hooks)
+}
+
+func serve(ctx context.Context, listener net.Listener, srv *http.Server, timeout time.Duration, hooks []Hook) error {
+    errs := make(chan error, 1)
+    go func () {
+        errs <- srv.Serve(listener)
+    }()
+    select {
+    case err := <-errs:
+        if !errors.Is(err, http.ErrServerClosed) {
+            return err
+        }
+        return nil
+    case <-ctx.Done():
+    }
+
+    logger.Info("Shutting down", "timeout", timeout.String())
+    deadline, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+    drainOnce.Do(func () { close(draining) })
+    // Stops accepting, then waits for in-flight requests, but not hijacked connections
+    if err := srv.Shutdown(deadline); err != nil {
+        logger.Warn("HTTP requests not drained", "err", err)
+    }
+    for _, hook := range hooks {
+        hook(deadline)
+    }
+    logger.Info("Shut down")
+    return nil
+}
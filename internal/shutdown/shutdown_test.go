@@ -0,0 +1,85 @@
+package shutdown
+
+import (
+    "context"
+    "io"
+    "net"
+    "net/http"
+    "testing"
+    "time"
+)
+
+func TestServeDrainsThenRunsHooks(t *testing.T) {
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    started := make(chan bool)
+    handler := http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+        started <- true
+        time.Sleep(50 * time.Millisecond)
+        w.Write([]byte("done"))
+    })
+
+    ctx, stop := context.WithCancel(context.Background())
+    order := make([]string, 0)
+    served := make(chan error, 1)
+    go func () {
+        served <- serve(ctx, listener, &http.Server { Handler: handler }, time.Second, []Hook {
+            func (ctx context.Context) { order = append(order, "first") },
+            func (ctx context.Context) { order = append(order, "second") },
+        })
+    }()
+
+    responses := make(chan string, 1)
+    go func () {
+        resp, err := http.Get("http://" + listener.Addr().String())
+        if err != nil {
+            responses <- err.Error()
+            return
+        }
+        defer resp.Body.Close()
+        body, _ := io.ReadAll(resp.Body)
+        responses <- string(body)
+    }()
+
+    // Signal mid-request
+    <-started
+    stop()
+    if body := <-responses; body != "done" {
+        t.Fatalf("Expected in-flight request to finish, got %q", body)
+    }
+    if err := <-served; err != nil {
+        t.Fatal(err)
+    }
+    if len(order) != 2 || order[0] != "first" || order[1] != "second" {
+        t.Fatalf("Expected hooks in order, got %v", order)
+    }
+    if _, err := http.Get("http://" + listener.Addr().String()); err == nil {
+        t.Fatal("Expected new connections to be refused")
+    }
+}
+
+func TestHooksShareDeadline(t *testing.T) {
+    listener, _ := net.Listen("tcp", "127.0.0.1:0")
+    ctx, stop := context.WithCancel(context.Background())
+    stop()
+    var remaining time.Duration
+    err := serve(ctx, listener, &http.Server {}, time.Second, []Hook {
+        func (ctx context.Context) {
+            deadline, _ := ctx.Deadline()
+            remaining = time.Until(deadline)
+        },
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    if remaining <= 0 || remaining > time.Second {
+        t.Fatal("Expected hooks to get the shutdown deadline, got ", remaining)
+    }
+    select {
+    case <-Draining():
+    default:
+        t.Fatal("Expected draining to be closed")
+    }
+}
@@ -0,0 +1,95 @@
+package token
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "strings"
+    "time"
+)
+
+// Compact JWT with HS256, so that other servers can verify session tokens offline with the shared secret.
+// Revocation is not visible offline, see the sessions service's revocation list.
+
+var ErrMalformed = errors.New("Malformed token")
+var ErrSignature = errors.New("Invalid token signature")
+var ErrExpired = errors.New("Token expired")
+
+const minSecretBytes = 16
+
+var header = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+type Claims struct {
+    SessionID string `json:"sid"`
+    PlayerName string `json:"name,omitempty"`
+    GameInstance string `json:"gi,omitempty"`
+    IsInGame bool `json:"inGame,omitempty"`
+    // Unix seconds
+    IssuedAt int64 `json:"iat"`
+    Expiry int64 `json:"exp"`
+    // No refresh extends the expiry past this, zero if unbounded
+    MaxExpiry int64 `json:"maxExp,omitempty"`
+    // Incremented whenever the session is re-signed, so that older tokens can be rejected
+    Version int64 `json:"ver,omitempty"`
+}
+
+type Signer struct {
+    secret []byte
+}
+
+func MakeSigner(secret []byte) (*Signer, error) {
+    if len(secret) < minSecretBytes {
+        return nil, errors.New("Token secret is too short")
+    }
+    return &Signer { secret }, nil
+}
+
+func (s *Signer) signature(signed string) string {
+    mac := hmac.New(sha256.New, s.secret)
+    mac.Write([]byte(signed))
+    return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Signer) Sign(claims *Claims) (string, error) {
+    payload, err := json.Marshal(claims)
+    if err != nil {
+        return "", err
+    }
+    signed := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+    return signed + "." + s.signature(signed), nil
+}
+
+// Checks the signature but not the expiry
+func (s *Signer) Parse(token string) (*Claims, error) {
+    parts := strings.Split(token, ".")
+    if len(parts) != 3 || parts[0] != header {
+        return nil, ErrMalformed
+    }
+    expected := s.signature(parts[0] + "." + parts[1])
+    if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+        return nil, ErrSignature
+    }
+    payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+    if err != nil {
+        return nil, ErrMalformed
+    }
+    var claims Claims
+    if err := json.Unmarshal(payload, &claims); err != nil || claims.SessionID == "" {
+        return nil, ErrMalformed
+    }
+    return &claims, nil
+}
+
+// For offline verification
+func (s *Signer) Verify(token string, now time.Time) (*Claims, error) {
+    claims, err := s.Parse(token)
+    if err != nil {
+        return nil, err
+    }
+    if now.Unix() >= claims.Expiry {
+        return nil, ErrExpired
+    }
+    return claims, nil
+}
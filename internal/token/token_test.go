@@ -0,0 +1,63 @@
+package token
+
+import (
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestSignAndVerify(t *testing.T) {
+    signer, err := MakeSigner([]byte("0123456789abcdef"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    now := time.Now()
+    signed, err := signer.Sign(&Claims {
+        SessionID: "abc",
+        PlayerName: "Bob",
+        GameInstance: "game1",
+        IsInGame: true,
+        IssuedAt: now.Unix(),
+        Expiry: now.Add(time.Minute).Unix(),
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    claims, err := signer.Verify(signed, now)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if claims.SessionID != "abc" || claims.PlayerName != "Bob" || !claims.IsInGame {
+        t.Fatalf("Unexpected claims %v", claims)
+    }
+
+    if _, err := signer.Verify(signed, now.Add(time.Hour)); err != ErrExpired {
+        t.Fatalf("Expected expired, got %v", err)
+    }
+    if _, err := signer.Parse(signed); err != nil {
+        t.Fatalf("Expected parse to ignore expiry, got %v", err)
+    }
+
+    other, _ := MakeSigner([]byte("fedcba9876543210"))
+    if _, err := other.Verify(signed, now); err != ErrSignature {
+        t.Fatalf("Expected signature error, got %v", err)
+    }
+
+    parts := strings.Split(signed, ".")
+    tampered := parts[0] + "." + parts[1] + "x." + parts[2]
+    if _, err := signer.Verify(tampered, now); err != ErrSignature {
+        t.Fatalf("Expected signature error for tampered payload, got %v", err)
+    }
+    if _, err := signer.Verify("not-a-token", now); err != ErrMalformed {
+        t.Fatalf("Expected malformed, got %v", err)
+    }
+
+    if _, err := MakeSigner([]byte("short")); err == nil {
+        t.Fatal("Expected short secret to be rejected")
+    }
+}
+
+func TestMain(m *testing.M) {
+    m.Run()
+}
@@ -0,0 +1,10 @@
+#!/bin/bash
+
+mkdir -p ../dist
+migrate -source file://../db/chat-migrations -database sqlite3://../dist/chat.db up
+if [ $? != 0 ]; then
+    echo error
+    exit 1
+fi
+
+echo finished